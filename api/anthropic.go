@@ -0,0 +1,441 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/jnb666/gpt-go/api/tools"
+	"github.com/openai/openai-go/v3"
+	"github.com/openai/openai-go/v3/option"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// Anthropic Messages API version header
+	AnthropicVersion = "2023-06-01"
+	// Max tokens to generate per request - this is a required parameter for the Messages API
+	AnthropicMaxTokens = 32000
+	// Context length returned by MaxModelLength
+	AnthropicContextLength = 200000
+	// Extended thinking budget for each reasoning effort level - thinking is disabled if not listed
+	AnthropicThinkingBudget = map[string]int{"low": 2048, "medium": 8192, "high": 24576}
+)
+
+// Anthropic Messages API - uses the ANTHROPIC_API_KEY environment variable for authentication if the endpoint API key is not set.
+type anthropicProvider struct{}
+
+func (anthropicProvider) Name() string {
+	return Anthropic
+}
+
+func (anthropicProvider) Defaults() (baseURL, modelName string) {
+	return "https://api.anthropic.com/v1", "claude-sonnet-4-5"
+}
+
+func (anthropicProvider) ReasoningField() string {
+	return ""
+}
+
+func (anthropicProvider) RequestOptions(req *openai.ChatCompletionNewParams) []option.RequestOption {
+	return nil
+}
+
+func (anthropicProvider) MaxModelLength(c *Client) (int, error) {
+	return AnthropicContextLength, nil
+}
+
+func (anthropicProvider) Tokenize(c *Client, messages []openai.ChatCompletionMessageParamUnion) (int, error) {
+	type Response struct {
+		InputTokens int `json:"input_tokens"`
+	}
+	var conv Conversation
+	for _, m := range messages {
+		if m.OfSystem != nil {
+			conv.Config.SystemPrompt = m.OfSystem.Content.OfString.Value
+		} else {
+			conv.Messages = append(conv.Messages, ToMessage(m, ""))
+		}
+	}
+	req := newAnthropicRequest(c.ModelName, conv, nil)
+	req.MaxTokens, req.Temperature, req.TopK = 0, nil, 0
+	var resp Response
+	_, err := tools.Post(c.BaseURL+"/messages/count_tokens", req, &resp, anthropicHeaders(c)...)
+	return resp.InputTokens, err
+}
+
+// Generate next message using the Messages API
+func (anthropicProvider) Complete(ctx context.Context, c *Client, conv Conversation, tools []ToolFunction, stream bool, callback CallbackFunc) (
+	resp Completion, err error) {
+
+	req := newAnthropicRequest(c.ModelName, conv, conv.Config.EnabledTools(tools))
+	req.Stream = stream
+	body := marshal(req)
+	if TraceRequests {
+		pprint("request", string(body))
+	}
+	r, err := http.NewRequestWithContext(ctx, "POST", c.BaseURL+"/messages", bytes.NewReader(body))
+	if err != nil {
+		return resp, err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	for _, h := range anthropicHeaders(c) {
+		r.Header.Set(h.Key, h.Value)
+	}
+	res, err := http.DefaultClient.Do(r)
+	if err != nil {
+		return resp, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		data, _ := io.ReadAll(res.Body)
+		return resp, anthropicError(res, data)
+	}
+	if stream {
+		return anthropicStream(res.Body, callback)
+	}
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return resp, err
+	}
+	if TraceRequests {
+		pprint("response", string(data))
+	}
+	var msg anthropicResponse
+	if err = json.Unmarshal(data, &msg); err != nil {
+		return resp, err
+	}
+	return msg.completion(), nil
+}
+
+type anthropicRequest struct {
+	Model       string             `json:"model"`
+	MaxTokens   int                `json:"max_tokens,omitzero"`
+	System      string             `json:"system,omitzero"`
+	Messages    []anthropicMessage `json:"messages"`
+	Tools       []anthropicTool    `json:"tools,omitzero"`
+	Thinking    *anthropicThinking `json:"thinking,omitzero"`
+	Temperature *float64           `json:"temperature,omitzero"`
+	TopK        int                `json:"top_k,omitzero"`
+	Stream      bool               `json:"stream,omitzero"`
+}
+
+type anthropicMessage struct {
+	Role    string           `json:"role"`
+	Content []anthropicBlock `json:"content"`
+}
+
+type anthropicBlock struct {
+	Type      string           `json:"type"`
+	Text      string           `json:"text,omitzero"`
+	Thinking  string           `json:"thinking,omitzero"`
+	Signature string           `json:"signature,omitzero"`
+	Data      string           `json:"data,omitzero"`
+	ID        string           `json:"id,omitzero"`
+	Name      string           `json:"name,omitzero"`
+	Input     json.RawMessage  `json:"input,omitzero"`
+	ToolUseID string           `json:"tool_use_id,omitzero"`
+	Content   string           `json:"content,omitzero"`
+	Source    *anthropicSource `json:"source,omitzero"`
+}
+
+// image source - base64 encoded data or a URL
+type anthropicSource struct {
+	Type      string `json:"type"`
+	MediaType string `json:"media_type,omitzero"`
+	Data      string `json:"data,omitzero"`
+	URL       string `json:"url,omitzero"`
+}
+
+type anthropicTool struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitzero"`
+	InputSchema any    `json:"input_schema"`
+}
+
+type anthropicThinking struct {
+	Type         string `json:"type"`
+	BudgetTokens int    `json:"budget_tokens"`
+}
+
+type anthropicUsage struct {
+	InputTokens              int64 `json:"input_tokens"`
+	OutputTokens             int64 `json:"output_tokens"`
+	CacheCreationInputTokens int64 `json:"cache_creation_input_tokens"`
+	CacheReadInputTokens     int64 `json:"cache_read_input_tokens"`
+}
+
+type anthropicResponse struct {
+	Model      string           `json:"model"`
+	Content    []anthropicBlock `json:"content"`
+	StopReason string           `json:"stop_reason"`
+	Usage      anthropicUsage   `json:"usage"`
+}
+
+// Streaming event - fields are set depending on the event type
+type anthropicEvent struct {
+	Type         string            `json:"type"`
+	Message      anthropicResponse `json:"message"`
+	Index        int               `json:"index"`
+	ContentBlock anthropicBlock    `json:"content_block"`
+	Delta        struct {
+		Type        string `json:"type"`
+		Text        string `json:"text"`
+		Thinking    string `json:"thinking"`
+		Signature   string `json:"signature"`
+		PartialJSON string `json:"partial_json"`
+		StopReason  string `json:"stop_reason"`
+	} `json:"delta"`
+	Usage anthropicUsage `json:"usage"`
+	Error struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// Convert conversation to Messages API request. Thinking blocks are only sent from the start of the latest turn
+// and only if they were returned in a previous Anthropic response. They are sent back unchanged with their signatures.
+func newAnthropicRequest(modelName string, conv Conversation, tools []ToolFunction) anthropicRequest {
+	cfg := conv.Config
+	req := anthropicRequest{Model: modelName, MaxTokens: AnthropicMaxTokens, System: conv.instructions()}
+	if cfg.ResponseFormat != nil {
+		// no response format option so the schema is added to the system prompt
+		req.System = trim(req.System + "\n\n" + cfg.ResponseFormat.prompt())
+	}
+	if budget, ok := AnthropicThinkingBudget[cfg.ReasoningEffort]; ok {
+		req.Thinking = &anthropicThinking{Type: "enabled", BudgetTokens: min(budget, AnthropicMaxTokens-1)}
+	} else {
+		// temperature and top_k are not compatible with extended thinking, top_p cannot be combined with temperature
+		temperature := min(cfg.Temperature, 1)
+		req.Temperature = &temperature
+		req.TopK = cfg.TopK
+	}
+	for _, tool := range tools {
+		def := tool.Definition()
+		t := anthropicTool{Name: def.Name, Description: def.Description.Value, InputSchema: def.Parameters}
+		if def.Parameters == nil {
+			t.InputSchema = map[string]any{"type": "object"}
+		}
+		req.Tools = append(req.Tools, t)
+	}
+	reasoningFrom := conv.LastUserMessageNumber()
+	for i, m := range conv.Messages {
+		if m.Excluded {
+			continue
+		}
+		var role string
+		var blocks []anthropicBlock
+		switch m.Role {
+		case "user":
+			role = "user"
+			if len(m.Parts) > 0 {
+				blocks = append(blocks, anthropicContent(m.Parts)...)
+			} else if m.Content != "" {
+				blocks = append(blocks, anthropicBlock{Type: "text", Text: m.Content})
+			}
+		case "assistant":
+			role = "assistant"
+			if req.Thinking != nil && i >= reasoningFrom {
+				blocks = append(blocks, anthropicThinkingBlocks(m)...)
+			}
+			if isSet(m.Content) {
+				blocks = append(blocks, anthropicBlock{Type: "text", Text: m.Content})
+			}
+			blocks = append(blocks, anthropicToolUse(m.ToolCall)...)
+		case "tool":
+			role = "user"
+			blocks = append(blocks, anthropicBlock{Type: "tool_result", ToolUseID: m.ToolCallID, Content: m.Content})
+		default:
+			panic("invalid message role: " + m.Role)
+		}
+		if len(blocks) == 0 {
+			continue
+		}
+		// consecutive messages with the same role must be merged - e.g. results from parallel tool calls
+		if n := len(req.Messages); n > 0 && req.Messages[n-1].Role == role {
+			req.Messages[n-1].Content = append(req.Messages[n-1].Content, blocks...)
+		} else {
+			req.Messages = append(req.Messages, anthropicMessage{Role: role, Content: blocks})
+		}
+	}
+	return req
+}
+
+// thinking and redacted_thinking blocks saved from the response, or a single block if saved with only a signature
+func anthropicThinkingBlocks(m Message) (blocks []anthropicBlock) {
+	if len(m.ReasoningBlocks) > 0 {
+		if err := json.Unmarshal(m.ReasoningBlocks, &blocks); err != nil {
+			log.Warnf("invalid thinking blocks: %s", err)
+			return nil
+		}
+		return blocks
+	}
+	if m.Signature != "" {
+		blocks = append(blocks, anthropicBlock{Type: "thinking", Thinking: m.Reasoning, Signature: m.Signature})
+	}
+	return blocks
+}
+
+// text and image blocks from multimodal message content
+func anthropicContent(parts []ContentPart) (blocks []anthropicBlock) {
+	for _, p := range parts {
+		switch p.Type {
+		case "text":
+			if p.Text != "" {
+				blocks = append(blocks, anthropicBlock{Type: "text", Text: p.Text})
+			}
+		case "image":
+			url, err := p.ImageURL()
+			if err != nil {
+				blocks = append(blocks, anthropicBlock{Type: "text", Text: missingImage(p, err)})
+				continue
+			}
+			source := &anthropicSource{Type: "url", URL: url}
+			if mediaType, data, ok := parseDataURL(url); ok {
+				source = &anthropicSource{Type: "base64", MediaType: mediaType, Data: data}
+			}
+			blocks = append(blocks, anthropicBlock{Type: "image", Source: source})
+		}
+	}
+	return blocks
+}
+func anthropicToolUse(data json.RawMessage) (blocks []anthropicBlock) {
+	for _, call := range toolCalls(data) {
+		input := json.RawMessage(call.Function.Arguments)
+		if !json.Valid(input) {
+			log.Warnf("invalid tool call arguments for %s: %q", call.Function.Name, call.Function.Arguments)
+			input = json.RawMessage("{}")
+		}
+		blocks = append(blocks, anthropicBlock{Type: "tool_use", ID: call.ID, Name: call.Function.Name, Input: input})
+	}
+	return blocks
+}
+
+// parse server sent events and accumulate response
+func anthropicStream(r io.Reader, callback CallbackFunc) (resp Completion, err error) {
+	var msg anthropicResponse
+	resp.Streamer = NewStreamer(callback)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 16*1024*1024)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data:")
+		if !ok {
+			continue
+		}
+		if TraceStream {
+			pprint("event", data)
+		}
+		var ev anthropicEvent
+		if err = json.Unmarshal([]byte(data), &ev); err != nil {
+			return resp, err
+		}
+		switch ev.Type {
+		case "message_start":
+			msg = ev.Message
+		case "content_block_start":
+			for len(msg.Content) <= ev.Index {
+				msg.Content = append(msg.Content, anthropicBlock{})
+			}
+			msg.Content[ev.Index] = ev.ContentBlock
+			if ev.ContentBlock.Type == "tool_use" {
+				// input is sent as {} in the start event and then streamed as input_json_delta - blank input is
+				// replaced with {} when the completion is generated
+				msg.Content[ev.Index].Input = nil
+				resp.Streamer.ToolCallDelta()
+			}
+		case "content_block_delta":
+			if ev.Index >= len(msg.Content) {
+				return resp, fmt.Errorf("stream error: delta for unknown content block %d", ev.Index)
+			}
+			block := &msg.Content[ev.Index]
+			switch ev.Delta.Type {
+			case "text_delta":
+				block.Text += ev.Delta.Text
+				resp.Content += ev.Delta.Text
+				resp.Streamer.Content(ev.Delta.Text)
+			case "thinking_delta":
+				block.Thinking += ev.Delta.Thinking
+				resp.Reasoning += ev.Delta.Thinking
+				resp.Streamer.Reasoning(ev.Delta.Thinking)
+			case "signature_delta":
+				block.Signature += ev.Delta.Signature
+			case "input_json_delta":
+				block.Input = append(block.Input, ev.Delta.PartialJSON...)
+			}
+		case "content_block_stop":
+			if ev.Index < len(msg.Content) && msg.Content[ev.Index].Type == "tool_use" {
+				resp.Streamer.EndToolCall()
+			}
+		case "message_delta":
+			msg.StopReason = ev.Delta.StopReason
+			msg.Usage.OutputTokens = ev.Usage.OutputTokens
+		case "error":
+			return resp, fmt.Errorf("error %s: %s", ev.Error.Type, ev.Error.Message)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return resp, err
+	}
+	streamer := resp.Streamer
+	resp = msg.completion()
+	resp.Streamer = streamer
+	return resp, nil
+}
+
+// convert response content blocks to completion
+func (r anthropicResponse) completion() Completion {
+	resp := Completion{Model: r.Model}
+	var thinking []anthropicBlock
+	for _, block := range r.Content {
+		switch block.Type {
+		case "text":
+			resp.Content += block.Text
+		case "thinking":
+			resp.Reasoning += block.Thinking
+			thinking = append(thinking, block)
+		case "redacted_thinking":
+			thinking = append(thinking, block)
+		case "tool_use":
+			args := string(block.Input)
+			if args == "" {
+				args = "{}"
+			}
+			resp.ToolCalls = append(resp.ToolCalls, toolCallUnion(block.ID, block.Name, args))
+		}
+	}
+	if len(thinking) > 0 {
+		resp.Blocks = marshal(thinking)
+	}
+	prompt := r.Usage.InputTokens + r.Usage.CacheCreationInputTokens + r.Usage.CacheReadInputTokens
+	resp.Usage = openai.CompletionUsage{
+		PromptTokens:        prompt,
+		CompletionTokens:    r.Usage.OutputTokens,
+		TotalTokens:         prompt + r.Usage.OutputTokens,
+		PromptTokensDetails: openai.CompletionUsagePromptTokensDetails{CachedTokens: r.Usage.CacheReadInputTokens},
+	}
+	return resp
+}
+
+func anthropicHeaders(c *Client) []tools.Header {
+	return []tools.Header{
+		{Key: "x-api-key", Value: cmp.Or(c.apiKey, os.Getenv("ANTHROPIC_API_KEY"), os.Getenv("OPENAI_API_KEY"))},
+		{Key: "anthropic-version", Value: AnthropicVersion},
+	}
+}
+
+func anthropicError(res *http.Response, body []byte) error {
+	var v struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	json.Unmarshal(body, &v)
+	return &StatusError{StatusCode: res.StatusCode, Message: cmp.Or(v.Error.Message, http.StatusText(res.StatusCode)), Header: res.Header}
+}
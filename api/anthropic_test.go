@@ -0,0 +1,226 @@
+package api_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/jnb666/gpt-go/api"
+	"github.com/openai/openai-go/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAnthropicToolCall(t *testing.T) {
+	var requests []map[string]any
+	record := func(body string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "/messages", r.URL.Path)
+			assert.Equal(t, api.AnthropicVersion, r.Header.Get("anthropic-version"))
+			var req map[string]any
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+			requests = append(requests, req)
+			jsonResponse(body)(w, r)
+		}
+	}
+	client := anthropicClient(t,
+		record(`{"model":"claude-test","stop_reason":"tool_use","content":[
+			{"type":"thinking","thinking":"need to sleep","signature":"sig1"},
+			{"type":"tool_use","id":"toolu_1","name":"sleep","input":{"id":"a"}}],
+			"usage":{"input_tokens":10,"output_tokens":7}}`),
+		record(`{"model":"claude-test","stop_reason":"end_turn","content":[{"type":"text","text":"It is sunny"}],
+			"usage":{"input_tokens":30,"cache_read_input_tokens":15,"output_tokens":4}}`),
+	)
+	tool := &sleepTool{name: "sleep"}
+	conv := newTestConversation(tool)
+
+	var analysis []string
+	callback := func(channel, content string, index int, end bool) {
+		if channel == "analysis" {
+			analysis = append(analysis, content)
+		}
+	}
+	var stats api.Stats
+	msgs, err := client.ChatCompletion(t.Context(), conv, callback, func(s api.Stats) { stats = s }, tool)
+	require.NoError(t, err)
+	t.Log(api.Pretty(msgs))
+
+	require.Len(t, msgs, 3)
+	assert.Equal(t, "need to sleep", msgs[0].Reasoning)
+	assert.JSONEq(t, `[{"type":"thinking","thinking":"need to sleep","signature":"sig1"}]`, string(msgs[0].ReasoningBlocks))
+	var calls []openai.ChatCompletionMessageToolCallUnion
+	require.NoError(t, json.Unmarshal(msgs[0].ToolCall, &calls))
+	require.Len(t, calls, 1)
+	assert.Equal(t, "toolu_1", calls[0].ID)
+	assert.Equal(t, "sleep", calls[0].Function.Name)
+	assert.JSONEq(t, `{"id":"a"}`, calls[0].Function.Arguments)
+	assert.Equal(t, api.Message{Role: "tool", Content: `{"id":"a"}`, ToolCallID: "toolu_1"}, msgs[1])
+	assert.Equal(t, "It is sunny", msgs[2].Content)
+	assert.Equal(t, []string{"need to sleep"}, analysis)
+	assert.Equal(t, 45, stats.PromptTokens)
+	assert.Equal(t, 11, stats.CompletionTokens)
+
+	require.Len(t, requests, 2)
+	first := requests[0]
+	assert.Equal(t, "test-model", first["model"])
+	assert.Contains(t, first["system"], "helpful")
+	assert.Equal(t, map[string]any{"type": "enabled", "budget_tokens": float64(8192)}, first["thinking"])
+	assert.NotContains(t, first, "temperature")
+	assert.Equal(t, "sleep", first["tools"].([]any)[0].(map[string]any)["name"])
+	// thinking block and tool_use replayed followed by tool result as user message
+	messages := requests[1]["messages"].([]any)
+	assert.Equal(t, toJSON(messages[len(messages)-2:]), toJSON([]any{
+		map[string]any{"role": "assistant", "content": []any{
+			map[string]any{"type": "thinking", "thinking": "need to sleep", "signature": "sig1"},
+			map[string]any{"type": "tool_use", "id": "toolu_1", "name": "sleep", "input": map[string]any{"id": "a"}},
+		}},
+		map[string]any{"role": "user", "content": []any{
+			map[string]any{"type": "tool_result", "tool_use_id": "toolu_1", "content": `{"id":"a"}`},
+		}},
+	}))
+}
+
+func TestAnthropicThinkingBlocks(t *testing.T) {
+	var requests []map[string]any
+	record := func(body string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			var req map[string]any
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+			requests = append(requests, req)
+			jsonResponse(body)(w, r)
+		}
+	}
+	client := anthropicClient(t,
+		record(`{"model":"claude-test","stop_reason":"tool_use","content":[
+			{"type":"thinking","thinking":"first","signature":"sig1"},
+			{"type":"redacted_thinking","data":"opaque"},
+			{"type":"thinking","thinking":"second","signature":"sig2"},
+			{"type":"tool_use","id":"toolu_1","name":"sleep","input":{}}],
+			"usage":{"input_tokens":10,"output_tokens":7}}`),
+		record(`{"model":"claude-test","stop_reason":"end_turn","content":[{"type":"text","text":"done"}],
+			"usage":{"input_tokens":30,"output_tokens":4}}`),
+	)
+	tool := &sleepTool{name: "sleep"}
+	msgs, err := client.ChatCompletion(t.Context(), newTestConversation(tool), discard, nil, tool)
+	require.NoError(t, err)
+	require.Len(t, msgs, 3)
+	assert.Equal(t, "firstsecond", msgs[0].Reasoning)
+
+	// each block is sent back unchanged with its own signature
+	require.Len(t, requests, 2)
+	messages := requests[1]["messages"].([]any)
+	content := messages[len(messages)-2].(map[string]any)["content"].([]any)
+	assert.Equal(t, toJSON(content[:3]), toJSON([]any{
+		map[string]any{"type": "thinking", "thinking": "first", "signature": "sig1"},
+		map[string]any{"type": "redacted_thinking", "data": "opaque"},
+		map[string]any{"type": "thinking", "thinking": "second", "signature": "sig2"},
+	}))
+}
+
+func TestAnthropicTokenize(t *testing.T) {
+	testServer(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/messages/count_tokens", r.URL.Path)
+		var req map[string]any
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		assert.Len(t, req["messages"], 3)
+		jsonResponse(`{"input_tokens":42}`)(w, r)
+	})
+	client, err := api.NewClient(api.Anthropic, "test-model")
+	require.NoError(t, err)
+	req := client.NewRequest(client.ModelName, newTestConversation())
+	n, err := client.Tokenize(req.Messages)
+	require.NoError(t, err)
+	assert.Equal(t, 42, n)
+}
+
+func TestAnthropicStream(t *testing.T) {
+	client := anthropicClient(t, sseResponse(
+		`{"type":"message_start","message":{"model":"claude-test","content":[],"usage":{"input_tokens":12,"output_tokens":1}}}`,
+		`{"type":"content_block_start","index":0,"content_block":{"type":"thinking","thinking":""}}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"thinking_delta","thinking":"Let me "}}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"thinking_delta","thinking":"count"}}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"signature_delta","signature":"sig"}}`,
+		`{"type":"content_block_stop","index":0}`,
+		`{"type":"content_block_start","index":1,"content_block":{"type":"text","text":""}}`,
+		`{"type":"content_block_delta","index":1,"delta":{"type":"text_delta","text":"There are "}}`,
+		`{"type":"content_block_delta","index":1,"delta":{"type":"text_delta","text":"3"}}`,
+		`{"type":"content_block_stop","index":1}`,
+		`{"type":"content_block_start","index":2,"content_block":{"type":"tool_use","id":"toolu_1","name":"sleep","input":{}}}`,
+		`{"type":"content_block_delta","index":2,"delta":{"type":"input_json_delta","partial_json":""}}`,
+		`{"type":"content_block_delta","index":2,"delta":{"type":"input_json_delta","partial_json":"{\"ms\": "}}`,
+		`{"type":"content_block_delta","index":2,"delta":{"type":"input_json_delta","partial_json":"1}"}}`,
+		`{"type":"content_block_stop","index":2}`,
+		`{"type":"content_block_start","index":3,"content_block":{"type":"tool_use","id":"toolu_2","name":"sleep","input":{}}}`,
+		`{"type":"content_block_stop","index":3}`,
+		`{"type":"message_delta","delta":{"stop_reason":"tool_use"},"usage":{"output_tokens":9}}`,
+		`{"type":"message_stop"}`,
+	), sseResponse(
+		`{"type":"message_start","message":{"model":"claude-test","content":[],"usage":{"input_tokens":30,"output_tokens":1}}}`,
+		`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Sunny"}}`,
+		`{"type":"content_block_stop","index":0}`,
+		`{"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":2}}`,
+		`{"type":"message_stop"}`,
+	))
+	tool := &sleepTool{name: "sleep"}
+	conv := newTestConversation(tool)
+
+	var output []string
+	callback := func(channel, content string, index int, end bool) {
+		output = append(output, fmt.Sprintf("%s:%d:%q", channel, index, content))
+	}
+	var stats api.Stats
+	msgs, err := client.ChatCompletionStream(t.Context(), conv, callback, func(s api.Stats) { stats = s }, tool)
+	require.NoError(t, err)
+	t.Log(strings.Join(output, "\n"))
+
+	require.Len(t, msgs, 4)
+	assert.Equal(t, "Let me count", msgs[0].Reasoning)
+	assert.JSONEq(t, `[{"type":"thinking","thinking":"Let me count","signature":"sig"}]`, string(msgs[0].ReasoningBlocks))
+	// tool input is assembled from the partial_json deltas, or {} if there are none
+	var calls []openai.ChatCompletionMessageToolCallUnion
+	require.NoError(t, json.Unmarshal(msgs[0].ToolCall, &calls))
+	require.Len(t, calls, 2)
+	assert.JSONEq(t, `{"ms":1}`, calls[0].Function.Arguments)
+	assert.Equal(t, "{}", calls[1].Function.Arguments)
+	assert.JSONEq(t, `{"ms":1}`, msgs[1].Content)
+	assert.Equal(t, "{}", msgs[2].Content)
+	assert.Equal(t, "Sunny", msgs[3].Content)
+	assert.Equal(t, []string{
+		`analysis:0:"Let me "`, `analysis:1:"count"`, `analysis:2:"\n"`,
+		`final:0:"There are "`, `final:1:"3"`,
+	}, output[:5])
+	assert.Equal(t, 30, stats.PromptTokens)
+	assert.Equal(t, 11, stats.CompletionTokens)
+}
+
+func TestAnthropicError(t *testing.T) {
+	client := anthropicClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"type":"error","error":{"type":"invalid_request_error","message":"bad request"}}`)
+	})
+	_, err := client.ChatCompletion(t.Context(), newTestConversation(), discard, nil)
+	assert.EqualError(t, err, "error 400: bad request")
+}
+
+func anthropicClient(t *testing.T, responses ...http.HandlerFunc) api.Client {
+	testServer(t, responses...)
+	client, err := api.NewClient(api.Anthropic, "test-model")
+	require.NoError(t, err)
+	return client
+}
+
+// send each of the events in the Messages API server sent event format
+func sseResponse(events ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, data := range events {
+			var ev struct{ Type string }
+			json.Unmarshal([]byte(data), &ev)
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data)
+		}
+	}
+}
@@ -3,14 +3,17 @@ package api
 
 import (
 	"bytes"
+	"cmp"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"slices"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/openai/openai-go/v3"
@@ -20,8 +23,6 @@ import (
 	"github.com/tidwall/pretty"
 )
 
-//go:generate stringer -type Server
-
 var (
 	// Optional logging of raw JSON requests and responses
 	TraceRequests = false
@@ -33,16 +34,6 @@ func init() {
 	pretty.DefaultOptions.Width = 120
 }
 
-const (
-	LlamaCPP   Server = 0
-	VLLM       Server = 1
-	OpenRouter Server = 2
-	Cerebras   Server = 3
-)
-
-// Endpoint to connect to
-type Server int
-
 // Interface implented by tools which can be called by the model.
 type ToolFunction interface {
 	// function name and argument schema
@@ -51,6 +42,40 @@ type ToolFunction interface {
 	Call(args string) (req, resp string, err error)
 }
 
+// Optional interface implemented by tools which need the request context or details of the conversation. If a tool
+// implements ContextTool then CallContext is used instead of Call - it should return promptly once ctx is cancelled.
+type ContextTool interface {
+	ToolFunction
+	CallContext(ctx context.Context, call ToolCall) (ToolResult, error)
+}
+
+// Optional interface implemented by tools with state which is saved with the conversation. The state is stored in
+// Conversation.ToolData under the tool name, or the StateKey if the tool implements SharedState. It is loaded at the
+// start of each chat completion and saved at the end - ResetState is called instead of LoadState if there is no
+// saved state for the tool.
+type StatefulTool interface {
+	SaveState() (json.RawMessage, error)
+	LoadState(data json.RawMessage) error
+	ResetState()
+}
+
+// Optional interface implemented by stateful tools which share their state with other tools - e.g. the browser
+// tools. The state is saved once under the given key.
+type SharedState interface {
+	StateKey() string
+}
+
+// Optional interface implemented by tools which can be interrupted while running if the request is cancelled
+type Interrupter interface {
+	Interrupt()
+}
+
+// Optional interface implemented by tools which cannot be called concurrently - if Sequential returns true then
+// parallel calls to the tool are run one at a time in the order they were generated
+type Sequential interface {
+	Sequential() bool
+}
+
 // Tool parameters for given list of tools
 func ChatCompletionToolParams(tools []ToolFunction) (params []openai.ChatCompletionToolUnionParam) {
 	for _, tool := range tools {
@@ -60,61 +85,62 @@ func ChatCompletionToolParams(tools []ToolFunction) (params []openai.ChatComplet
 	return params
 }
 
-// Get current server from LLM_SERVER env if set
-func GetServer() Server {
-	switch strings.ToLower(os.Getenv("LLM_SERVER")) {
-	case "llamacpp":
-		return LlamaCPP
-	case "vllm":
-		return VLLM
-	case "openrouter":
-		return OpenRouter
-	case "cerebras":
-		return Cerebras
-	default:
-		return -1
-	}
+// Get current provider name from LLM_SERVER env if set
+func GetServer() string {
+	return strings.ToLower(os.Getenv("LLM_SERVER"))
 }
 
 // Client and associated info
 type Client struct {
 	openai.Client
-	Server         Server
+	Provider       Provider
 	BaseURL        string
 	ModelName      string
 	ReasoningField string
 	ContextLength  int
+	ResponsesAPI   bool        // use the Responses API instead of Chat Completions if provider is OpenAI compatible
+	Fallbacks      []*Client   // tried in order if a request fails - see AddFallback
+	Approve        ApproveFunc // called before tool calls with the ask approval policy - see ToolConfig
+	apiKey         string
 }
 
-// Create new client with default settings if no options are given.
-// If set then will use OPENAI_BASE_URL and OPENAI_API_KEY environment variables.
-// The model name is optional for LlamaCPP and LLLM - they will use the currently loaded model.
-func NewClient(server Server, modelName string, opts ...option.RequestOption) (c Client, err error) {
-	c = Client{Server: server, ReasoningField: "reasoning"}
-	switch server {
-	case LlamaCPP:
-		c.BaseURL = "http://localhost:8080/v1"
-		c.ReasoningField = "reasoning_content"
-	case VLLM:
-		c.BaseURL = "http://localhost:8080/v1"
-	case OpenRouter:
-		c.BaseURL = "https://openrouter.ai/api/v1"
-		c.ModelName = "@preset/gpt-oss-120"
-	case Cerebras:
-		c.BaseURL = "https://api.cerebras.ai/v1"
-		c.ModelName = "gpt-oss-120b"
-	}
-	if modelName != "" {
-		c.ModelName = modelName
-	}
-	if url := os.Getenv("OPENAI_BASE_URL"); url != "" {
-		c.BaseURL = url
-	}
-	log.Infof("connecting to %s at %s %s", server, c.BaseURL, c.ModelName)
-	opts = append([]option.RequestOption{option.WithBaseURL(c.BaseURL)}, opts...)
+// Create new client for the named provider with default settings if no options are given.
+// If set then will use OPENAI_BASE_URL and OPENAI_API_KEY environment variables, or {PROVIDER}_BASE_URL and
+// {PROVIDER}_API_KEY as for ParseEndpoints.
+// The model name is optional for LlamaCPP and VLLM - they will use the currently loaded model.
+func NewClient(provider, modelName string, opts ...option.RequestOption) (c Client, err error) {
+	return newClient(Endpoint{
+		Provider:  provider,
+		ModelName: modelName,
+		BaseURL:   cmp.Or(os.Getenv("OPENAI_BASE_URL"), providerEnv(provider, "BASE_URL")),
+		APIKey:    providerEnv(provider, "API_KEY"),
+	}, opts...)
+}
+
+func newClient(e Endpoint, opts ...option.RequestOption) (c Client, err error) {
+	p, err := GetProvider(e.Provider)
+	if err != nil {
+		return c, err
+	}
+	c = Client{Provider: p, ReasoningField: p.ReasoningField()}
+	c.BaseURL, c.ModelName = p.Defaults()
+	if e.ModelName != "" {
+		c.ModelName = e.ModelName
+	}
+	if e.BaseURL != "" {
+		c.BaseURL = e.BaseURL
+	}
+	log.Infof("connecting to %s at %s %s", p.Name(), c.BaseURL, c.ModelName)
+	// retries are handled in ChatCompletion so they apply to all providers
+	opts = append([]option.RequestOption{option.WithBaseURL(c.BaseURL), option.WithMaxRetries(0)}, opts...)
+	if e.APIKey != "" {
+		c.apiKey = e.APIKey
+		opts = append(opts, option.WithAPIKey(e.APIKey))
+	}
 	c.Client = openai.NewClient(opts...)
-	if server == LlamaCPP || server == VLLM {
-		c.ContextLength, err = MaxModelLength(server, c.BaseURL)
+	c.ContextLength, err = c.MaxModelLength()
+	if errors.Is(err, ErrNotSupported) {
+		err = nil
 	}
 	return c, err
 }
@@ -126,165 +152,418 @@ func GetContent(raw string) (content, reasoning string) {
 		Refusal           string
 		Reasoning         string
 		Reasoning_Content string
+		Thinking          string
 	}
 	json.Unmarshal([]byte(raw), &v)
-	return v.Content + v.Refusal, v.Reasoning + v.Reasoning_Content
+	return v.Content + v.Refusal, v.Reasoning + v.Reasoning_Content + v.Thinking
 }
 
 // Generated content where channel is either analysis (i.e. reasoning text), final (generated text) or tool (response from tool call) and
-// index is the count of the message on the current stream, end is set on final message completion and full rather than delta content is sent
+// index is the count of the message on the current stream, end is set on final message completion and full rather than delta content is sent.
+// Each tool call is sent as a separate stream on the tool channel - partial output from the tool may be sent before the request and full response.
 type CallbackFunc func(channel, content string, index int, end bool)
 
 // Chat completion without streaming with optional function call support. The list of new generated messages are returned.
 // callback and statsCallback are called after each stage of generation - i.e. reasoning text, tool response and final response.
+// If the context is cancelled then the messages generated so far are returned along with the context error.
 func (c *Client) ChatCompletion(ctx context.Context, request Conversation, callback CallbackFunc, statsCallback func(Stats), tools ...ToolFunction) ([]Message, error) {
+	return c.chatCompletion(ctx, request, false, callback, statsCallback, tools)
+}
+
+// As per ChatCompletion but will stream responses as they are generated.
+func (c *Client) ChatCompletionStream(ctx context.Context, request Conversation, callback CallbackFunc, statsCallback func(Stats), tools ...ToolFunction) ([]Message, error) {
+	return c.chatCompletion(ctx, request, true, callback, statsCallback, tools)
+}
+
+// Optional interface implemented by providers which do not use the OpenAI chat completions API
+type Completer interface {
+	// Generate next assistant message for the conversation. If stream is set then callback should be called with each
+	// reasoning and content delta using a Streamer. If the context is cancelled then return the partial response.
+	Complete(ctx context.Context, c *Client, conv Conversation, tools []ToolFunction, stream bool, callback CallbackFunc) (Completion, error)
+}
+
+// Assistant message and usage info returned from a single API call
+type Completion struct {
+	Model     string
+	Content   string
+	Reasoning string
+	Signature string
+	Blocks    json.RawMessage // provider specific reasoning blocks - saved as Message.ReasoningBlocks
+	ToolCalls []openai.ChatCompletionMessageToolCallUnion
+	Usage     openai.CompletionUsage
+	Streamer  Streamer
+}
+
+func (c *Client) chatCompletion(ctx context.Context, request Conversation, stream bool, callback CallbackFunc, statsCallback func(Stats), tools []ToolFunction) (
+	msgs []Message, err error) {
+
 	stats := newStats()
+	ctx, span := startTurnSpan(ctx, request)
+	defer func() { endTurnSpan(span, stats, err) }()
 	conv := request
 	conv.Messages = slices.Clone(request.Messages)
-	var content, reasoning string
+	var resp Completion
 	retries := 0
 	maxRetries := 3
+	rounds := 0
+	final := false
+	turnStart := time.Now()
+	active := c
+	if request.ToolData != nil {
+		enabled := conv.Config.EnabledTools(tools)
+		if err := conv.LoadToolState(enabled); err != nil {
+			log.Error(err)
+		}
+		defer func() {
+			if err := request.SaveToolState(enabled); err != nil {
+				log.Error(err)
+			}
+		}()
+	}
 	for {
-		req := c.NewRequest(c.ModelName, conv, tools...)
-		// optionally exclude previous messages if reached context threshold
+		// optionally compact messages if reached context threshold - this is checked before every API call as tool
+		// responses in the current turn may also overflow the context
 		if conv.Config.CompactThreshold > 0 && conv.Config.CompactThreshold < 1 {
-			limit := int(float64(c.ContextLength) * conv.Config.CompactThreshold)
-			c.CompactMessages(request, limit)
+			active.updateContextLength()
+			limit := int(float64(active.ContextLength) * conv.Config.CompactThreshold)
+			if err := active.CompactMessages(ctx, conv, limit); err != nil {
+				log.Warn(err)
+			}
+			// earlier messages which were excluded or summarized are also updated in the request
+			copy(request.Messages, conv.Messages)
+		}
+		// if a budget for the turn is used up then remove the tools so the model has to give a final answer
+		if reason := conv.Config.budgetExceeded(rounds, &stats, turnStart); reason != "" && !final {
+			log.Warnf("budget reached: %s - requesting final answer", reason)
+			stats.addLimit(reason)
+			conv.Config.SystemPrompt = trim(conv.Config.SystemPrompt + "\n\n" + fmt.Sprintf(BudgetPrompt, reason))
+			tools, final = nil, true
 		}
 		// submit request
-		opts := requestOptions(&req)
 		start := time.Now()
-		resp, err := c.Chat.Completions.New(ctx, req, opts...)
+		resp, active, err = c.completeWithFailover(ctx, active, conv, tools, stream, callback, &stats)
 		if err != nil {
+			if ctx.Err() != nil {
+				return partialMessages(request, conv, resp.Content, resp.Reasoning), ctx.Err()
+			}
 			return nil, err
 		}
-		if len(resp.Choices) == 0 {
-			return nil, getError(resp.RawJSON())
+		usage := newUsage(conv.ID, active.Provider.Name(), cmp.Or(resp.Model, active.ModelName), resp.Usage)
+		_, usage.ReasoningTokens = splitTokens(resp)
+		stats.update(usage, start, resp.Streamer.FirstToken)
+		recordUsage(usage)
+		// size of the next prompt is estimated from the token counts reported by the server
+		conv.NumTokens = 0
+		if stats.PromptTokens > 0 {
+			conv.NumTokens = stats.PromptTokens + int(resp.Usage.CompletionTokens)
+		}
+		if !stream && isSet(resp.Reasoning) {
+			callback("analysis", resp.Reasoning, 0, true)
 		}
-		stats.update(resp.Model, resp.Usage, start)
-		// parse response
-		message := resp.Choices[0].Message
-		content, reasoning = GetContent(message.RawJSON())
-		if isSet(reasoning) {
-			callback("analysis", reasoning, 0, true)
+		if final && len(resp.ToolCalls) > 0 {
+			log.Warnf("ignoring %d tool calls after budget reached", len(resp.ToolCalls))
+			resp.ToolCalls = nil
 		}
-		if len(message.ToolCalls) == 0 {
-			if isSet(content) {
+		if len(resp.ToolCalls) == 0 {
+			if isSet(resp.Content) {
 				break
 			} else if retries >= maxRetries {
-				content = fmt.Sprintf("Error: giving up on request after %d retries", maxRetries)
+				resp.Content = fmt.Sprintf("Error: giving up on request after %d retries", maxRetries)
 				break
 			} else {
 				retries++
-				log.Warnf("no message content or tool call - retry %d/%d reasoning=%q", retries, maxRetries, reasoning)
+				log.Warnf("no message content or tool call - retry %d/%d reasoning=%q", retries, maxRetries, resp.Reasoning)
 				continue
 			}
 		}
 		retries = 0
 		// have tool calls - call function and resend
-		conv.Messages = append(conv.Messages, Message{Role: "assistant", Reasoning: reasoning, ToolCall: marshal(message.ToolCalls)})
-		for _, call := range message.ToolCalls {
-			toolID, toolResp := callTool(call, tools, &stats, callback)
-			conv.Messages = append(conv.Messages, Message{Role: "tool", Content: toolResp, ToolCallID: toolID})
+		msg := active.assistantMessage(resp)
+		msg.Content, msg.ToolCall = "", marshal(resp.ToolCalls)
+		conv.Messages = append(conv.Messages, msg)
+		conv.Messages = append(conv.Messages, callTools(ctx, conv, resp.ToolCalls, tools, &stats, callback, c.Approve)...)
+		if ctx.Err() != nil {
+			return partialMessages(request, conv, "", ""), ctx.Err()
 		}
+		rounds++
+		tools = conv.Config.toolsWithinLimits(tools, &stats)
 		if statsCallback != nil {
 			statsCallback(stats)
 		}
 	}
-	callback("final", content+"\n", 0, true)
+	if stream {
+		callback("final", "\n", resp.Streamer.Index, false)
+		callback("final", resp.Content+"\n", resp.Streamer.Index+1, true)
+	} else {
+		callback("final", resp.Content+"\n", 0, true)
+	}
 	if statsCallback != nil {
 		statsCallback(stats)
 	}
-	msgs := append(conv.Messages[len(request.Messages):], Message{Role: "assistant", Content: content, Reasoning: reasoning})
+	msgs = append(conv.Messages[len(request.Messages):], active.assistantMessage(resp))
 	return msgs, nil
 }
 
-// As per ChatCompletion but will stream responses as they are generated.
-func (c *Client) ChatCompletionStream(ctx context.Context, request Conversation, callback CallbackFunc, statsCallback func(Stats), tools ...ToolFunction) ([]Message, error) {
-	stats := newStats()
-	conv := request
-	conv.Messages = slices.Clone(conv.Messages)
-	var acc Accumulator
-	retries := 0
-	maxRetries := 3
-	for {
-		req := c.NewRequest(c.ModelName, conv, tools...)
-		req.StreamOptions = openai.ChatCompletionStreamOptionsParam{IncludeUsage: openai.Bool(true)}
-		// optionally exclude previous messages if reached context threshold
-		if conv.Config.CompactThreshold > 0 && conv.Config.CompactThreshold < 1 {
-			limit := int(float64(c.ContextLength) * conv.Config.CompactThreshold)
-			c.CompactMessages(request, limit)
+// assistant message from completion - opaque reasoning data is tagged with the endpoint which generated it
+func (c *Client) assistantMessage(resp Completion) Message {
+	msg := Message{Role: "assistant", Content: resp.Content, Reasoning: resp.Reasoning, Signature: resp.Signature, ReasoningBlocks: resp.Blocks}
+	msg.ContentTokens, msg.ReasoningTokens = splitTokens(resp)
+	if msg.Signature != "" || len(msg.ReasoningBlocks) > 0 {
+		msg.ReasoningSource = c.endpointID()
+	}
+	return msg
+}
+
+// completion tokens split into content, including any tool calls, and reasoning. If the number of reasoning tokens is
+// not reported by the server then it is estimated from the length of the reasoning text.
+func splitTokens(resp Completion) (content, reasoning int) {
+	total := int(resp.Usage.CompletionTokens)
+	reasoning = int(resp.Usage.CompletionTokensDetails.ReasoningTokens)
+	if reasoning == 0 && resp.Reasoning != "" {
+		other := len(resp.Content)
+		for _, call := range resp.ToolCalls {
+			other += len(call.Function.Name) + len(call.Function.Arguments)
 		}
-		// submit streaming request
-		opts := requestOptions(&req)
-		start := time.Now()
-		var err error
-		acc, err = chatCompletionStream(ctx, c.Client, req, opts, callback)
+		reasoning = total * len(resp.Reasoning) / (len(resp.Reasoning) + other)
+	}
+	return max(total-reasoning, 0), min(reasoning, total)
+}
+
+func (c *Client) endpointID() string {
+	return c.Provider.Name() + " " + c.BaseURL
+}
+
+// remove signatures and reasoning blocks generated by a different endpoint as they will not be accepted by this one -
+// e.g. after failing over from the Responses API to Anthropic
+func (c *Client) withoutForeignReasoning(conv Conversation) Conversation {
+	id := c.endpointID()
+	var msgs []Message
+	for i, m := range conv.Messages {
+		if m.ReasoningSource != "" && m.ReasoningSource != id {
+			if msgs == nil {
+				msgs = slices.Clone(conv.Messages)
+			}
+			msgs[i].Signature, msgs[i].ReasoningBlocks = "", nil
+		}
+	}
+	if msgs != nil {
+		conv.Messages = msgs
+	}
+	return conv
+}
+
+// get next message using the provider Completer if implemented, else the chat completions API
+func (c *Client) complete(ctx context.Context, conv Conversation, tools []ToolFunction, stream bool, callback CallbackFunc) (resp Completion, err error) {
+	conv = c.withoutForeignReasoning(conv)
+	if p, ok := c.Provider.(Completer); ok {
+		return p.Complete(ctx, c, conv, tools, stream, callback)
+	}
+	if c.ResponsesAPI {
+		return c.responsesComplete(ctx, conv, tools, stream, callback)
+	}
+	req := c.NewRequest(c.ModelName, conv, tools...)
+	if stream {
+		req.StreamOptions = openai.ChatCompletionStreamOptionsParam{IncludeUsage: openai.Bool(true)}
+	}
+	opts := c.requestOptions(&req)
+	if !stream {
+		r, err := c.Chat.Completions.New(ctx, req, opts...)
 		if err != nil {
-			return nil, err
+			return resp, err
 		}
-		stats.update(acc.Model, acc.Usage, start)
-		if len(acc.Choices) == 0 {
-			return nil, getError(acc.RawJSON())
+		if len(r.Choices) == 0 {
+			return resp, getError(r.RawJSON())
 		}
-		// parse response
-		message := acc.Choices[0].Message
-		if len(message.ToolCalls) == 0 {
-			if isSet(acc.Content) {
-				break
-			} else if retries >= maxRetries {
-				acc.Content = fmt.Sprintf("Error: giving up on request after %d retries", maxRetries)
-				break
-			} else {
-				retries++
-				log.Warnf("no message content or tool call - retry %d/%d reasoning=%q", retries, maxRetries, acc.Reasoning)
-				continue
-			}
-		}
-		retries = 0
-		// have tool call - call function and resend
-		conv.Messages = append(conv.Messages, Message{Role: "assistant", Reasoning: acc.Reasoning, ToolCall: marshal(message.ToolCalls)})
-		for _, call := range message.ToolCalls {
-			toolID, toolResp := callTool(call, tools, &stats, callback)
-			conv.Messages = append(conv.Messages, Message{Role: "tool", Content: toolResp, ToolCallID: toolID})
+		resp = Completion{Model: r.Model, Usage: r.Usage, ToolCalls: r.Choices[0].Message.ToolCalls}
+		resp.Content, resp.Reasoning = GetContent(r.Choices[0].Message.RawJSON())
+		return resp, nil
+	}
+	acc, err := chatCompletionStream(ctx, c.Client, req, opts, callback)
+	resp = Completion{Model: acc.Model, Content: acc.Content, Reasoning: acc.Reasoning, Usage: acc.Usage, Streamer: acc.Streamer}
+	if err != nil {
+		return resp, err
+	}
+	if len(acc.Choices) == 0 {
+		return resp, getError(acc.RawJSON())
+	}
+	resp.ToolCalls = acc.Choices[0].Message.ToolCalls
+	return resp, nil
+}
+
+// messages generated so far in the current turn, with the partial assistant response if content or reasoning is set
+func partialMessages(request, conv Conversation, content, reasoning string) []Message {
+	msgs := slices.Clone(conv.Messages[len(request.Messages):])
+	if isSet(content) || isSet(reasoning) {
+		msgs = append(msgs, Message{Role: "assistant", Content: content, Reasoning: reasoning})
+	}
+	return msgs
+}
+
+// Call each of the tools and return the tool response messages in the same order as the calls.
+// Up to MaxParallelToolCalls are run concurrently, except that calls to a Sequential tool are run one at a time in order.
+// If the context is cancelled then an error response is returned for each of the calls which have not yet started.
+// Calls which are not allowed by the tool approval policy or would exceed the tool call limit in the config are not run.
+func callTools(ctx context.Context, conv Conversation, calls []openai.ChatCompletionMessageToolCallUnion, tools []ToolFunction, stats *Stats, callback CallbackFunc, approve ApproveFunc) []Message {
+	msgs := make([]Message, len(calls))
+	store := conversationStore(conv.ID)
+	approvals := limitCalls(conv.Config, calls, stats)
+	approveCalls(ctx, conv.Config, calls, tools, approve, approvals)
+	// each queue is a list of call indexes to be run in order
+	var queues [][]int
+	sequential := map[string]int{}
+	for i, call := range calls {
+		name := call.Function.Name
+		if n, ok := sequential[name]; ok {
+			queues[n] = append(queues[n], i)
+			continue
 		}
-		if statsCallback != nil {
-			statsCallback(stats)
+		if tool := findTool(tools, name); tool != nil {
+			if t, ok := tool.(Sequential); ok && t.Sequential() {
+				sequential[name] = len(queues)
+			}
 		}
+		queues = append(queues, []int{i})
 	}
-	callback("final", "\n", acc.index, false)
-	callback("final", acc.Content+"\n", acc.index+1, true)
-	if statsCallback != nil {
-		statsCallback(stats)
+	sem := make(chan struct{}, max(MaxParallelToolCalls, 1))
+	out := newToolOutput(len(calls), callback)
+	var wg sync.WaitGroup
+	for _, queue := range queues {
+		wg.Go(func() {
+			for _, i := range queue {
+				call := calls[i]
+				msgs[i] = Message{Role: "tool", Content: fmt.Sprintf("Error: %s function call cancelled", call.Function.Name), ToolCallID: call.ID}
+				select {
+				case sem <- struct{}{}:
+				case <-ctx.Done():
+					continue
+				}
+				if ctx.Err() == nil {
+					tc := ToolCall{ID: call.ID, ConversationID: conv.ID, Store: store, Output: func(text string) { out.send(i, text, false) }}
+					msgs[i].Content = callTool(ctx, tc, call, tools, stats, out, i, approvals[i])
+				}
+				<-sem
+			}
+		})
 	}
-	msgs := append(conv.Messages[len(request.Messages):], Message{Role: "assistant", Content: acc.Content, Reasoning: acc.Reasoning})
-	return msgs, nil
+	wg.Wait()
+	out.flush()
+	return msgs
 }
 
-// call tools, update stats and call callback with request and response text
-func callTool(call openai.ChatCompletionMessageToolCallUnion, tools []ToolFunction, stats *Stats, callback CallbackFunc) (id, res string) {
+// call tool, update stats and send request and response text to the output - out.mu is held while updating stats
+func callTool(ctx context.Context, tc ToolCall, call openai.ChatCompletionMessageToolCallUnion, tools []ToolFunction, stats *Stats, out *toolOutput, i int, approval approval) string {
 	fn := call.Function
+	ctx, span := startToolSpan(ctx, call)
+	tool := findTool(tools, fn.Name)
+	if tool == nil {
+		toolErrorCount.Inc("unknown")
+		return rejectToolSpan(span, toolError(fn, fmt.Sprintf("Error: function %q is not defined", fn.Name), stats, out, i))
+	}
+	args, err := ValidateArgs(tool.Definition().Parameters, fn.Arguments)
+	if err != nil {
+		toolErrorCount.Inc(fn.Name)
+		return rejectToolSpan(span, toolError(fn, invalidArgs(fn.Name, err), stats, out, i))
+	}
+	if approval.reject != "" {
+		out.send(i, fn.Name+args+"\n"+approval.reject+"\n", true)
+		return rejectToolSpan(span, approval.reject)
+	} else if approval.checked {
+		args = approval.args
+	}
+	tc.Name, tc.Arguments = fn.Name, args
+	start := time.Now()
+	res, err := WithContext(tool).CallContext(ctx, tc)
+	endSpan(span, err)
+	req, resp := res.Request, res.Response
+	if err != nil {
+		resp = fmt.Sprintf("Error calling %s function: %v", fn.Name, err)
+		log.Error(resp)
+	}
+	out.mu.Lock()
+	stats.toolCalled(fn.Name, start, err)
+	out.mu.Unlock()
+	out.send(i, req+"\n"+resp+"\n", true)
+	return resp
+}
+
+// tool call was rejected without calling the tool - log the error and return it to the model so that it can retry
+func toolError(fn openai.ChatCompletionMessageFunctionToolCallFunction, resp string, stats *Stats, out *toolOutput, i int) string {
+	log.Warnf("%s(%s): %s", fn.Name, fn.Arguments, resp)
+	out.mu.Lock()
+	stats.ToolErrors++
+	out.mu.Unlock()
+	out.send(i, fn.Name+fn.Arguments+"\n"+resp+"\n", true)
+	return resp
+}
+
+// Output from a set of tool calls which is sent to the callback on the tool channel. Each call may send partial
+// output as it runs followed by the request and complete response with end set. The index is the count of messages
+// sent for that call. So that each call is sent as a contiguous stream, output from a call is queued until the
+// earlier calls have completed.
+type toolOutput struct {
+	mu       sync.Mutex
+	callback CallbackFunc
+	queued   [][]toolMessage // pending output for each call
+	count    []int           // number of messages sent for each call
+	current  int             // call which is currently being sent
+}
+
+type toolMessage struct {
+	text string
+	end  bool
+}
+
+func newToolOutput(calls int, callback CallbackFunc) *toolOutput {
+	return &toolOutput{callback: callback, queued: make([][]toolMessage, calls), count: make([]int, calls)}
+}
+
+// queue output from call i and send any output which is ready
+func (o *toolOutput) send(i int, text string, end bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.queued[i] = append(o.queued[i], toolMessage{text: text, end: end})
+	for o.current < len(o.queued) {
+		ended := o.sendQueued(o.current)
+		if !ended {
+			return
+		}
+		o.current++
+	}
+}
+
+// send output from any calls which did not complete - e.g. if cancelled
+func (o *toolOutput) flush() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for ; o.current < len(o.queued); o.current++ {
+		o.sendQueued(o.current)
+	}
+}
+
+func (o *toolOutput) sendQueued(i int) (ended bool) {
+	for _, m := range o.queued[i] {
+		o.callback("tool", m.text, o.count[i], m.end)
+		o.count[i]++
+		ended = m.end
+	}
+	o.queued[i] = nil
+	return ended
+}
+
+func findTool(tools []ToolFunction, name string) ToolFunction {
 	for _, tool := range tools {
-		if tool.Definition().Name == fn.Name {
-			start := time.Now()
-			req, resp, err := tool.Call(fn.Arguments)
-			stats.toolCalled(fn.Name, start)
-			if err != nil {
-				resp = fmt.Sprintf("Error calling %s function: %v", fn.Name, err)
-				log.Error(resp)
-			}
-			callback("tool", req+"\n"+resp+"\n", 0, false)
-			return call.ID, resp
+		if tool.Definition().Name == name {
+			return tool
 		}
 	}
-	return call.ID, fmt.Sprintf("Error: function %q is not defined", fn.Name)
+	return nil
 }
 
 type Accumulator struct {
 	openai.ChatCompletionAccumulator
 	Content   string
 	Reasoning string
-	index     int
+	Streamer  Streamer
 }
 
 // send streaming request and accumulate response
@@ -292,7 +571,7 @@ func chatCompletionStream(ctx context.Context, client openai.Client, req openai.
 	acc Accumulator, err error) {
 
 	stream := client.Chat.Completions.NewStreaming(ctx, req, opts...)
-	channel := "analysis"
+	acc.Streamer = NewStreamer(callback)
 	for stream.Next() {
 		chunk := stream.Current()
 		if TraceStream {
@@ -300,46 +579,80 @@ func chatCompletionStream(ctx context.Context, client openai.Client, req openai.
 		}
 		acc.AddChunk(chunk)
 		if _, ok := acc.JustFinishedToolCall(); ok {
-			if acc.index > 0 {
-				callback(channel, "\n", acc.index, false)
-			}
+			acc.Streamer.EndToolCall()
 		}
 		if len(chunk.Choices) > 0 {
+			if len(chunk.Choices[0].Delta.ToolCalls) > 0 {
+				acc.Streamer.ToolCallDelta()
+			}
 			content, reasoning := GetContent(chunk.Choices[0].Delta.RawJSON())
 			acc.Content += content
 			acc.Reasoning += reasoning
-			if reasoning != "" {
-				callback(channel, reasoning, acc.index, false)
-				acc.index++
-			}
-			if content != "" {
-				if channel == "analysis" {
-					if acc.index > 0 {
-						callback(channel, "\n", acc.index, false)
-					}
-					channel = "final"
-					acc.index = 0
-				}
-				callback(channel, content, acc.index, false)
-				acc.index++
-			}
+			acc.Streamer.Reasoning(reasoning)
+			acc.Streamer.Content(content)
 		}
 	}
 	return acc, stream.Err()
 }
 
-// extra JSON fields to set in request
-func requestOptions(req *openai.ChatCompletionNewParams) (opts []option.RequestOption) {
-	kwargs := map[string]any{}
-	if req.ReasoningEffort == "none" {
-		kwargs["enable_thinking"] = false
-		req.ReasoningEffort = ""
-	} else if req.ReasoningEffort != "" {
-		kwargs["reasoning_effort"] = req.ReasoningEffort
+// Tracks the current channel and message index when streaming deltas to a CallbackFunc
+type Streamer struct {
+	Channel    string
+	Index      int
+	FirstToken time.Time // when the first reasoning, content or tool call delta was received
+	callback   CallbackFunc
+}
+
+func NewStreamer(callback CallbackFunc) Streamer {
+	return Streamer{Channel: "analysis", callback: callback}
+}
+
+// Send reasoning delta if not blank
+func (s *Streamer) Reasoning(text string) {
+	if text != "" {
+		s.started()
+		s.callback(s.Channel, text, s.Index, false)
+		s.Index++
+	}
+}
+
+// Send content delta if not blank - switches to the final channel on the first call
+func (s *Streamer) Content(text string) {
+	if text != "" {
+		s.started()
+		if s.Channel == "analysis" {
+			if s.Index > 0 {
+				s.callback(s.Channel, "\n", s.Index, false)
+			}
+			s.Channel = "final"
+			s.Index = 0
+		}
+		s.callback(s.Channel, text, s.Index, false)
+		s.Index++
+	}
+}
+
+// Called when a tool call delta is received - these are not sent to the callback but are used to set FirstToken
+func (s *Streamer) ToolCallDelta() {
+	s.started()
+}
+
+func (s *Streamer) started() {
+	if s.FirstToken.IsZero() {
+		s.FirstToken = time.Now()
 	}
-	if len(kwargs) > 0 {
-		opts = append(opts, option.WithJSONSet("chat_template_kwargs", kwargs))
+}
+
+// Add line break after tool call has been generated
+func (s *Streamer) EndToolCall() {
+	if s.Index > 0 {
+		s.callback(s.Channel, "\n", s.Index, false)
 	}
+}
+
+// extra JSON fields to set in request
+func (c *Client) requestOptions(req *openai.ChatCompletionNewParams) (opts []option.RequestOption) {
+	opts = c.Provider.RequestOptions(req)
 	if TraceRequests {
 		opts = append(opts, option.WithMiddleware(debugLogger))
 	}
@@ -375,14 +688,29 @@ func pprint(title string, value any) io.ReadCloser {
 	return io.NopCloser(bytes.NewBuffer(data))
 }
 
+// error from response with no choices - the details may be at the top level or in an error object
 func getError(rawJSON string) error {
 	type errorResponse struct {
 		Code    int
 		Message string
 	}
-	v := errorResponse{Code: 500, Message: "server error"}
+	var v struct {
+		errorResponse
+		Error errorResponse
+	}
 	json.Unmarshal([]byte(rawJSON), &v)
-	return fmt.Errorf("error %d: %s", v.Code, v.Message)
+	return &StatusError{
+		StatusCode: cmp.Or(v.Code, v.Error.Code, http.StatusInternalServerError),
+		Message:    cmp.Or(v.Message, v.Error.Message, "server error"),
+	}
+}
+
+func toolCallUnion(id, name, args string) (call openai.ChatCompletionMessageToolCallUnion) {
+	data := marshal(map[string]any{"id": id, "type": "function", "function": map[string]string{"name": name, "arguments": args}})
+	if err := json.Unmarshal(data, &call); err != nil {
+		panic(err)
+	}
+	return call
 }
 
 func isSet(s string) bool {
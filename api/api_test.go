@@ -1,12 +1,22 @@
 package api_test
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/jnb666/gpt-go/api"
 	"github.com/jnb666/gpt-go/api/tools/weather"
+	"github.com/openai/openai-go/v3"
+	"github.com/openai/openai-go/v3/shared"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -103,6 +113,248 @@ func TestRequestWithTools(t *testing.T) {
 	assert.JSONEq(t, toJSON(expect), toJSON(req))
 }
 
+func TestCancelToolCall(t *testing.T) {
+	tool := &waitTool{started: make(chan struct{}), interrupted: make(chan struct{})}
+	client := testClient(t, jsonResponse(toolCallResponse(toolCall{"call_1", "wait", `{}`})))
+	conv := newTestConversation(tool)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-tool.started
+		cancel()
+	}()
+	msgs, err := client.ChatCompletion(ctx, conv, discard, nil, tool)
+	assert.ErrorIs(t, err, context.Canceled)
+	t.Log(api.Pretty(msgs))
+
+	require.Len(t, msgs, 2)
+	assert.Equal(t, "assistant", msgs[0].Role)
+	assert.NotEmpty(t, msgs[0].ToolCall)
+	assert.Equal(t, "tool", msgs[1].Role)
+	assert.Equal(t, "call_1", msgs[1].ToolCallID)
+	assert.Contains(t, msgs[1].Content, "context canceled")
+	select {
+	case <-tool.interrupted:
+	default:
+		t.Error("tool was not interrupted")
+	}
+}
+
+func TestCancelStream(t *testing.T) {
+	client := testClient(t, blockingStreamResponse(
+		`{"choices":[{"index":0,"delta":{"role":"assistant","reasoning_content":"thinking"}}]}`,
+		`{"choices":[{"index":0,"delta":{"content":"Hello"}}]}`,
+	))
+	conv := newTestConversation()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	callback := func(channel, content string, index int, end bool) {
+		if channel == "final" && content == "Hello" {
+			cancel()
+		}
+	}
+	msgs, err := client.ChatCompletionStream(ctx, conv, callback, nil)
+	assert.ErrorIs(t, err, context.Canceled)
+	t.Log(api.Pretty(msgs))
+
+	require.Len(t, msgs, 1)
+	assert.Equal(t, api.Message{Role: "assistant", Content: "Hello", Reasoning: "thinking"}, msgs[0])
+}
+
+func TestStreamTimings(t *testing.T) {
+	client := testClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		time.Sleep(50 * time.Millisecond)
+		for _, chunk := range []string{
+			`{"model":"test-model","choices":[{"index":0,"delta":{"reasoning_content":"thinking about it"}}]}`,
+			`{"model":"test-model","choices":[{"index":0,"delta":{"content":"Hello"},"finish_reason":"stop"}]}`,
+			`{"model":"test-model","choices":[],"usage":{"prompt_tokens":20,"completion_tokens":12}}`,
+			`[DONE]`,
+		} {
+			fmt.Fprintf(w, "data: %s\n\n", chunk)
+			w.(http.Flusher).Flush()
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+	var stats api.Stats
+	msgs, err := client.ChatCompletionStream(t.Context(), newTestConversation(), discard, func(s api.Stats) { stats = s })
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+	// reasoning tokens are estimated from the text length as they are not reported
+	assert.Equal(t, 9, msgs[0].ReasoningTokens)
+	assert.Equal(t, 3, msgs[0].ContentTokens)
+	assert.Equal(t, 9, stats.ReasoningTokens)
+	assert.GreaterOrEqual(t, stats.TTFT, 50)
+	assert.Equal(t, stats.TTFT, stats.PrefillTime)
+	assert.Greater(t, stats.DecodeTokensPerSec(), stats.CompletionTokensPerSec())
+}
+
+func TestParallelToolCalls(t *testing.T) {
+	tool := &sleepTool{name: "sleep"}
+	calls := []toolCall{{"call_1", "sleep", `{"ms":100}`}, {"call_2", "sleep", `{"ms":10}`}, {"call_3", "sleep", `{"ms":50}`}}
+	client := testClient(t, jsonResponse(toolCallResponse(calls...)), jsonResponse(contentResponse("done")))
+
+	var stats api.Stats
+	msgs, err := client.ChatCompletion(context.Background(), newTestConversation(tool), discard, func(s api.Stats) { stats = s }, tool)
+	require.NoError(t, err)
+	t.Log(api.Pretty(msgs))
+
+	require.Len(t, msgs, 5)
+	for i, call := range calls {
+		assert.Equal(t, call.id, msgs[i+1].ToolCallID)
+		assert.Equal(t, call.args, msgs[i+1].Content)
+	}
+	assert.Equal(t, 3, stats.ToolCalls)
+	assert.Equal(t, 3, stats.Functions["sleep"])
+	assert.Greater(t, tool.maxRunning, int32(1), "expecting concurrent calls")
+}
+
+func TestSequentialToolCalls(t *testing.T) {
+	tool := &sleepTool{name: "sleep", sequential: true}
+	calls := []toolCall{{"call_1", "sleep", `{"ms":50}`}, {"call_2", "sleep", `{"ms":10}`}, {"call_3", "sleep", `{"ms":20}`}}
+	client := testClient(t, jsonResponse(toolCallResponse(calls...)), jsonResponse(contentResponse("done")))
+
+	msgs, err := client.ChatCompletion(context.Background(), newTestConversation(tool), discard, nil, tool)
+	require.NoError(t, err)
+
+	require.Len(t, msgs, 5)
+	assert.Equal(t, int32(1), tool.maxRunning, "expecting sequential calls")
+	assert.Equal(t, []string{`{"ms":50}`, `{"ms":10}`, `{"ms":20}`}, tool.order)
+}
+
+// tool which sleeps for the given time and records the max number of concurrent calls
+type sleepTool struct {
+	name       string
+	sequential bool
+	running    atomic.Int32
+	maxRunning int32
+	mu         sync.Mutex
+	order      []string
+}
+
+func (t *sleepTool) Definition() shared.FunctionDefinitionParam {
+	return shared.FunctionDefinitionParam{
+		Name:        t.name,
+		Description: openai.String("Sleep for given number of milliseconds."),
+		Parameters: shared.FunctionParameters{
+			"type":       "object",
+			"properties": map[string]any{"ms": map[string]any{"type": "number"}},
+		},
+	}
+}
+
+func (t *sleepTool) Call(args string) (req, resp string, err error) {
+	var arg struct{ Ms int }
+	json.Unmarshal([]byte(args), &arg)
+	n := t.running.Add(1)
+	t.mu.Lock()
+	t.maxRunning = max(t.maxRunning, n)
+	t.order = append(t.order, args)
+	t.mu.Unlock()
+	time.Sleep(time.Duration(arg.Ms) * time.Millisecond)
+	t.running.Add(-1)
+	return t.name + args, args, nil
+}
+
+func (t *sleepTool) Sequential() bool {
+	return t.sequential
+}
+
+// tool which blocks until it is interrupted
+type waitTool struct {
+	started     chan struct{}
+	interrupted chan struct{}
+}
+
+func (t *waitTool) Definition() shared.FunctionDefinitionParam {
+	return shared.FunctionDefinitionParam{
+		Name:        "wait",
+		Description: openai.String("Wait until interrupted."),
+		Parameters:  shared.FunctionParameters{"type": "object", "properties": map[string]any{}},
+	}
+}
+
+func (t *waitTool) Call(args string) (req, resp string, err error) {
+	close(t.started)
+	<-t.interrupted
+	return "wait()", "interrupted", nil
+}
+
+func (t *waitTool) Interrupt() {
+	close(t.interrupted)
+}
+
+// client connected to a local stand-in for the chat completions API which returns each of the responses in turn
+func testClient(t *testing.T, responses ...http.HandlerFunc) api.Client {
+	testServer(t, responses...)
+	client, err := api.NewClient(api.OpenRouter, "test-model")
+	require.NoError(t, err)
+	return client
+}
+
+// start test server and set OPENAI_BASE_URL to point to it
+func testServer(t *testing.T, responses ...http.HandlerFunc) *httptest.Server {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(calls.Add(1)) - 1
+		if n >= len(responses) {
+			http.Error(w, "unexpected request", http.StatusInternalServerError)
+			return
+		}
+		responses[n](w, r)
+	}))
+	t.Cleanup(srv.Close)
+	t.Setenv("OPENAI_BASE_URL", srv.URL)
+	return srv
+}
+
+func newTestConversation(tools ...api.ToolFunction) api.Conversation {
+	cfg := api.DefaultConfig(tools...)
+	cfg.CompactThreshold = 0
+	conv := api.NewConversation(cfg)
+	conv.Messages = append(conv.Messages, testMessages...)
+	return conv
+}
+
+func jsonResponse(body string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, body)
+	}
+}
+
+// send each of the chunks as server sent events then block until the request is cancelled
+func blockingStreamResponse(chunks ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, chunk := range chunks {
+			fmt.Fprintf(w, "data: %s\n\n", chunk)
+			w.(http.Flusher).Flush()
+		}
+		<-r.Context().Done()
+	}
+}
+
+type toolCall struct {
+	id, name, args string
+}
+
+func toolCallResponse(calls ...toolCall) string {
+	var list []string
+	for _, c := range calls {
+		list = append(list, fmt.Sprintf(`{"id":%q,"type":"function","function":{"name":%q,"arguments":%q}}`, c.id, c.name, c.args))
+	}
+	return fmt.Sprintf(`{"model":"test-model","choices":[{"index":0,"finish_reason":"tool_calls","message":{"role":"assistant","content":"",
+		"tool_calls":[%s]}}],"usage":{"prompt_tokens":10,"completion_tokens":5}}`, strings.Join(list, ","))
+}
+
+func contentResponse(content string) string {
+	return fmt.Sprintf(`{"model":"test-model","choices":[{"index":0,"finish_reason":"stop","message":{"role":"assistant","content":%q}}],
+		"usage":{"prompt_tokens":20,"completion_tokens":5}}`, content)
+}
+
+func discard(channel, content string, index int, end bool) {}
+
 func toJSON(v any) string {
 	data, err := json.Marshal(v)
 	if err != nil {
@@ -0,0 +1,96 @@
+package api
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/openai/openai-go/v3"
+	log "github.com/sirupsen/logrus"
+)
+
+// Tool approval policy - see ToolConfig
+const (
+	ApprovalAuto = "auto" // tool is called without asking - this is the default
+	ApprovalAsk  = "ask"  // Client.Approve is called to ask the user before each call is run
+	ApprovalDeny = "deny" // tool calls are rejected
+)
+
+// Response from the user to a request to approve a tool call
+type Approval struct {
+	Approved  bool
+	Arguments string // edited arguments in JSON format - the original arguments are used if this is blank
+}
+
+// Function called to ask the user to approve a tool call. It should block until the user responds or the context
+// is cancelled. Calls from the same assistant message are checked in order before any of them are run.
+type ApproveFunc func(ctx context.Context, call ToolCall) (Approval, error)
+
+// Approval policy for the named tool
+func (cfg Config) ToolApproval(name string) string {
+	for _, t := range cfg.Tools {
+		if t.Name == name && t.Approval != "" {
+			return t.Approval
+		}
+	}
+	return ApprovalAuto
+}
+
+// result of checking the approval policy for a tool call
+type approval struct {
+	checked bool   // set if the policy is not auto
+	args    string // arguments to use which may have been edited by the user
+	reject  string // message returned to the model if the call is not allowed
+}
+
+// check the approval policy for each of the tool calls in order before any are run - calls which have already been
+// rejected are skipped
+func approveCalls(ctx context.Context, cfg Config, calls []openai.ChatCompletionMessageToolCallUnion, tools []ToolFunction, approve ApproveFunc, res []approval) {
+	for i, call := range calls {
+		fn := call.Function
+		policy := cfg.ToolApproval(fn.Name)
+		tool := findTool(tools, fn.Name)
+		if policy == ApprovalAuto || tool == nil || res[i].reject != "" {
+			continue
+		}
+		// invalid arguments are reported when the tool is called
+		params := tool.Definition().Parameters
+		args, err := ValidateArgs(params, fn.Arguments)
+		if err != nil {
+			continue
+		}
+		res[i] = checkApproval(ctx, policy, ToolCall{ID: call.ID, Name: fn.Name, Arguments: args}, params, approve)
+	}
+}
+
+func checkApproval(ctx context.Context, policy string, call ToolCall, params map[string]any, approve ApproveFunc) approval {
+	res := approval{checked: true}
+	if policy != ApprovalAsk {
+		res.reject = fmt.Sprintf("Error: the user does not allow the %s function to be called", call.Name)
+		return res
+	}
+	if approve == nil {
+		res.reject = fmt.Sprintf("Error: the %s function requires approval from the user which is not available", call.Name)
+		return res
+	}
+	if ctx.Err() != nil {
+		res.reject = fmt.Sprintf("Error: %s function call cancelled", call.Name)
+		return res
+	}
+	log.Infof("ask for approval: %s(%s)", call.Name, call.Arguments)
+	resp, err := approve(ctx, call)
+	switch {
+	case err != nil:
+		res.reject = fmt.Sprintf("Error: approval for %s function call failed: %v", call.Name, err)
+	case !resp.Approved:
+		log.Infof("%s function call rejected", call.Name)
+		res.reject = fmt.Sprintf("The user declined the request to call the %s function. Do not try to call it again unless the user asks you to.", call.Name)
+	case resp.Arguments != "":
+		log.Infof("%s arguments edited: %s", call.Name, resp.Arguments)
+		if res.args, err = ValidateArgs(params, resp.Arguments); err != nil {
+			res.reject = invalidArgs(call.Name, err)
+		}
+	default:
+		res.args = call.Arguments
+	}
+	return res
+}
@@ -0,0 +1,51 @@
+package api_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jnb666/gpt-go/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestToolApproval(t *testing.T) {
+	tool := api.NewTool("get_forecast", "Get weather forecast.", forecast)
+	client := testClient(t,
+		jsonResponse(toolCallResponse(
+			toolCall{"call_1", "get_forecast", `{"location":"Paris"}`},
+			toolCall{"call_2", "get_forecast", `{"location":"London"}`},
+			toolCall{"call_3", "get_forecast", `{"location":"Rome"}`},
+		)),
+		jsonResponse(contentResponse("Done")),
+		jsonResponse(toolCallResponse(toolCall{"call_4", "get_forecast", `{"location":"Paris"}`})),
+		jsonResponse(contentResponse("Done")),
+	)
+	var asked []string
+	client.Approve = func(ctx context.Context, call api.ToolCall) (api.Approval, error) {
+		asked = append(asked, call.ID)
+		switch call.ID {
+		case "call_1":
+			return api.Approval{Approved: true}, nil
+		case "call_2":
+			return api.Approval{Approved: true, Arguments: `{"location":"London","days":"2"}`}, nil
+		}
+		return api.Approval{}, nil
+	}
+	conv := newTestConversation(tool)
+	conv.Config.Tools[0].Approval = api.ApprovalAsk
+	msgs, err := client.ChatCompletion(t.Context(), conv, discard, nil, tool)
+	require.NoError(t, err)
+	require.Len(t, msgs, 5)
+	assert.Equal(t, []string{"call_1", "call_2", "call_3"}, asked)
+	assert.Equal(t, "3 day forecast for Paris in metric units", msgs[1].Content)
+	assert.Equal(t, "2 day forecast for London in metric units", msgs[2].Content)
+	assert.Contains(t, msgs[3].Content, "The user declined the request to call the get_forecast function")
+
+	conv.Config.Tools[0].Approval = api.ApprovalDeny
+	msgs, err = client.ChatCompletion(t.Context(), conv, discard, nil, tool)
+	require.NoError(t, err)
+	require.Len(t, msgs, 3)
+	assert.Len(t, asked, 3)
+	assert.Equal(t, "Error: the user does not allow the get_forecast function to be called", msgs[1].Content)
+}
@@ -0,0 +1,75 @@
+package api
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/openai/openai-go/v3"
+	log "github.com/sirupsen/logrus"
+)
+
+// Added to the system prompt when a budget for the turn is reached and the tools are removed from the request
+var BudgetPrompt = "The budget for this turn has been used up (%s). No more tools are available - answer the user now using the information you already have."
+
+// reason if one of the limits for the turn in the config has been reached, else a blank string
+func (cfg Config) budgetExceeded(rounds int, stats *Stats, start time.Time) string {
+	switch {
+	case cfg.MaxToolRounds > 0 && rounds >= cfg.MaxToolRounds:
+		return fmt.Sprintf("max %d tool call rounds", cfg.MaxToolRounds)
+	case cfg.MaxTurnTokens > 0 && stats.CompletionTokens >= cfg.MaxTurnTokens:
+		return fmt.Sprintf("max %d completion tokens", cfg.MaxTurnTokens)
+	case cfg.MaxTurnTime > 0 && time.Since(start) >= time.Duration(cfg.MaxTurnTime)*time.Second:
+		return fmt.Sprintf("max %ds elapsed time", cfg.MaxTurnTime)
+	}
+	return ""
+}
+
+// Max number of calls to the named tool in one turn, or zero if there is no limit
+func (cfg Config) ToolMaxCalls(name string) int {
+	for _, t := range cfg.Tools {
+		if t.Name == name {
+			return t.MaxCalls
+		}
+	}
+	return 0
+}
+
+// tools which have not reached their call limit - the limit is recorded in the stats when first reached
+func (cfg Config) toolsWithinLimits(tools []ToolFunction, stats *Stats) (avail []ToolFunction) {
+	for _, tool := range tools {
+		name := tool.Definition().Name
+		if n := cfg.ToolMaxCalls(name); n > 0 && stats.Functions[name] >= n {
+			stats.addLimit(fmt.Sprintf("max %d %s calls", n, name))
+			continue
+		}
+		avail = append(avail, tool)
+	}
+	return avail
+}
+
+// reject calls which would exceed the tool call limit for the turn, including earlier calls in the same message
+func limitCalls(cfg Config, calls []openai.ChatCompletionMessageToolCallUnion, stats *Stats) []approval {
+	res := make([]approval, len(calls))
+	count := map[string]int{}
+	for i, call := range calls {
+		name := call.Function.Name
+		n := cfg.ToolMaxCalls(name)
+		if n == 0 {
+			continue
+		}
+		if stats.Functions[name]+count[name] >= n {
+			log.Warnf("%s call rejected - limit of %d calls reached", name, n)
+			res[i] = approval{checked: true, reject: fmt.Sprintf("Error: the limit of %d calls to the %s function in this turn has been reached - do not call it again", n, name)}
+			continue
+		}
+		count[name]++
+	}
+	return res
+}
+
+func (s *Stats) addLimit(reason string) {
+	if !slices.Contains(s.Limits, reason) {
+		s.Limits = append(s.Limits, reason)
+	}
+}
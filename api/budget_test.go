@@ -0,0 +1,90 @@
+package api_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/jnb666/gpt-go/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMaxToolRounds(t *testing.T) {
+	tool := api.NewTool("get_forecast", "Get weather forecast.", forecast)
+	var finalRequest struct {
+		Messages []struct {
+			Role    string
+			Content string
+		}
+		Tools []any
+	}
+	client := testClient(t,
+		jsonResponse(toolCallResponse(toolCall{"call_1", "get_forecast", `{"location":"Paris"}`})),
+		jsonResponse(toolCallResponse(toolCall{"call_2", "get_forecast", `{"location":"London"}`})),
+		func(w http.ResponseWriter, r *http.Request) {
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&finalRequest))
+			// tool calls after the budget is reached are ignored
+			jsonResponse(toolCallResponse(toolCall{"call_3", "get_forecast", `{"location":"Rome"}`}))(w, r)
+		},
+		jsonResponse(contentResponse("Paris and London are sunny")),
+	)
+	conv := newTestConversation(tool)
+	conv.Config.MaxToolRounds = 2
+	var stats api.Stats
+	msgs, err := client.ChatCompletion(t.Context(), conv, discard, func(s api.Stats) { stats = s }, tool)
+	require.NoError(t, err)
+	require.Len(t, msgs, 5)
+	assert.Equal(t, "Paris and London are sunny", msgs[4].Content)
+	assert.Equal(t, 2, stats.ToolCalls)
+	assert.Equal(t, 4, stats.ApiCalls)
+	assert.Equal(t, []string{"max 2 tool call rounds"}, stats.Limits)
+	assert.Empty(t, finalRequest.Tools)
+	assert.Contains(t, finalRequest.Messages[0].Content, "The budget for this turn has been used up (max 2 tool call rounds)")
+	assert.Equal(t, api.DefaultSystemMessage, conv.Config.SystemPrompt)
+}
+
+func TestMaxTurnTokens(t *testing.T) {
+	tool := api.NewTool("get_forecast", "Get weather forecast.", forecast)
+	client := testClient(t,
+		jsonResponse(toolCallResponse(toolCall{"call_1", "get_forecast", `{"location":"Paris"}`})),
+		jsonResponse(contentResponse("Paris is sunny")),
+	)
+	conv := newTestConversation(tool)
+	conv.Config.MaxTurnTokens = 5
+	var stats api.Stats
+	msgs, err := client.ChatCompletion(t.Context(), conv, discard, func(s api.Stats) { stats = s }, tool)
+	require.NoError(t, err)
+	require.Len(t, msgs, 3)
+	assert.Equal(t, []string{"max 5 completion tokens"}, stats.Limits)
+}
+
+func TestToolMaxCalls(t *testing.T) {
+	tool := api.NewTool("get_forecast", "Get weather forecast.", forecast)
+	var nextRequest struct {
+		Tools []any
+	}
+	client := testClient(t,
+		jsonResponse(toolCallResponse(
+			toolCall{"call_1", "get_forecast", `{"location":"Paris"}`},
+			toolCall{"call_2", "get_forecast", `{"location":"London"}`},
+			toolCall{"call_3", "get_forecast", `{"location":"Rome"}`},
+		)),
+		func(w http.ResponseWriter, r *http.Request) {
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&nextRequest))
+			jsonResponse(contentResponse("Done"))(w, r)
+		},
+	)
+	conv := newTestConversation(tool)
+	conv.Config.Tools[0].MaxCalls = 2
+	var stats api.Stats
+	msgs, err := client.ChatCompletion(t.Context(), conv, discard, func(s api.Stats) { stats = s }, tool)
+	require.NoError(t, err)
+	require.Len(t, msgs, 5)
+	assert.Equal(t, "3 day forecast for Paris in metric units", msgs[1].Content)
+	assert.Equal(t, "3 day forecast for London in metric units", msgs[2].Content)
+	assert.Equal(t, "Error: the limit of 2 calls to the get_forecast function in this turn has been reached - do not call it again", msgs[3].Content)
+	assert.Equal(t, 2, stats.ToolCalls)
+	assert.Equal(t, []string{"max 2 get_forecast calls"}, stats.Limits)
+	assert.Empty(t, nextRequest.Tools)
+}
@@ -0,0 +1,303 @@
+package api
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/openai/openai-go/v3"
+	log "github.com/sirupsen/logrus"
+)
+
+// Names of built in compaction strategies - selected using Config.CompactStrategy
+const (
+	CompactExclude   = "exclude"              // mark the oldest turns as excluded - this is the default
+	CompactSummarize = "summarize"            // exclude the oldest turns and replace them with a summary generated by the model
+	CompactTruncate  = "truncate-tool-output" // shorten the largest tool responses from earlier turns before excluding turns
+)
+
+var (
+	// System prompt for the side request used to summarize excluded turns
+	SummaryPrompt = "You are summarizing the earlier part of a conversation between a user and an AI assistant so that it can be continued " +
+		"without the full history. Write a concise summary which keeps all facts, decisions, results from tool calls and open questions " +
+		"which may be needed later. Reply with the summary only."
+	// Heading used when adding the summary to the system prompt
+	SummaryHeading = "Summary of the earlier conversation:"
+	// Max number of characters kept from each tool response by the truncate-tool-output strategy
+	TruncateToolOutput = 2000
+)
+
+// Function which reduces the prompt length by at least excess tokens by updating messages before index end in place.
+// Returns the number of tokens removed, or an error if there is nothing left to compact.
+type Compactor func(ctx context.Context, c *Client, conv Conversation, end, excess int) (removed int, err error)
+
+var compactors = map[string]Compactor{}
+
+func init() {
+	RegisterCompactor(CompactExclude, excludeTurns)
+	RegisterCompactor(CompactSummarize, summarizeTurns)
+	RegisterCompactor(CompactTruncate, truncateToolOutput)
+}
+
+// Register compaction strategy so it can be selected by name. Replaces any existing strategy with the same name.
+func RegisterCompactor(name string, fn Compactor) {
+	compactors[strings.ToLower(name)] = fn
+}
+
+// Sorted list of registered compaction strategy names
+func Compactors() []string {
+	return slices.Sorted(maps.Keys(compactors))
+}
+
+// Returned by a Compactor if there are no more messages which it can remove or shorten
+var ErrNothingToCompact = errors.New("no more messages to compact")
+
+// Estimate number of prompt tokens for the conversation using the token count reported by the server for the last
+// request in NumTokens plus the messages added since the last assistant message. If this exceeds the given limit then
+// the conversation is compacted using the strategy from Config.CompactStrategy. If there is nothing left to compact
+// from previous turns then the largest tool responses in the current turn are shortened. Messages are updated in place.
+func (c *Client) CompactMessages(ctx context.Context, conv Conversation, limit int) error {
+	strategy := cmp.Or(conv.Config.CompactStrategy, CompactExclude)
+	compact, ok := compactors[strings.ToLower(strategy)]
+	if !ok {
+		return fmt.Errorf("compaction strategy %q not found - expecting one of %s", strategy, strings.Join(Compactors(), ", "))
+	}
+	if c.ContextLength == 0 {
+		log.Warnf("CompactMessages: skipping as context length not known for %s server", c.Provider.Name())
+		return nil
+	}
+	if len(conv.Messages) == 0 {
+		log.Warn("empty conversation passed to CompactMessages - skipping")
+		return nil
+	}
+	tokens, err := c.promptTokens(conv)
+	if errors.Is(err, ErrNotSupported) {
+		log.Warnf("CompactMessages: skipping as tokenize not supported for %s server", c.Provider.Name())
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	end := conv.LastUserMessageNumber()
+	for tokens > limit {
+		log.Warnf("number of prompt tokens %d exceeds threshold of %d - compacting using %s", tokens, limit, strategy)
+		compactions.Inc(strings.ToLower(strategy))
+		removed, err := compact(ctx, c, conv, end, tokens-limit)
+		tokens -= removed
+		if errors.Is(err, ErrNothingToCompact) && end >= 0 {
+			log.Warnf("%v - truncating tool responses from current turn", err)
+			removed, err = c.truncateToolMessages(conv.Messages[end:], tokens-limit)
+			tokens -= removed
+		}
+		if err != nil {
+			return err
+		}
+	}
+	log.Infof("number of prompt tokens = %d / %d", tokens, limit)
+	return nil
+}
+
+// prompt tokens from the last request plus the new messages since the last assistant message, or count the
+// full request if the number of tokens is not known
+func (c *Client) promptTokens(conv Conversation) (int, error) {
+	if conv.NumTokens == 0 {
+		return c.TokenizeRequest(c.NewRequest(c.ModelName, conv))
+	}
+	start := len(conv.Messages)
+	for start > 0 && conv.Messages[start-1].Role != "assistant" {
+		start--
+	}
+	var msgs []openai.ChatCompletionMessageParamUnion
+	for _, m := range conv.Messages[start:] {
+		msgs = append(msgs, FromMessage(m, ""))
+	}
+	newTokens, err := c.Tokenize(msgs)
+	return conv.NumTokens + newTokens, err
+}
+
+// exclude the oldest turns until at least excess tokens have been removed
+func excludeTurns(ctx context.Context, c *Client, conv Conversation, end, excess int) (removed int, err error) {
+	for removed < excess {
+		start := slices.IndexFunc(conv.Messages[:max(end, 0)], func(m Message) bool { return !m.Excluded && m.Role == "user" })
+		if start < 0 {
+			return removed, fmt.Errorf("%w: exceeded limit but no earlier turns to exclude", ErrNothingToCompact)
+		}
+		excluded, err := excludeTurnAt(start, end, conv.Messages)
+		if err != nil {
+			return removed, err
+		}
+		tokens, err := c.Tokenize(excluded)
+		if err != nil {
+			return removed, err
+		}
+		removed += tokens
+	}
+	return removed, nil
+}
+
+func excludeTurnAt(start, end int, msgs []Message) (excluded []openai.ChatCompletionMessageParamUnion, err error) {
+	msgs[start].Excluded = true
+	excluded = append(excluded, FromMessage(msgs[start], ""))
+	for i := start + 1; i <= end; i++ {
+		if msgs[i].Role == "user" {
+			// llama.cpp gives "Assistant response prefill is incompatible with enable_thinking." error if last message is assistant so add a dummy record
+			excluded = append(excluded, openai.UserMessage(""))
+			log.Infof("excluded %d messages from turn starting at message %d", i-start, start)
+			return excluded, nil
+		}
+		msgs[i].Excluded = true
+		excluded = append(excluded, FromMessage(msgs[i], ""))
+	}
+	return nil, fmt.Errorf("ExcludeOldMessages: %w: exceeded limit but no more messages to exclude", ErrNothingToCompact)
+}
+
+// exclude the oldest turns and ask the model to summarize them along with any previous summary. The summary is saved
+// on the first message which is still included. If the summary request fails then the turns are just excluded.
+func summarizeTurns(ctx context.Context, c *Client, conv Conversation, end, excess int) (removed int, err error) {
+	prevSummary := conv.Summary()
+	first := firstIncluded(conv.Messages)
+	removed, excludeErr := excludeTurns(ctx, c, conv, end, excess)
+	if excludeErr != nil && !errors.Is(excludeErr, ErrNothingToCompact) {
+		return removed, excludeErr
+	}
+	next := firstIncluded(conv.Messages)
+	if next <= first {
+		return removed, excludeErr
+	}
+	summary, err := c.summarize(ctx, conv.ID, conv.Config, prevSummary, conv.Messages[first:next])
+	if err != nil {
+		if ctx.Err() != nil {
+			return removed, err
+		}
+		log.Warnf("error summarizing excluded messages - dropping them instead: %v", err)
+		return removed, excludeErr
+	}
+	log.Infof("summarized messages %d to %d in %d characters", first, next-1, len(summary))
+	conv.Messages[next].Summary = summary
+	oldTokens, err := c.summaryTokens(prevSummary)
+	if err != nil {
+		return removed, err
+	}
+	newTokens, err := c.summaryTokens(summary)
+	if err != nil {
+		return removed, err
+	}
+	return removed + oldTokens - newTokens, excludeErr
+}
+
+// side request to generate summary of the given messages
+func (c *Client) summarize(ctx context.Context, id string, cfg Config, prevSummary string, msgs []Message) (string, error) {
+	var b strings.Builder
+	if prevSummary != "" {
+		fmt.Fprintf(&b, "%s\n%s\n\n", SummaryHeading, prevSummary)
+	}
+	for _, m := range msgs {
+		switch {
+		case m.Role == "tool":
+			fmt.Fprintf(&b, "tool response:\n%s\n\n", m.Content)
+		case len(m.ToolCall) > 0:
+			for _, call := range toolCalls(m.ToolCall) {
+				fmt.Fprintf(&b, "assistant called %s(%s)\n\n", call.Function.Name, call.Function.Arguments)
+			}
+		case m.Images() > 0:
+			// images are not included in the summary request
+			fmt.Fprintf(&b, "%s:\n%s\n[%d images attached]\n\n", m.Role, m.Content, m.Images())
+		case isSet(m.Content):
+			fmt.Fprintf(&b, "%s:\n%s\n\n", m.Role, m.Content)
+		}
+	}
+	conv := Conversation{
+		Config:   Config{SystemPrompt: SummaryPrompt, ReasoningEffort: "low", Temperature: cfg.Temperature, TopP: cfg.TopP, TopK: cfg.TopK},
+		Messages: []Message{{Role: "user", Content: b.String()}},
+	}
+	var stats Stats
+	resp, err := c.completeWithRetry(ctx, conv, nil, false, func(string, string, int, bool) {}, &stats)
+	if err != nil {
+		return "", err
+	}
+	recordUsage(newUsage(id, c.Provider.Name(), cmp.Or(resp.Model, c.ModelName), resp.Usage))
+	if !isSet(resp.Content) {
+		return "", fmt.Errorf("summary request returned no content")
+	}
+	return trim(resp.Content), nil
+}
+
+func (c *Client) summaryTokens(summary string) (int, error) {
+	if summary == "" {
+		return 0, nil
+	}
+	return c.Tokenize([]openai.ChatCompletionMessageParamUnion{openai.SystemMessage(summaryPrompt(summary))})
+}
+
+// shorten the largest tool responses before index end until at least excess tokens have been removed, then fall
+// back to excluding turns if there are none left to truncate
+func truncateToolOutput(ctx context.Context, c *Client, conv Conversation, end, excess int) (removed int, err error) {
+	removed, err = c.truncateToolMessages(conv.Messages[:max(end, 0)], excess)
+	if errors.Is(err, ErrNothingToCompact) {
+		n, err := excludeTurns(ctx, c, conv, end, excess-removed)
+		return removed + n, err
+	}
+	return removed, err
+}
+
+// shorten the largest tool responses in msgs to TruncateToolOutput characters until at least excess tokens have been removed
+func (c *Client) truncateToolMessages(msgs []Message, excess int) (removed int, err error) {
+	for removed < excess {
+		i := largestToolOutput(msgs, TruncateToolOutput)
+		if i < 0 {
+			return removed, fmt.Errorf("%w: no more tool responses to truncate", ErrNothingToCompact)
+		}
+		n, err := c.truncateMessage(&msgs[i], TruncateToolOutput)
+		if err != nil {
+			return removed, err
+		}
+		log.Infof("truncated tool response %s - removed %d tokens", msgs[i].ToolCallID, n)
+		removed += n
+	}
+	return removed, nil
+}
+
+// index of largest included tool message with content longer than maxLen characters, or -1 if none
+func largestToolOutput(msgs []Message, maxLen int) int {
+	index, size := -1, maxLen
+	for i, m := range msgs {
+		if !m.Excluded && m.Role == "tool" && len(m.Content) > size {
+			index, size = i, len(m.Content)
+		}
+	}
+	return index
+}
+
+// truncate message content to maxLen characters and return the number of tokens removed
+func (c *Client) truncateMessage(m *Message, maxLen int) (removed int, err error) {
+	before, err := c.Tokenize([]openai.ChatCompletionMessageParamUnion{FromMessage(*m, "")})
+	if err != nil {
+		return 0, err
+	}
+	m.Content = truncateMiddle(m.Content, maxLen)
+	after, err := c.Tokenize([]openai.ChatCompletionMessageParamUnion{FromMessage(*m, "")})
+	if err != nil {
+		return 0, err
+	}
+	return before - after, nil
+}
+
+// keep the start and end of the text with a marker in place of the omitted characters so that the total length
+// including the marker is at most maxLen
+func truncateMiddle(s string, maxLen int) string {
+	const markerLen = 48
+	if len(s) <= maxLen {
+		return s
+	}
+	n := max(maxLen-markerLen, 0) / 2
+	head, tail := strings.ToValidUTF8(s[:n], ""), strings.ToValidUTF8(s[len(s)-n:], "")
+	return fmt.Sprintf("%s\n... [%d characters omitted] ...\n%s", head, len(s)-len(head)-len(tail), tail)
+}
+
+func firstIncluded(msgs []Message) int {
+	return slices.IndexFunc(msgs, func(m Message) bool { return !m.Excluded })
+}
@@ -0,0 +1,134 @@
+package api_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/jnb666/gpt-go/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompactSummarize(t *testing.T) {
+	var summaryRequest map[string]any
+	client := testClient(t,
+		func(w http.ResponseWriter, r *http.Request) {
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&summaryRequest))
+			jsonResponse(contentResponse("The user likes long stories about dragons."))(w, r)
+		},
+	)
+	client.ContextLength = 100000
+	conv := compactTestConversation(api.CompactSummarize, strings.Repeat("Once upon a time there was a dragon. ", 100))
+
+	err := client.CompactMessages(t.Context(), conv, conv.NumTokens)
+	require.NoError(t, err)
+	checkNumMessages(t, conv.Messages, 5, 2)
+	assert.Equal(t, "The user likes long stories about dragons.", conv.Messages[2].Summary)
+	assert.Equal(t, "The user likes long stories about dragons.", conv.Summary())
+
+	// side request has the excluded turn as a transcript
+	messages := summaryRequest["messages"].([]any)
+	require.Len(t, messages, 2)
+	assert.Equal(t, api.SummaryPrompt, messages[0].(map[string]any)["content"])
+	assert.Contains(t, messages[1].(map[string]any)["content"], "user:\nTell me a story")
+	assert.NotContains(t, summaryRequest, "tools")
+
+	// summary is added to the system prompt in place of the excluded messages
+	req := client.NewRequest(client.ModelName, conv)
+	require.Len(t, req.Messages, 4)
+	system := req.Messages[0].OfSystem.Content.OfString.Value
+	assert.True(t, strings.HasSuffix(system, api.SummaryHeading+"\nThe user likes long stories about dragons."), system)
+}
+
+func TestCompactSummarizeError(t *testing.T) {
+	client := testClient(t, errorResponse(http.StatusBadRequest))
+	client.ContextLength = 100000
+	conv := compactTestConversation(api.CompactSummarize, strings.Repeat("Once upon a time there was a dragon. ", 100))
+
+	// falls back to excluding the messages without a summary
+	err := client.CompactMessages(t.Context(), conv, conv.NumTokens)
+	require.NoError(t, err)
+	checkNumMessages(t, conv.Messages, 5, 2)
+	assert.Equal(t, "", conv.Summary())
+}
+
+func TestCompactTruncateToolOutput(t *testing.T) {
+	client := testClient(t)
+	client.ContextLength = 100000
+	conv := compactTestConversation(api.CompactTruncate, "Once upon a time")
+	conv.Messages = append([]api.Message{
+		{Role: "user", Content: "Read the page"},
+		{Role: "assistant", ToolCall: json.RawMessage(`[{"id":"call_1","type":"function","function":{"name":"browser_open","arguments":"{}"}}]`)},
+		{Role: "tool", ToolCallID: "call_1", Content: "START " + strings.Repeat("lots of text ", 1000) + " END"},
+	}, conv.Messages...)
+
+	err := client.CompactMessages(t.Context(), conv, conv.NumTokens)
+	require.NoError(t, err)
+	checkNumMessages(t, conv.Messages, 8, 0)
+	content := conv.Messages[2].Content
+	assert.LessOrEqual(t, len(content), api.TruncateToolOutput)
+	assert.True(t, strings.HasPrefix(content, "START lots of text"))
+	assert.True(t, strings.HasSuffix(content, "lots of text  END"))
+	assert.Contains(t, content, "characters omitted")
+}
+
+func TestCompactCurrentTurn(t *testing.T) {
+	var requests []map[string]any
+	record := func(body string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			var req map[string]any
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+			requests = append(requests, req)
+			jsonResponse(body)(w, r)
+		}
+	}
+	page := "START " + strings.Repeat("lots of text ", 2000) + " END"
+	client := testClient(t,
+		record(toolCallResponse(toolCall{"call_1", "sleep", toJSON(map[string]string{"page": page})})),
+		record(contentResponse("done")),
+	)
+	client.ContextLength = 2000
+	tool := &sleepTool{name: "sleep"}
+	conv := newTestConversation(tool)
+	conv.Config.CompactThreshold = 0.5
+
+	msgs, err := client.ChatCompletion(t.Context(), conv, discard, nil, tool)
+	require.NoError(t, err)
+	require.Len(t, msgs, 3)
+
+	// previous turn is excluded in the caller's conversation, then the tool response is shortened
+	checkNumMessages(t, conv.Messages, 3, 2)
+	assert.LessOrEqual(t, len(msgs[1].Content), api.TruncateToolOutput)
+	assert.Contains(t, msgs[1].Content, "characters omitted")
+
+	require.Len(t, requests, 2)
+	assert.Len(t, requests[0]["messages"], 4)
+	messages := requests[1]["messages"].([]any)
+	require.Len(t, messages, 4)
+	assert.Equal(t, msgs[1].Content, messages[3].(map[string]any)["content"])
+}
+
+func TestCompactUnknownStrategy(t *testing.T) {
+	client := testClient(t)
+	client.ContextLength = 100000
+	conv := compactTestConversation("forget-everything", "Once upon a time")
+	err := client.CompactMessages(t.Context(), conv, conv.NumTokens)
+	assert.ErrorContains(t, err, `compaction strategy "forget-everything" not found`)
+}
+
+// conversation with two previous turns where the total prompt size is just over the limit
+func compactTestConversation(strategy, story string) api.Conversation {
+	conv := newTestConversation()
+	conv.Config.CompactStrategy = strategy
+	conv.Messages = []api.Message{
+		{Role: "user", Content: "Tell me a story"},
+		{Role: "assistant", Content: story},
+		{Role: "user", Content: "Another one"},
+		{Role: "assistant", Content: "The end."},
+		{Role: "user", Content: "Thanks"},
+	}
+	conv.NumTokens = 5000
+	return conv
+}
@@ -0,0 +1,171 @@
+package api
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/openai/openai-go/v3"
+	log "github.com/sirupsen/logrus"
+)
+
+// Estimated number of prompt tokens for each image if the server does not have a tokenize API
+var ImageTokens = 768
+
+// Part of multimodal user message content - text or an image. An image is either a URL, which may be a data URL
+// with the base64 encoded image, or a reference to a local file which is read when the request is sent.
+type ContentPart struct {
+	Type string `json:"type"` // text | image
+	Text string `json:"text,omitzero"`
+	URL  string `json:"url,omitzero"`
+	File string `json:"file,omitzero"`
+}
+
+func TextPart(text string) ContentPart {
+	return ContentPart{Type: "text", Text: text}
+}
+
+// Image part from http(s) URL or data URL
+func ImagePart(url string) ContentPart {
+	return ContentPart{Type: "image", URL: url}
+}
+
+// Image part referencing a local file - the file should not be removed while the conversation is in use
+func ImageFile(path string) ContentPart {
+	return ContentPart{Type: "image", File: path}
+}
+
+// Image part with the data encoded as a data URL. The media type is detected from the content.
+func ImageData(data []byte) ContentPart {
+	return ImagePart(DataURL(data))
+}
+
+// Create a user message from a list of content parts. Content is set to the text parts so the message can be
+// displayed, and Parts is only set if there are any images.
+func NewUserMessage(parts ...ContentPart) Message {
+	msg := Message{Role: "user"}
+	var text []string
+	for _, p := range parts {
+		switch p.Type {
+		case "text":
+			text = append(text, p.Text)
+		case "image":
+			msg.Parts = parts
+		}
+	}
+	msg.Content = strings.Join(text, "\n")
+	return msg
+}
+
+// Number of image parts in the message
+func (m Message) Images() int {
+	n := 0
+	for _, p := range m.Parts {
+		if p.Type == "image" {
+			n++
+		}
+	}
+	return n
+}
+
+// URL to send to the model - if File is set then the file is read and returned as a data URL
+func (p ContentPart) ImageURL() (string, error) {
+	if p.File == "" {
+		return p.URL, nil
+	}
+	data, err := os.ReadFile(p.File)
+	if err != nil {
+		return "", err
+	}
+	return DataURL(data), nil
+}
+
+// Encode image data as a data URL
+func DataURL(data []byte) string {
+	return "data:" + http.DetectContentType(data) + ";base64," + base64.StdEncoding.EncodeToString(data)
+}
+
+// media type and base64 encoded data from a data URL
+func parseDataURL(url string) (mediaType, data string, ok bool) {
+	header, data, ok := strings.Cut(strings.TrimPrefix(url, "data:"), ",")
+	if !ok || !strings.HasPrefix(url, "data:") || !strings.HasSuffix(header, ";base64") {
+		return "", "", false
+	}
+	return strings.TrimSuffix(header, ";base64"), data, true
+}
+
+// Decode base64 encoded data URL
+func DecodeDataURL(url string) (mediaType string, data []byte, err error) {
+	mediaType, encoded, ok := parseDataURL(url)
+	if !ok {
+		return "", nil, fmt.Errorf("invalid data URL - expecting data:<media type>;base64,<data>")
+	}
+	data, err = base64.StdEncoding.DecodeString(encoded)
+	return mediaType, data, err
+}
+
+// content parts for chat completions request - if an image file cannot be read then it is replaced by an error
+// message so that the model knows it is missing
+func contentParts(parts []ContentPart) (list []openai.ChatCompletionContentPartUnionParam) {
+	for _, p := range parts {
+		switch p.Type {
+		case "text":
+			list = append(list, openai.TextContentPart(p.Text))
+		case "image":
+			url, err := p.ImageURL()
+			if err != nil {
+				list = append(list, openai.TextContentPart(missingImage(p, err)))
+				continue
+			}
+			list = append(list, openai.ImageContentPart(openai.ChatCompletionContentPartImageImageURLParam{URL: url}))
+		}
+	}
+	return list
+}
+
+// placeholder text sent to the model if an image file cannot be read
+func missingImage(p ContentPart, err error) string {
+	log.Warnf("error loading image: %v", err)
+	return fmt.Sprintf("[image %s not available]", p.File)
+}
+
+// convert chat completions content parts back to our format - text from each part is also returned
+func fromContentParts(list []openai.ChatCompletionContentPartUnionParam) (parts []ContentPart, text string) {
+	var texts []string
+	for _, p := range list {
+		switch {
+		case p.OfText != nil:
+			parts = append(parts, TextPart(p.OfText.Text))
+			texts = append(texts, p.OfText.Text)
+		case p.OfImageURL != nil:
+			parts = append(parts, ImagePart(p.OfImageURL.ImageURL.URL))
+		}
+	}
+	return parts, strings.Join(texts, "\n")
+}
+
+// number of image parts in a user message
+func countImages(m openai.ChatCompletionMessageParamUnion) (n int) {
+	if m.OfUser != nil {
+		for _, p := range m.OfUser.Content.OfArrayOfContentParts {
+			if p.OfImageURL != nil {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// text content from string or list of content parts
+func messageText(m openai.ChatCompletionMessageParamUnion) string {
+	if content, ok := m.GetContent().AsAny().(*string); ok {
+		return *content
+	}
+	if m.OfUser != nil {
+		_, text := fromContentParts(m.OfUser.Content.OfArrayOfContentParts)
+		return text
+	}
+	return ""
+}
@@ -0,0 +1,102 @@
+package api_test
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jnb666/gpt-go/api"
+	"github.com/openai/openai-go/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// 1x1 pixel PNG image
+var testImage = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR\x00\x00\x00\x01\x00\x00\x00\x01\x08\x06\x00\x00\x00\x1f\x15\xc4\x89" +
+	"\x00\x00\x00\rIDATx\x9cc\xf8\x0f\x00\x00\x01\x01\x00\x05\x18\xd8N\x00\x00\x00\x00IEND\xaeB`\x82")
+
+func TestImageMessage(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "test.png")
+	require.NoError(t, os.WriteFile(file, testImage, 0644))
+	dataURL := api.DataURL(testImage)
+	assert.Regexp(t, `^data:image/png;base64,iVBORw0KGgo`, dataURL)
+
+	msg := api.NewUserMessage(api.TextPart("what is this?"), api.ImageFile(file))
+	assert.Equal(t, "what is this?", msg.Content)
+	assert.Equal(t, 1, msg.Images())
+	assert.Empty(t, api.NewUserMessage(api.TextPart("hello")).Parts)
+
+	// saved with the file reference
+	var saved api.Message
+	require.NoError(t, json.Unmarshal([]byte(toJSON(msg)), &saved))
+	assert.Equal(t, msg, saved)
+
+	mediaType, data, err := api.DecodeDataURL(dataURL)
+	require.NoError(t, err)
+	assert.Equal(t, "image/png", mediaType)
+	assert.Equal(t, testImage, data)
+
+	// image file is sent as a data URL
+	param := api.FromMessage(msg, "")
+	assert.JSONEq(t, `{"role":"user","content":[{"type":"text","text":"what is this?"},{"type":"image_url","image_url":{"url":"`+dataURL+`"}}]}`,
+		toJSON(param))
+	assert.Equal(t, api.Message{Role: "user", Content: "what is this?", Parts: []api.ContentPart{
+		api.TextPart("what is this?"), api.ImagePart(dataURL),
+	}}, api.ToMessage(param, ""))
+
+	// missing file is replaced with a placeholder
+	param = api.FromMessage(api.NewUserMessage(api.ImageFile(filepath.Join(t.TempDir(), "missing.png"))), "")
+	assert.Contains(t, toJSON(param), "not available")
+}
+
+func TestImageTokens(t *testing.T) {
+	client := testClient(t)
+	text, err := client.Tokenize([]openai.ChatCompletionMessageParamUnion{api.FromMessage(api.NewUserMessage(api.TextPart("hello")), "")})
+	require.NoError(t, err)
+	msg := api.NewUserMessage(api.TextPart("hello"), api.ImageData(testImage), api.ImageData(testImage))
+	withImages, err := client.Tokenize([]openai.ChatCompletionMessageParamUnion{api.FromMessage(msg, "")})
+	require.NoError(t, err)
+	assert.Equal(t, 2*api.ImageTokens, withImages-text)
+}
+
+func TestImageRequest(t *testing.T) {
+	var chatRequest, anthropicRequest, responsesRequest map[string]any
+	record := func(req *map[string]any, body string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			require.NoError(t, json.NewDecoder(r.Body).Decode(req))
+			jsonResponse(body)(w, r)
+		}
+	}
+	conv := newTestConversation()
+	conv.Messages = []api.Message{api.NewUserMessage(api.TextPart("describe this"), api.ImagePart("https://example.com/cat.jpg"),
+		api.ImageData(testImage))}
+
+	client := testClient(t, record(&chatRequest, contentResponse("a cat")))
+	_, err := client.ChatCompletion(t.Context(), conv, discard, nil)
+	require.NoError(t, err)
+	messages := chatRequest["messages"].([]any)
+	assert.JSONEq(t, `[{"type":"text","text":"describe this"},{"type":"image_url","image_url":{"url":"https://example.com/cat.jpg"}},
+		{"type":"image_url","image_url":{"url":"`+api.DataURL(testImage)+`"}}]`, toJSON(messages[len(messages)-1].(map[string]any)["content"]))
+
+	client = anthropicClient(t, record(&anthropicRequest, `{"model":"claude-test","stop_reason":"end_turn",
+		"content":[{"type":"text","text":"a cat"}],"usage":{"input_tokens":10,"output_tokens":2}}`))
+	_, err = client.ChatCompletion(t.Context(), conv, discard, nil)
+	require.NoError(t, err)
+	messages = anthropicRequest["messages"].([]any)
+	assert.JSONEq(t, `[{"type":"text","text":"describe this"},{"type":"image","source":{"type":"url","url":"https://example.com/cat.jpg"}},
+		{"type":"image","source":{"type":"base64","media_type":"image/png","data":"`+base64.StdEncoding.EncodeToString(testImage)+`"}}]`,
+		toJSON(messages[len(messages)-1].(map[string]any)["content"]))
+
+	client = testClient(t, record(&responsesRequest, `{"id":"resp_1","object":"response","model":"test-model","status":"completed","output":[
+		{"type":"message","id":"msg_1","role":"assistant","status":"completed","content":[{"type":"output_text","text":"a cat","annotations":[]}]}],
+		"usage":{"input_tokens":10,"output_tokens":2,"total_tokens":12}}`))
+	client.ResponsesAPI = true
+	_, err = client.ChatCompletion(t.Context(), conv, discard, nil)
+	require.NoError(t, err)
+	input := responsesRequest["input"].([]any)
+	assert.JSONEq(t, `[{"type":"input_text","text":"describe this"},{"type":"input_image","detail":"auto","image_url":"https://example.com/cat.jpg"},
+		{"type":"input_image","detail":"auto","image_url":"`+api.DataURL(testImage)+`"}]`, toJSON(input[len(input)-1].(map[string]any)["content"]))
+}
@@ -0,0 +1,128 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Provider, model and server address used to create a client
+type Endpoint struct {
+	Provider  string
+	ModelName string // optional - uses the provider default if blank
+	BaseURL   string // optional - uses the provider default if blank
+	APIKey    string // optional - uses the OPENAI_API_KEY environment variable if blank
+}
+
+// Parse comma separated list of endpoints in provider[:model] format - e.g. "vllm,openrouter:@preset/gpt-oss-120".
+// The base URL and API key for each endpoint are set from the {PROVIDER}_BASE_URL and {PROVIDER}_API_KEY environment
+// variables if defined - e.g. VLLM_BASE_URL or CEREBRAS_API_KEY.
+func ParseEndpoints(spec string) (list []Endpoint, err error) {
+	for _, s := range strings.Split(spec, ",") {
+		s = trim(s)
+		if s == "" {
+			continue
+		}
+		provider, model, _ := strings.Cut(s, ":")
+		if _, err := GetProvider(provider); err != nil {
+			return nil, err
+		}
+		list = append(list, Endpoint{
+			Provider:  provider,
+			ModelName: model,
+			BaseURL:   providerEnv(provider, "BASE_URL"),
+			APIKey:    providerEnv(provider, "API_KEY"),
+		})
+	}
+	return list, nil
+}
+
+// environment variable setting for provider - e.g. OLLAMA_BASE_URL
+func providerEnv(provider, key string) string {
+	return os.Getenv(strings.ToUpper(provider) + "_" + key)
+}
+
+// Add endpoints to the failover chain. If a request fails because the server is unavailable, overloaded or the context
+// length is exceeded then the turn continues on the next endpoint in the chain. The fallback servers do not need to be
+// running when they are added - if the context length cannot be read then it is retried when the endpoint is first used.
+func (c *Client) AddFallback(endpoints ...Endpoint) error {
+	for _, e := range endpoints {
+		fallback, err := newClient(e)
+		if err != nil {
+			if fallback.Provider == nil {
+				return err
+			}
+			log.Warnf("fallback %s %s: error getting context length: %v", fallback.Provider.Name(), fallback.ModelName, err)
+		}
+		c.Fallbacks = append(c.Fallbacks, &fallback)
+	}
+	return nil
+}
+
+// send request starting from the active client, switching to the next fallback on error - returns the client used
+func (c *Client) completeWithFailover(ctx context.Context, active *Client, conv Conversation, tools []ToolFunction, stream bool, callback CallbackFunc, stats *Stats) (
+	resp Completion, used *Client, err error) {
+
+	chain := append([]*Client{c}, c.Fallbacks...)
+	for i := slices.Index(chain, active); ; i++ {
+		resp, err = chain[i].completeWithRetry(ctx, conv, tools, stream, callback, stats)
+		if err == nil || i == len(chain)-1 || ctx.Err() != nil || streamStarted(resp, stream) || !canFailover(err) {
+			return resp, chain[i], err
+		}
+		notice := fmt.Sprintf("%s %s failed: %v - switching to %s %s", chain[i].Provider.Name(), chain[i].ModelName, err,
+			chain[i+1].Provider.Name(), chain[i+1].ModelName)
+		log.Warn(notice)
+		callback("analysis", notice+"\n", 0, false)
+		chain[i+1].updateContextLength()
+	}
+}
+
+// retry getting the context length for an endpoint which was not available when the client was created
+func (c *Client) updateContextLength() {
+	if c.ContextLength > 0 {
+		return
+	}
+	n, err := c.MaxModelLength()
+	if errors.Is(err, ErrNotSupported) {
+		return
+	}
+	if err != nil {
+		log.Warnf("%s %s: error getting context length: %v", c.Provider.Name(), c.ModelName, err)
+		return
+	}
+	c.ContextLength = n
+}
+
+// server down, overloaded or request too long for the model context
+func canFailover(err error) bool {
+	status, _, ok := errorStatus(err)
+	if !ok {
+		// connection errors etc.
+		return true
+	}
+	if retryable(status) {
+		return true
+	}
+	if status == http.StatusBadRequest || status == http.StatusRequestEntityTooLarge {
+		return contextOverflow(err)
+	}
+	return false
+}
+
+var contextOverflowMessages = []string{"context length", "context size", "context window", "context_length", "maximum context", "too many tokens", "prompt is too long"}
+
+func contextOverflow(err error) bool {
+	msg := strings.ToLower(err.Error())
+	for _, s := range contextOverflowMessages {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,157 @@
+package api_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jnb666/gpt-go/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFailover(t *testing.T) {
+	fastRetry(t, 0)
+	fallback := testServer(t, jsonResponse(modelResponse("fallback-model", "Hello")))
+	client := testClient(t, errorResponse(http.StatusServiceUnavailable))
+	require.NoError(t, client.AddFallback(api.Endpoint{Provider: api.OpenRouter, ModelName: "fallback-model", BaseURL: fallback.URL}))
+
+	var analysis []string
+	callback := func(channel, content string, index int, end bool) {
+		if channel == "analysis" {
+			analysis = append(analysis, content)
+		}
+	}
+	var stats api.Stats
+	msgs, err := client.ChatCompletion(t.Context(), newTestConversation(), callback, func(s api.Stats) { stats = s })
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+	assert.Equal(t, "Hello", msgs[0].Content)
+	assert.Equal(t, []string{"fallback-model"}, stats.Models)
+	require.Len(t, analysis, 1)
+	assert.True(t, strings.HasPrefix(analysis[0], "openrouter test-model failed:"), analysis[0])
+	assert.Contains(t, analysis[0], "503")
+	assert.Contains(t, analysis[0], "switching to openrouter fallback-model")
+}
+
+func TestFailoverContextOverflow(t *testing.T) {
+	fastRetry(t, 0)
+	tool := &sleepTool{name: "sleep"}
+	fallback := testServer(t,
+		jsonResponse(modelResponse("fallback-model", "done")),
+		jsonResponse(modelResponse("fallback-model", "next turn")),
+	)
+	client := testClient(t,
+		jsonResponse(toolCallResponse(toolCall{"call_1", "sleep", `{"id":"a"}`})),
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error":{"message":"This model's maximum context length is 8192 tokens","code":400}}`)
+		},
+		jsonResponse(modelResponse("test-model", "back on primary")),
+	)
+	require.NoError(t, client.AddFallback(api.Endpoint{Provider: api.OpenRouter, ModelName: "fallback-model", BaseURL: fallback.URL}))
+
+	var stats api.Stats
+	conv := newTestConversation(tool)
+	msgs, err := client.ChatCompletion(t.Context(), conv, discard, func(s api.Stats) { stats = s }, tool)
+	require.NoError(t, err)
+	require.Len(t, msgs, 3)
+	assert.Equal(t, "done", msgs[2].Content)
+	assert.Equal(t, []string{"test-model", "fallback-model"}, stats.Models)
+	assert.Equal(t, []string{`{"id":"a"}`}, tool.order)
+
+	// next turn starts from the primary endpoint again
+	msgs, err = client.ChatCompletion(t.Context(), conv, discard, func(s api.Stats) { stats = s }, tool)
+	require.NoError(t, err)
+	assert.Equal(t, "back on primary", msgs[0].Content)
+	assert.Equal(t, []string{"test-model"}, stats.Models)
+}
+
+func TestFailoverServerDown(t *testing.T) {
+	fallback := testServer(t, jsonResponse(modelResponse("fallback-model", "Hello")))
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	t.Setenv("OPENAI_BASE_URL", down.URL)
+	client, err := api.NewClient(api.OpenRouter, "test-model")
+	require.NoError(t, err)
+	require.NoError(t, client.AddFallback(api.Endpoint{Provider: api.OpenRouter, ModelName: "fallback-model", BaseURL: fallback.URL}))
+
+	msgs, err := client.ChatCompletion(t.Context(), newTestConversation(), discard, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "Hello", msgs[0].Content)
+}
+
+func TestFallbackDownWhenAdded(t *testing.T) {
+	client := testClient(t, jsonResponse(modelResponse("test-model", "Hello")))
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	require.NoError(t, client.AddFallback(api.Endpoint{Provider: api.Ollama, BaseURL: down.URL + "/v1"}))
+	require.Len(t, client.Fallbacks, 1)
+	assert.Equal(t, 0, client.Fallbacks[0].ContextLength)
+}
+
+func TestFailoverDropsForeignReasoning(t *testing.T) {
+	fastRetry(t, 0)
+	tool := &sleepTool{name: "sleep"}
+	var fallbackRequest map[string]any
+	fallback := testServer(t, func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&fallbackRequest))
+		jsonResponse(`{"model":"claude-test","stop_reason":"end_turn","content":[{"type":"text","text":"done"}],
+			"usage":{"input_tokens":30,"output_tokens":4}}`)(w, r)
+	})
+	client := testClient(t,
+		jsonResponse(`{"id":"resp_1","object":"response","model":"test-model","status":"completed","output":[
+			{"type":"reasoning","id":"rs_1","summary":[],"encrypted_content":"enc1"},
+			{"type":"function_call","id":"fc_1","call_id":"call_1","name":"sleep","arguments":"{}","status":"completed"}],
+			"usage":{"input_tokens":10,"output_tokens":7,"total_tokens":17}}`),
+		errorResponse(http.StatusServiceUnavailable),
+	)
+	client.ResponsesAPI = true
+	require.NoError(t, client.AddFallback(api.Endpoint{Provider: api.Anthropic, ModelName: "claude-test", BaseURL: fallback.URL}))
+
+	msgs, err := client.ChatCompletion(t.Context(), newTestConversation(tool), discard, nil, tool)
+	require.NoError(t, err)
+	require.Len(t, msgs, 3)
+	assert.Equal(t, "done", msgs[2].Content)
+	assert.NotEmpty(t, msgs[0].ReasoningBlocks)
+	assert.Contains(t, msgs[0].ReasoningSource, "openrouter")
+
+	// encrypted reasoning from the Responses API is not sent to Anthropic
+	messages := fallbackRequest["messages"].([]any)
+	assistant := messages[len(messages)-2].(map[string]any)
+	assert.Equal(t, toJSON([]any{
+		map[string]any{"type": "tool_use", "id": "call_1", "name": "sleep", "input": map[string]any{}},
+	}), toJSON(assistant["content"]))
+}
+
+func TestNoFailoverAuthError(t *testing.T) {
+	fallback := testServer(t, jsonResponse(modelResponse("fallback-model", "Hello")))
+	client := testClient(t, errorResponse(http.StatusUnauthorized))
+	require.NoError(t, client.AddFallback(api.Endpoint{Provider: api.OpenRouter, ModelName: "fallback-model", BaseURL: fallback.URL}))
+
+	_, err := client.ChatCompletion(t.Context(), newTestConversation(), discard, nil)
+	assert.ErrorContains(t, err, "401")
+}
+
+func TestParseEndpoints(t *testing.T) {
+	t.Setenv("VLLM_BASE_URL", "http://gpu-server:8000/v1")
+	t.Setenv("OPENROUTER_API_KEY", "sk-or-test")
+	list, err := api.ParseEndpoints("vllm, ollama:gpt-oss:20b,openrouter:@preset/gpt-oss-120")
+	require.NoError(t, err)
+	assert.Equal(t, []api.Endpoint{
+		{Provider: "vllm", BaseURL: "http://gpu-server:8000/v1"},
+		{Provider: "ollama", ModelName: "gpt-oss:20b"},
+		{Provider: "openrouter", ModelName: "@preset/gpt-oss-120", APIKey: "sk-or-test"},
+	}, list)
+
+	_, err = api.ParseEndpoints("vllm,unknown")
+	assert.ErrorContains(t, err, `provider "unknown" not found`)
+}
+
+func modelResponse(model, content string) string {
+	return fmt.Sprintf(`{"model":%q,"choices":[{"index":0,"finish_reason":"stop","message":{"role":"assistant","content":%q}}],
+		"usage":{"prompt_tokens":20,"completion_tokens":5}}`, model, content)
+}
@@ -2,7 +2,9 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"iter"
 	"slices"
 	"strings"
 	"time"
@@ -18,24 +20,35 @@ var (
 	DefaultSystemMessage = "You are a helpful assistant. You should answer concisely unless more detail is requested. The current date is {{today}}."
 	// Used by NewRequest
 	ParallelToolCalls = true
+	// Max number of tool calls from one assistant message which are run concurrently
+	MaxParallelToolCalls = 4
 )
 
 // Chat API request from frontend to webserver
 type Request struct {
-	Action  string  `json:"action"`           // add | list | load | delete | config
-	ID      string  `json:"id,omitzero"`      // if action=load,delete uuid format
-	Message Message `json:"message,omitzero"` // if action=add
-	Config  *Config `json:"config,omitzero"`  // if action=config
+	Action    string  `json:"action"`             // add | stop | list | load | delete | config | approve | reject
+	ID        string  `json:"id,omitzero"`        // if action=load,delete uuid format, if action=approve,reject tool call id
+	Message   Message `json:"message,omitzero"`   // if action=add
+	Config    *Config `json:"config,omitzero"`    // if action=config
+	Arguments string  `json:"arguments,omitzero"` // if action=approve - edited tool call arguments in JSON format
 }
 
 // Chat API response from webserver back to frontend
 type Response struct {
-	Action       string       `json:"action"`                // add | list | load | config | stats
+	Action       string       `json:"action"`                // add | list | load | config | stats | approve
 	Message      Message      `json:"message,omitzero"`      // if action=add
 	Conversation Conversation `json:"conversation,omitzero"` // if action=load
 	List         []Item       `json:"list,omitzero"`         // if action=list
 	Config       Config       `json:"config,omitzero"`       // if action=config
 	Stats        Stats        `json:"stats,omitzero"`        // if action=stats
+	Call         ToolCallInfo `json:"call,omitzero"`         // if action=approve
+}
+
+// Tool call which needs approval from the user
+type ToolCallInfo struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"` // pretty printed JSON
 }
 
 type Conversation struct {
@@ -51,12 +64,17 @@ type Message struct {
 	Update          bool            `json:"update,omitzero"` // true if update to existing message
 	End             bool            `json:"end,omitzero"`    // true if update and message is now complete
 	Content         string          `json:"content"`
+	Parts           []ContentPart   `json:"parts,omitzero"` // multimodal user message content with images - sent instead of Content if set
 	Reasoning       string          `json:"reasoning,omitzero"`
+	Signature       string          `json:"signature,omitzero"`        // opaque reasoning signature if required by the provider
+	ReasoningBlocks json.RawMessage `json:"reasoning_blocks,omitzero"` // opaque provider reasoning blocks which are sent back unchanged
+	ReasoningSource string          `json:"reasoning_source,omitzero"` // endpoint which generated the signature and reasoning blocks
 	ToolCall        json.RawMessage `json:"tool_call,omitzero"`
 	ToolCallID      string          `json:"tool_call_id,omitzero"`
 	ContentTokens   int             `json:"content_tokens,omitzero"`
 	ReasoningTokens int             `json:"reasoning_tokens,omitzero"`
 	Excluded        bool            `json:"excluded,omitzero"` // message is ignored by NewRequest if this is set
+	Summary         string          `json:"summary,omitzero"`  // summary of the excluded messages before this one if compacted using the summarize strategy
 }
 
 type Item struct {
@@ -65,31 +83,47 @@ type Item struct {
 }
 
 type Config struct {
-	SystemPrompt      string       `json:"system_prompt"`
-	ReasoningEffort   string       `json:"reasoning_effort"` // low | medium | high | none
-	Tools             []ToolConfig `json:"tools,omitzero"`
-	Temperature       float64      `json:"temperature,omitzero"`
-	TopP              float64      `json:"top_p,omitzero"`
-	TopK              int          `json:"top_k,omitzero"`
-	PresencePenalty   float64      `json:"presence_penalty,omitzero"`
-	RepetitionPenalty float64      `json:"repetition_penalty,omitzero"`
-	CompactThreshold  float64      `json:"compact_threshold,omitzero"` // if set then apply message compaction if hit this fraction of model context length
+	SystemPrompt      string          `json:"system_prompt"`
+	ReasoningEffort   string          `json:"reasoning_effort"` // low | medium | high | none
+	Tools             []ToolConfig    `json:"tools,omitzero"`
+	Temperature       float64         `json:"temperature,omitzero"`
+	TopP              float64         `json:"top_p,omitzero"`
+	TopK              int             `json:"top_k,omitzero"`
+	PresencePenalty   float64         `json:"presence_penalty,omitzero"`
+	RepetitionPenalty float64         `json:"repetition_penalty,omitzero"`
+	CompactThreshold  float64         `json:"compact_threshold,omitzero"` // if set then apply message compaction if hit this fraction of model context length
+	CompactStrategy   string          `json:"compact_strategy,omitzero"`  // exclude | summarize | truncate-tool-output - default is exclude
+	ResponseFormat    *ResponseFormat `json:"response_format,omitzero"`   // if set then final response is JSON matching this schema
+	MaxToolRounds     int             `json:"max_tool_rounds,omitzero"`   // if set then force a final answer after this many rounds of tool calls
+	MaxTurnTokens     int             `json:"max_turn_tokens,omitzero"`   // if set then force a final answer after this many completion tokens in a turn
+	MaxTurnTime       int             `json:"max_turn_time,omitzero"`     // if set then force a final answer after this many seconds
 }
 
 type ToolConfig struct {
-	Name    string `json:"name"`
-	Enabled bool   `json:"enabled"`
+	Name     string `json:"name"`
+	Enabled  bool   `json:"enabled"`
+	Approval string `json:"approval,omitzero"`  // auto | ask | deny - default is auto
+	MaxCalls int    `json:"max_calls,omitzero"` // if set then max number of calls to the tool in a turn
 }
 
 type Stats struct {
-	Model            string         `json:"model"`             // model name
-	ApiCalls         int            `json:"api_calls"`         // total number of API calls
-	ApiTime          int            `json:"api_time"`          // total elapsed time in API calls in msec
-	CompletionTokens int            `json:"completion_tokens"` // no. of completion tokens generated
-	PromptTokens     int            `json:"prompt_tokens"`     // max prompt length
-	ToolCalls        int            `json:"tool_calls"`        // total number of tool calls
-	Functions        map[string]int `json:"functions"`         // numer of tool calls by function name
-	ToolTime         int            `json:"tool_time"`         // total elapsed time in tool calls in msec
+	Model            string         `json:"model"`                     // model name
+	Models           []string       `json:"models,omitzero"`           // model used for each API call
+	ApiCalls         int            `json:"api_calls"`                 // total number of API calls
+	ApiTime          int            `json:"api_time"`                  // total elapsed time in API calls in msec
+	CompletionTokens int            `json:"completion_tokens"`         // no. of completion tokens generated
+	PromptTokens     int            `json:"prompt_tokens"`             // max prompt length
+	ToolCalls        int            `json:"tool_calls"`                // total number of tool calls
+	Functions        map[string]int `json:"functions"`                 // numer of tool calls by function name
+	ToolTime         int            `json:"tool_time"`                 // total elapsed time in tool calls in msec
+	Retries          int            `json:"retries,omitzero"`          // number of API calls retried after an error
+	ToolErrors       int            `json:"tool_errors,omitzero"`      // number of tool calls rejected due to an unknown function or invalid arguments
+	Limits           []string       `json:"limits,omitzero"`           // budgets from the config which were reached in this turn
+	CachedTokens     int            `json:"cached_tokens,omitzero"`    // no. of prompt tokens read from the cache if reported by the server
+	ReasoningTokens  int            `json:"reasoning_tokens,omitzero"` // no. of completion tokens used for reasoning - estimated if not reported by the server
+	Cost             float64        `json:"cost,omitzero"`             // total cost in USD if known - see Prices
+	TTFT             int            `json:"ttft,omitzero"`             // time to first generated token in the first API call in msec if streaming
+	PrefillTime      int            `json:"prefill_time,omitzero"`     // total time to first token in API calls in msec if streaming
 }
 
 func newStats() Stats {
@@ -97,20 +131,34 @@ func newStats() Stats {
 }
 
 func (s *Stats) APICallInfo() string {
-	return fmt.Sprintf("%d API calls in %s  %d prompt tokens  %d completion tokens at %.1f tok/sec",
+	info := fmt.Sprintf("%d API calls in %s  %d prompt tokens  %d completion tokens at %.1f tok/sec",
 		s.ApiCalls, msec(s.ApiTime), s.PromptTokens, s.CompletionTokens, s.CompletionTokensPerSec())
+	if s.PrefillTime > 0 {
+		info += fmt.Sprintf("  TTFT %s  decode %.1f tok/sec", msec(s.TTFT), s.DecodeTokensPerSec())
+	}
+	if s.Cost > 0 {
+		info += fmt.Sprintf("  cost $%.4f", s.Cost)
+	}
+	return info
 }
 
 func (s *Stats) ToolCallInfo() string {
 	funcs := fmt.Sprint(s.Functions)
-	return fmt.Sprintf("%d tool calls in %s - %s", s.ToolCalls, msec(s.ToolTime), funcs[4:len(funcs)-1])
+	info := fmt.Sprintf("%d tool calls in %s - %s", s.ToolCalls, msec(s.ToolTime), funcs[4:len(funcs)-1])
+	if s.ToolErrors > 0 {
+		info += fmt.Sprintf(" - %d rejected", s.ToolErrors)
+	}
+	return info
 }
 
 func (s *Stats) Loginfo() {
 	log.Info(s.APICallInfo())
-	if s.ToolCalls > 0 {
+	if s.ToolCalls > 0 || s.ToolErrors > 0 {
 		log.Info(s.ToolCallInfo())
 	}
+	if len(s.Limits) > 0 {
+		log.Info("limits reached: " + strings.Join(s.Limits, ", "))
+	}
 }
 
 func (s *Stats) CompletionTokensPerSec() float64 {
@@ -120,18 +168,48 @@ func (s *Stats) CompletionTokensPerSec() float64 {
 	return 0
 }
 
-func (s *Stats) update(model string, u openai.CompletionUsage, start time.Time) {
-	s.Model = model
+// Generation speed excluding the time to first token in each API call, or zero if not streaming
+func (s *Stats) DecodeTokensPerSec() float64 {
+	if s.PrefillTime > 0 && s.ApiTime > s.PrefillTime {
+		return 1000 * float64(s.CompletionTokens) / float64(s.ApiTime-s.PrefillTime)
+	}
+	return 0
+}
+
+// update after API call - firstToken is zero if not streaming
+func (s *Stats) update(u Usage, start, firstToken time.Time) {
+	elapsed := time.Since(start)
+	var prefill time.Duration
+	s.Model = u.Model
+	s.Models = append(s.Models, u.Model)
 	s.ApiCalls++
-	s.ApiTime += int(time.Since(start).Milliseconds())
-	s.CompletionTokens += int(u.CompletionTokens)
-	s.PromptTokens = int(u.PromptTokens)
+	s.ApiTime += int(elapsed.Milliseconds())
+	if !firstToken.IsZero() {
+		prefill = firstToken.Sub(start)
+		ms := max(int(prefill.Milliseconds()), 1)
+		if s.PrefillTime == 0 {
+			s.TTFT = ms
+		}
+		s.PrefillTime += ms
+	}
+	recordAPICall(u, elapsed, prefill)
+	s.CompletionTokens += u.CompletionTokens
+	s.PromptTokens = u.PromptTokens
+	s.CachedTokens += u.CachedTokens
+	s.ReasoningTokens += u.ReasoningTokens
+	s.Cost += u.Cost
 }
 
-func (s *Stats) toolCalled(name string, start time.Time) {
+func (s *Stats) toolCalled(name string, start time.Time, err error) {
+	elapsed := time.Since(start)
 	s.ToolCalls++
 	s.Functions[name]++
-	s.ToolTime += int(time.Since(start).Milliseconds())
+	s.ToolTime += int(elapsed.Milliseconds())
+	toolCallCount.Inc(name)
+	toolDuration.Observe(elapsed.Seconds(), name)
+	if err != nil {
+		toolErrorCount.Inc(name)
+	}
 }
 
 // Get default configuration with given tools enabled
@@ -171,14 +249,38 @@ func (c Conversation) LastUserMessageNumber() int {
 	return -1
 }
 
+// Summary of excluded messages from the first message which is still included, or blank if not set
+func (c Conversation) Summary() string {
+	for _, m := range c.Messages {
+		if !m.Excluded {
+			return m.Summary
+		}
+	}
+	return ""
+}
+
+// system prompt with the summary of any excluded messages appended
+func (c Conversation) instructions() string {
+	prompt := systemPrompt(c.Config.SystemPrompt)
+	if summary := c.Summary(); summary != "" {
+		prompt = trim(prompt + "\n\n" + summaryPrompt(summary))
+	}
+	return prompt
+}
+
+func summaryPrompt(summary string) string {
+	return SummaryHeading + "\n" + summary
+}
+
 // Convert from openai chat completion message to our message format
 func ToMessage(m openai.ChatCompletionMessageParamUnion, reasoningField string) Message {
-	var msg Message
-	if role := m.GetRole(); role != nil {
-		msg.Role = *role
-	}
+	msg := Message{Role: messageRole(m)}
 	if content, ok := m.GetContent().AsAny().(*string); ok {
 		msg.Content = *content
+	} else if m.OfUser != nil && countImages(m) > 0 {
+		msg.Parts, msg.Content = fromContentParts(m.OfUser.Content.OfArrayOfContentParts)
+	} else {
+		msg.Content = messageText(m)
 	}
 	if extra := m.ExtraFields(); extra != nil {
 		if text, ok := extra[reasoningField].(string); ok {
@@ -189,16 +291,37 @@ func ToMessage(m openai.ChatCompletionMessageParamUnion, reasoningField string)
 		msg.ToolCall = marshal(m.OfAssistant.ToolCalls)
 	}
 	if m.OfTool != nil {
-		msg.Role = "tool"
 		msg.ToolCallID = m.OfTool.ToolCallID
 	}
 	return msg
 }
 
+// role from message type - GetRole returns a blank string for messages which have not been unmarshalled from JSON
+func messageRole(m openai.ChatCompletionMessageParamUnion) string {
+	switch {
+	case m.OfSystem != nil:
+		return "system"
+	case m.OfDeveloper != nil:
+		return "developer"
+	case m.OfUser != nil:
+		return "user"
+	case m.OfAssistant != nil:
+		return "assistant"
+	case m.OfTool != nil:
+		return "tool"
+	case m.OfFunction != nil:
+		return "function"
+	}
+	return ""
+}
+
 // Convert our message format to openai chat completion struct
 func FromMessage(m Message, reasoningField string) openai.ChatCompletionMessageParamUnion {
 	switch m.Role {
 	case "user":
+		if len(m.Parts) > 0 {
+			return openai.UserMessage(contentParts(m.Parts))
+		}
 		return openai.UserMessage(m.Content)
 	case "assistant":
 		msg := openai.AssistantMessage(m.Content)
@@ -218,7 +341,8 @@ func FromMessage(m Message, reasoningField string) openai.ChatCompletionMessageP
 	}
 }
 
-// Create a new chat completion request with given config settings. Messages with Excluded set are omitted from the request.
+// Create a new chat completion request with given config settings. Messages with Excluded set are omitted from the request
+// and replaced by their summary in the system prompt if the conversation was compacted with the summarize strategy.
 // Includes reasoning content starting from the beginning of the latest turn.
 func (c *Client) NewRequest(modelName string, conv Conversation, tools ...ToolFunction) openai.ChatCompletionNewParams {
 	var req openai.ChatCompletionNewParams
@@ -239,21 +363,21 @@ func (c *Client) NewRequest(modelName string, conv Conversation, tools ...ToolFu
 	if cfg.RepetitionPenalty != 0 {
 		extra["repetition_penalty"] = cfg.RepetitionPenalty
 	}
-	if cfg.SystemPrompt != "" {
-		req.Messages = append(req.Messages, parseSystemPrompt(cfg.SystemPrompt))
+	if prompt := conv.instructions(); prompt != "" {
+		req.Messages = append(req.Messages, openai.SystemMessage(prompt))
 	}
 	req.SetExtraFields(extra)
 	if ParallelToolCalls {
 		req.ParallelToolCalls = openai.Bool(true)
 	}
-	var enabledTools []ToolFunction
-	for _, tool := range tools {
-		def := tool.Definition()
-		if slices.ContainsFunc(cfg.Tools, func(t ToolConfig) bool { return t.Enabled && t.Name == def.Name }) {
-			enabledTools = append(enabledTools, tool)
-		}
+	req.Tools = ChatCompletionToolParams(cfg.EnabledTools(tools))
+	if f := cfg.ResponseFormat; f != nil {
+		req.ResponseFormat.OfJSONSchema = &shared.ResponseFormatJSONSchemaParam{JSONSchema: shared.ResponseFormatJSONSchemaJSONSchemaParam{
+			Name:   f.Name,
+			Schema: f.Schema,
+			Strict: openai.Bool(f.Strict),
+		}}
 	}
-	req.Tools = ChatCompletionToolParams(enabledTools)
 	reasoningFrom := conv.LastUserMessageNumber()
 	for i, m := range conv.Messages {
 		if !m.Excluded {
@@ -267,10 +391,74 @@ func (c *Client) NewRequest(modelName string, conv Conversation, tools ...ToolFu
 	return req
 }
 
-func parseSystemPrompt(s string) openai.ChatCompletionMessageParamUnion {
+// Load state from ToolData for each of the tools which implement StatefulTool
+func (c Conversation) LoadToolState(tools []ToolFunction) error {
+	var errs []error
+	for key, tool := range statefulTools(tools) {
+		if data, ok := c.ToolData[key]; ok {
+			if err := tool.LoadState(data); err != nil {
+				errs = append(errs, fmt.Errorf("error loading %s state: %w", key, err))
+			}
+		} else {
+			tool.ResetState()
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Save state to ToolData for each of the tools which implement StatefulTool - ToolData should not be nil.
+func (c Conversation) SaveToolState(tools []ToolFunction) error {
+	var errs []error
+	for key, tool := range statefulTools(tools) {
+		data, err := tool.SaveState()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("error saving %s state: %w", key, err))
+		} else if len(data) > 0 {
+			c.ToolData[key] = data
+		} else {
+			delete(c.ToolData, key)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// stateful tools keyed by the name used in ToolData - tools with shared state are only included once
+func statefulTools(tools []ToolFunction) iter.Seq2[string, StatefulTool] {
+	return func(yield func(string, StatefulTool) bool) {
+		seen := map[string]bool{}
+		for _, tool := range tools {
+			t, ok := tool.(StatefulTool)
+			if !ok {
+				continue
+			}
+			key := tool.Definition().Name
+			if s, ok := tool.(SharedState); ok {
+				key = s.StateKey()
+			}
+			if !seen[key] {
+				seen[key] = true
+				if !yield(key, t) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// Subset of tools which are enabled in the config
+func (cfg Config) EnabledTools(tools []ToolFunction) (enabled []ToolFunction) {
+	for _, tool := range tools {
+		def := tool.Definition()
+		if slices.ContainsFunc(cfg.Tools, func(t ToolConfig) bool { return t.Enabled && t.Name == def.Name }) {
+			enabled = append(enabled, tool)
+		}
+	}
+	return enabled
+}
+
+func systemPrompt(s string) string {
 	today := time.Now().Format("2 January 2006")
-	s = strings.ReplaceAll(s, "{{today}}", today)
-	return openai.SystemMessage(s)
+	return strings.ReplaceAll(s, "{{today}}", today)
 }
 
 func msec(n int) string {
@@ -293,3 +481,14 @@ func marshal(v any) []byte {
 	}
 	return data
 }
+
+// unmarshal tool calls saved in message
+func toolCalls(data json.RawMessage) (calls []openai.ChatCompletionMessageToolCallUnion) {
+	if len(data) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(data, &calls); err != nil {
+		panic(err)
+	}
+	return calls
+}
@@ -0,0 +1,42 @@
+package api
+
+import (
+	"time"
+
+	"github.com/jnb666/gpt-go/metrics"
+)
+
+// Metrics exported in the Prometheus text format - see the metrics package
+var (
+	apiCalls       = metrics.NewCounter("gpt_api_calls_total", "Number of completed API calls.", "provider", "model")
+	apiErrors      = metrics.NewCounter("gpt_api_errors_total", "Number of failed API calls including those which were retried.", "provider")
+	apiDuration    = metrics.NewHistogram("gpt_api_call_duration_seconds", "Elapsed time for each API call.", nil, "provider", "model")
+	apiFirstToken  = metrics.NewHistogram("gpt_api_time_to_first_token_seconds", "Time to first generated token for streamed API calls.", nil, "provider", "model")
+	tokenCount     = metrics.NewCounter("gpt_tokens_total", "Number of tokens by type - prompt, cached, completion or reasoning.", "model", "type")
+	tokensPerSec   = metrics.NewHistogram("gpt_decode_tokens_per_second", "Generation speed for each API call excluding the time to first token.", tokenRateBuckets, "model")
+	costTotal      = metrics.NewCounter("gpt_cost_usd_total", "Cost of API calls in USD if known.", "model")
+	toolCallCount  = metrics.NewCounter("gpt_tool_calls_total", "Number of tool calls which were run.", "tool")
+	toolErrorCount = metrics.NewCounter("gpt_tool_errors_total", "Number of tool calls which were rejected or returned an error.", "tool")
+	toolDuration   = metrics.NewHistogram("gpt_tool_call_duration_seconds", "Elapsed time for each tool call.", nil, "tool")
+	compactions    = metrics.NewCounter("gpt_compactions_total", "Number of times messages were compacted.", "strategy")
+
+	tokenRateBuckets = []float64{5, 10, 20, 30, 50, 75, 100, 150, 200, 300, 500}
+)
+
+func recordAPICall(u Usage, elapsed, prefill time.Duration) {
+	apiCalls.Inc(u.Provider, u.Model)
+	apiDuration.Observe(elapsed.Seconds(), u.Provider, u.Model)
+	tokenCount.Add(float64(u.PromptTokens), u.Model, "prompt")
+	tokenCount.Add(float64(u.CachedTokens), u.Model, "cached")
+	tokenCount.Add(float64(u.CompletionTokens), u.Model, "completion")
+	tokenCount.Add(float64(u.ReasoningTokens), u.Model, "reasoning")
+	if u.Cost > 0 {
+		costTotal.Add(u.Cost, u.Model)
+	}
+	if prefill > 0 {
+		apiFirstToken.Observe(prefill.Seconds(), u.Provider, u.Model)
+		if decode := elapsed - prefill; decode > 0 && u.CompletionTokens > 0 {
+			tokensPerSec.Observe(float64(u.CompletionTokens)/decode.Seconds(), u.Model)
+		}
+	}
+}
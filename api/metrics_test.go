@@ -0,0 +1,39 @@
+package api_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/jnb666/gpt-go/api"
+	"github.com/jnb666/gpt-go/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetrics(t *testing.T) {
+	tool := api.NewTool("get_forecast", "Get weather forecast.", forecast)
+	client := testClient(t,
+		jsonResponse(toolCallResponse(
+			toolCall{"call_1", "get_forecast", `{"location":"Paris"}`},
+			toolCall{"call_2", "get_forecast", `{}`},
+		)),
+		jsonResponse(contentResponse("Paris is sunny")),
+	)
+	_, err := client.ChatCompletion(t.Context(), newTestConversation(tool), discard, nil, tool)
+	require.NoError(t, err)
+
+	var b strings.Builder
+	_, err = metrics.Default.WriteTo(&b)
+	require.NoError(t, err)
+	text := b.String()
+	for _, series := range []string{
+		`gpt_api_calls_total{provider="openrouter",model="test-model"}`,
+		`gpt_api_call_duration_seconds_count{provider="openrouter",model="test-model"}`,
+		`gpt_tokens_total{model="test-model",type="completion"}`,
+		`gpt_tool_calls_total{tool="get_forecast"}`,
+		`gpt_tool_errors_total{tool="get_forecast"}`,
+		`gpt_tool_call_duration_seconds_bucket{tool="get_forecast",le="+Inf"}`,
+	} {
+		assert.Contains(t, text, "\n"+series+" ", series)
+	}
+}
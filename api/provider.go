@@ -0,0 +1,216 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/openai/openai-go/v3"
+	"github.com/openai/openai-go/v3/option"
+)
+
+// Names of built in providers
+const (
+	LlamaCPP   = "llamacpp"
+	VLLM       = "vllm"
+	OpenRouter = "openrouter"
+	Cerebras   = "cerebras"
+	Ollama     = "ollama"
+	Anthropic  = "anthropic"
+)
+
+// Returned by Provider methods which are not implemented for that backend
+var ErrNotSupported = errors.New("not supported")
+
+// Interface implemented by each backend server type. New backends are added by calling RegisterProvider.
+type Provider interface {
+	// unique name used to select the provider - e.g. from the LLM_SERVER environment variable
+	Name() string
+	// default base URL and model name - model name may be blank if the server uses the currently loaded model
+	Defaults() (baseURL, modelName string)
+	// field name used for reasoning content in assistant messages
+	ReasoningField() string
+	// update request with any backend specific settings and return extra request options
+	RequestOptions(req *openai.ChatCompletionNewParams) []option.RequestOption
+	// get max context length for current model - returns ErrNotSupported if not available
+	MaxModelLength(c *Client) (int, error)
+	// get number of prompt tokens for list of messages - returns ErrNotSupported if not available
+	Tokenize(c *Client, messages []openai.ChatCompletionMessageParamUnion) (int, error)
+}
+
+var providers = map[string]Provider{}
+
+func init() {
+	RegisterProvider(llamaCPPProvider{})
+	RegisterProvider(vLLMProvider{})
+	RegisterProvider(ollamaProvider{})
+	RegisterProvider(anthropicProvider{})
+	RegisterProvider(HostedProvider{ProviderName: OpenRouter, BaseURL: "https://openrouter.ai/api/v1", ModelName: "@preset/gpt-oss-120"})
+	RegisterProvider(HostedProvider{ProviderName: Cerebras, BaseURL: "https://api.cerebras.ai/v1", ModelName: "gpt-oss-120b"})
+}
+
+// Register provider so it can be selected by name. Replaces any existing provider with the same name.
+func RegisterProvider(p Provider) {
+	providers[strings.ToLower(p.Name())] = p
+}
+
+// Get provider with given name - case insensitive
+func GetProvider(name string) (Provider, error) {
+	if p, ok := providers[strings.ToLower(name)]; ok {
+		return p, nil
+	}
+	return nil, fmt.Errorf("provider %q not found - expecting one of %s", name, strings.Join(Providers(), ", "))
+}
+
+// Sorted list of registered provider names
+func Providers() []string {
+	return slices.Sorted(maps.Keys(providers))
+}
+
+// Hosted OpenAI compatible API endpoint without tokenizer support - token counts use the local tokenizer and
+// the context length is looked up in ModelContextLength
+type HostedProvider struct {
+	ProviderName string
+	BaseURL      string
+	ModelName    string
+}
+
+func (p HostedProvider) Name() string {
+	return p.ProviderName
+}
+
+func (p HostedProvider) Defaults() (baseURL, modelName string) {
+	return p.BaseURL, p.ModelName
+}
+
+func (p HostedProvider) ReasoningField() string {
+	return "reasoning"
+}
+
+func (p HostedProvider) RequestOptions(req *openai.ChatCompletionNewParams) []option.RequestOption {
+	if req.ReasoningEffort == "none" {
+		req.ReasoningEffort = ""
+	}
+	return nil
+}
+
+func (p HostedProvider) MaxModelLength(c *Client) (int, error) {
+	return 0, ErrNotSupported
+}
+
+func (p HostedProvider) Tokenize(c *Client, messages []openai.ChatCompletionMessageParamUnion) (int, error) {
+	return 0, ErrNotSupported
+}
+
+// Local llama.cpp server
+type llamaCPPProvider struct{}
+
+func (llamaCPPProvider) Name() string {
+	return LlamaCPP
+}
+
+func (llamaCPPProvider) Defaults() (baseURL, modelName string) {
+	return "http://localhost:8080/v1", ""
+}
+
+func (llamaCPPProvider) ReasoningField() string {
+	return "reasoning_content"
+}
+
+func (llamaCPPProvider) RequestOptions(req *openai.ChatCompletionNewParams) []option.RequestOption {
+	return append(chatTemplateOptions(req), schemaOptions(req, "json_schema")...)
+}
+
+func (llamaCPPProvider) MaxModelLength(c *Client) (int, error) {
+	return maxModelLenLllamaCPP(c.BaseURL)
+}
+
+func (llamaCPPProvider) Tokenize(c *Client, messages []openai.ChatCompletionMessageParamUnion) (int, error) {
+	return tokenizeLlamaCPP(c.BaseURL, messages)
+}
+
+// Local vLLM server
+type vLLMProvider struct{}
+
+func (vLLMProvider) Name() string {
+	return VLLM
+}
+
+func (vLLMProvider) Defaults() (baseURL, modelName string) {
+	return "http://localhost:8080/v1", ""
+}
+
+func (vLLMProvider) ReasoningField() string {
+	return "reasoning"
+}
+
+func (vLLMProvider) RequestOptions(req *openai.ChatCompletionNewParams) []option.RequestOption {
+	return append(chatTemplateOptions(req), schemaOptions(req, "guided_json")...)
+}
+
+func (vLLMProvider) MaxModelLength(c *Client) (int, error) {
+	_, maxLen, err := tokenizeVLLM(c.BaseURL, []openai.ChatCompletionMessageParamUnion{openai.UserMessage("test")})
+	return maxLen, err
+}
+
+func (vLLMProvider) Tokenize(c *Client, messages []openai.ChatCompletionMessageParamUnion) (int, error) {
+	numTokens, _, err := tokenizeVLLM(c.BaseURL, messages)
+	return numTokens, err
+}
+
+// Local Ollama server using the OpenAI compatible API
+type ollamaProvider struct{}
+
+func (ollamaProvider) Name() string {
+	return Ollama
+}
+
+func (ollamaProvider) Defaults() (baseURL, modelName string) {
+	return "http://localhost:11434/v1", "gpt-oss:20b"
+}
+
+func (ollamaProvider) ReasoningField() string {
+	return "reasoning"
+}
+
+func (ollamaProvider) RequestOptions(req *openai.ChatCompletionNewParams) []option.RequestOption {
+	if req.ReasoningEffort == "none" {
+		req.ReasoningEffort = ""
+	}
+	return nil
+}
+
+func (ollamaProvider) MaxModelLength(c *Client) (int, error) {
+	return maxModelLenOllama(c.BaseURL, c.ModelName)
+}
+
+// Ollama does not provide a tokenize API so the local tokenizer is used
+func (ollamaProvider) Tokenize(c *Client, messages []openai.ChatCompletionMessageParamUnion) (int, error) {
+	return 0, ErrNotSupported
+}
+
+// reasoning settings are passed to the chat template for local servers
+func chatTemplateOptions(req *openai.ChatCompletionNewParams) (opts []option.RequestOption) {
+	kwargs := map[string]any{}
+	if req.ReasoningEffort == "none" {
+		kwargs["enable_thinking"] = false
+		req.ReasoningEffort = ""
+	} else if req.ReasoningEffort != "" {
+		kwargs["reasoning_effort"] = req.ReasoningEffort
+	}
+	if len(kwargs) > 0 {
+		opts = append(opts, option.WithJSONSet("chat_template_kwargs", kwargs))
+	}
+	return opts
+}
+
+// JSON schema response format is passed in a server specific field for local servers
+func schemaOptions(req *openai.ChatCompletionNewParams, field string) (opts []option.RequestOption) {
+	if f := req.ResponseFormat.OfJSONSchema; f != nil {
+		opts = append(opts, option.WithJSONSet(field, f.JSONSchema.Schema))
+		req.ResponseFormat = openai.ChatCompletionNewParamsResponseFormatUnion{}
+	}
+	return opts
+}
@@ -0,0 +1,105 @@
+package api_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/jnb666/gpt-go/api"
+	"github.com/openai/openai-go/v3"
+	"github.com/openai/openai-go/v3/option"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testProvider struct {
+	api.HostedProvider
+}
+
+func (testProvider) MaxModelLength(c *api.Client) (int, error) {
+	return 4096, nil
+}
+
+func (testProvider) RequestOptions(req *openai.ChatCompletionNewParams) []option.RequestOption {
+	req.ReasoningEffort = ""
+	return []option.RequestOption{option.WithJSONSet("custom_field", "test")}
+}
+
+func TestRegisterProvider(t *testing.T) {
+	api.RegisterProvider(testProvider{api.HostedProvider{ProviderName: "Test", ModelName: "default-model"}})
+	assert.Contains(t, api.Providers(), "test")
+
+	var request map[string]any
+	record := func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		json.Unmarshal(data, &request)
+		jsonResponse(contentResponse("hello"))(w, r)
+	}
+	testServer(t, record)
+	client, err := api.NewClient("TEST", "")
+	require.NoError(t, err)
+	assert.Equal(t, "Test", client.Provider.Name())
+	assert.Equal(t, "default-model", client.ModelName)
+	assert.Equal(t, 4096, client.ContextLength)
+
+	msgs, err := client.ChatCompletion(context.Background(), newTestConversation(), discard, nil)
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+	assert.Equal(t, "hello", msgs[0].Content)
+	t.Log(api.Pretty(request))
+	assert.Equal(t, "test", request["custom_field"])
+	assert.Equal(t, "default-model", request["model"])
+	assert.NotContains(t, request, "reasoning_effort")
+	assert.NotContains(t, request, "chat_template_kwargs")
+}
+
+func TestUnknownProvider(t *testing.T) {
+	_, err := api.NewClient("nonesuch", "")
+	assert.ErrorContains(t, err, `provider "nonesuch" not found`)
+}
+
+func TestOllamaContextLength(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		show   string
+		expect int
+	}{
+		{"num_ctx", `{"parameters":"stop \"<|end|>\"\nnum_ctx 16384\ntemperature 1","model_info":{"gptoss.context_length":131072}}`, 16384},
+		{"default", `{"parameters":"temperature 1","model_info":{"gptoss.context_length":131072}}`, api.OllamaDefaultContext},
+		{"model_limit", `{"model_info":{"llama.context_length":2048}}`, 2048},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var request map[string]any
+			show := func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, "/api/show", r.URL.Path)
+				data, _ := io.ReadAll(r.Body)
+				json.Unmarshal(data, &request)
+				jsonResponse(test.show)(w, r)
+			}
+			srv := testServer(t, show)
+			t.Setenv("OPENAI_BASE_URL", srv.URL+"/v1")
+			client, err := api.NewClient(api.Ollama, "")
+			require.NoError(t, err)
+			assert.Equal(t, "gpt-oss:20b", request["model"])
+			assert.Equal(t, test.expect, client.ContextLength)
+		})
+	}
+}
+
+func TestOllamaTokenize(t *testing.T) {
+	srv := testServer(t, jsonResponse(`{"parameters":"num_ctx 8192"}`))
+	t.Setenv("OPENAI_BASE_URL", srv.URL+"/v1")
+	client, err := api.NewClient(api.Ollama, "")
+	require.NoError(t, err)
+
+	// actual count for gpt-oss is 50 - see TestTokenizeSimple
+	conv := newTestConversation()
+	conv.Config.SystemPrompt = "You are a helpful assistant."
+	req := client.NewRequest(client.ModelName, conv)
+	toks, err := client.Tokenize(req.Messages)
+	require.NoError(t, err)
+	t.Logf("estimated token count=%d", toks)
+	assert.InDelta(t, 50, toks, 15)
+}
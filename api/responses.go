@@ -0,0 +1,237 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/openai/openai-go/v3"
+	"github.com/openai/openai-go/v3/option"
+	"github.com/openai/openai-go/v3/packages/param"
+	"github.com/openai/openai-go/v3/responses"
+	"github.com/openai/openai-go/v3/shared"
+	log "github.com/sirupsen/logrus"
+)
+
+// Create a new Responses API request with given config settings. Messages with Excluded set are omitted from the request.
+// Reasoning from all previous turns is sent as reasoning items - the server decides which of these to include in the prompt.
+// As responses are not stored the encrypted reasoning content is requested so that it can be sent back with the item ID.
+func (c *Client) NewResponsesRequest(modelName string, conv Conversation, tools ...ToolFunction) responses.ResponseNewParams {
+	var req responses.ResponseNewParams
+	cfg := conv.Config
+	extra := map[string]any{}
+	req.Model = shared.ResponsesModel(modelName)
+	req.Store = openai.Bool(false)
+	req.Include = []responses.ResponseIncludable{responses.ResponseIncludableReasoningEncryptedContent}
+	if cfg.ReasoningEffort != "" && cfg.ReasoningEffort != "none" {
+		req.Reasoning = shared.ReasoningParam{Effort: shared.ReasoningEffort(cfg.ReasoningEffort)}
+	}
+	req.Temperature = openai.Float(cfg.Temperature)
+	if cfg.TopP != 0 {
+		req.TopP = openai.Float(cfg.TopP)
+	}
+	if cfg.TopK != 0 {
+		extra["top_k"] = cfg.TopK
+	}
+	if cfg.RepetitionPenalty != 0 {
+		extra["repetition_penalty"] = cfg.RepetitionPenalty
+	}
+	req.SetExtraFields(extra)
+	if prompt := conv.instructions(); prompt != "" {
+		req.Instructions = openai.String(prompt)
+	}
+	if ParallelToolCalls {
+		req.ParallelToolCalls = openai.Bool(true)
+	}
+	for _, tool := range cfg.EnabledTools(tools) {
+		def := tool.Definition()
+		req.Tools = append(req.Tools, responses.ToolUnionParam{OfFunction: &responses.FunctionToolParam{
+			Name:        def.Name,
+			Description: def.Description,
+			Parameters:  def.Parameters,
+			Strict:      openai.Bool(false),
+		}})
+	}
+	if f := cfg.ResponseFormat; f != nil {
+		req.Text.Format.OfJSONSchema = &responses.ResponseFormatTextJSONSchemaConfigParam{Name: f.Name, Schema: f.Schema, Strict: openai.Bool(f.Strict)}
+	}
+	var items responses.ResponseInputParam
+	for _, m := range conv.Messages {
+		if !m.Excluded {
+			items = append(items, toInputItems(m)...)
+		}
+	}
+	req.Input = responses.ResponseNewParamsInputUnion{OfInputItemList: items}
+	return req
+}
+
+// Convert our message format to list of Responses API input items
+func toInputItems(m Message) (items []responses.ResponseInputItemUnionParam) {
+	switch m.Role {
+	case "user":
+		if len(m.Parts) > 0 {
+			item := responses.ResponseInputItemParamOfMessage(inputContent(m.Parts), responses.EasyInputMessageRoleUser)
+			item.OfMessage.Type = responses.EasyInputMessageTypeMessage
+			items = append(items, item)
+		} else {
+			items = append(items, inputMessage(m.Content, responses.EasyInputMessageRoleUser))
+		}
+	case "assistant":
+		for _, reasoning := range reasoningItems(m) {
+			items = append(items, responses.ResponseInputItemUnionParam{OfReasoning: &reasoning})
+		}
+		if isSet(m.Content) {
+			items = append(items, inputMessage(m.Content, responses.EasyInputMessageRoleAssistant))
+		}
+		for _, call := range toolCalls(m.ToolCall) {
+			items = append(items, responses.ResponseInputItemParamOfFunctionCall(call.Function.Arguments, call.ID, call.Function.Name))
+		}
+	case "tool":
+		items = append(items, responses.ResponseInputItemParamOfFunctionCallOutput(m.ToolCallID, m.Content))
+	default:
+		panic("invalid message role: " + m.Role)
+	}
+	return items
+}
+
+// reasoning items saved from the response with their original IDs. If not available then the reasoning text is sent
+// without an item ID - e.g. if the message was generated using the chat completions API.
+func reasoningItems(m Message) (items []responses.ResponseReasoningItemParam) {
+	if len(m.ReasoningBlocks) > 0 {
+		if err := json.Unmarshal(m.ReasoningBlocks, &items); err != nil {
+			log.Warnf("invalid reasoning items: %s", err)
+			return nil
+		}
+		return items
+	}
+	if isSet(m.Reasoning) || m.Signature != "" {
+		reasoning := responses.ResponseReasoningItemParam{Summary: []responses.ResponseReasoningItemSummaryParam{}}
+		if isSet(m.Reasoning) {
+			reasoning.Content = []responses.ResponseReasoningItemContentParam{{Text: m.Reasoning}}
+		}
+		if m.Signature != "" {
+			reasoning.EncryptedContent = openai.String(m.Signature)
+		}
+		reasoning.SetExtraFields(map[string]any{"id": param.Omit})
+		items = append(items, reasoning)
+	}
+	return items
+}
+
+func inputMessage(content string, role responses.EasyInputMessageRole) responses.ResponseInputItemUnionParam {
+	item := responses.ResponseInputItemParamOfMessage(content, role)
+	item.OfMessage.Type = responses.EasyInputMessageTypeMessage
+	return item
+}
+
+// text and image input content from multimodal message content
+func inputContent(parts []ContentPart) (list responses.ResponseInputMessageContentListParam) {
+	for _, p := range parts {
+		switch p.Type {
+		case "text":
+			list = append(list, responses.ResponseInputContentParamOfInputText(p.Text))
+		case "image":
+			url, err := p.ImageURL()
+			if err != nil {
+				list = append(list, responses.ResponseInputContentParamOfInputText(missingImage(p, err)))
+				continue
+			}
+			image := responses.ResponseInputContentParamOfInputImage(responses.ResponseInputImageDetailAuto)
+			image.OfInputImage.ImageURL = openai.String(url)
+			list = append(list, image)
+		}
+	}
+	return list
+}
+
+// get next message using the Responses API
+func (c *Client) responsesComplete(ctx context.Context, conv Conversation, tools []ToolFunction, stream bool, callback CallbackFunc) (
+	resp Completion, err error) {
+
+	req := c.NewResponsesRequest(c.ModelName, conv, tools...)
+	var opts []option.RequestOption
+	if TraceRequests {
+		opts = append(opts, option.WithMiddleware(debugLogger))
+	}
+	if !stream {
+		r, err := c.Responses.New(ctx, req, opts...)
+		if err != nil {
+			return resp, err
+		}
+		return responseCompletion(r)
+	}
+	s := c.Responses.NewStreaming(ctx, req, opts...)
+	resp.Streamer = NewStreamer(callback)
+	for s.Next() {
+		ev := s.Current()
+		if TraceStream {
+			pprint("event", ev.RawJSON())
+		}
+		switch ev.Type {
+		case "response.reasoning_text.delta", "response.reasoning_summary_text.delta":
+			resp.Reasoning += ev.Delta
+			resp.Streamer.Reasoning(ev.Delta)
+		case "response.output_text.delta", "response.refusal.delta":
+			resp.Content += ev.Delta
+			resp.Streamer.Content(ev.Delta)
+		case "response.function_call_arguments.delta":
+			resp.Streamer.ToolCallDelta()
+		case "response.output_item.done":
+			if ev.Item.Type == "function_call" {
+				resp.Streamer.EndToolCall()
+			}
+		case "response.completed", "response.incomplete", "response.failed":
+			streamer := resp.Streamer
+			resp, err = responseCompletion(&ev.Response)
+			resp.Streamer = streamer
+			return resp, err
+		case "error":
+			return resp, fmt.Errorf("error %s: %s", ev.Code, ev.Message)
+		}
+	}
+	if err = s.Err(); err != nil {
+		return resp, err
+	}
+	return resp, errors.New("response stream ended without completed event")
+}
+
+// convert output items to completion
+func responseCompletion(r *responses.Response) (resp Completion, err error) {
+	if r.Status == responses.ResponseStatusFailed {
+		return resp, fmt.Errorf("error %s: %s", r.Error.Code, r.Error.Message)
+	}
+	resp.Model = string(r.Model)
+	var reasoning []responses.ResponseReasoningItemParam
+	for _, item := range r.Output {
+		switch item.Type {
+		case "reasoning":
+			reasoning = append(reasoning, item.AsReasoning().ToParam())
+			for _, part := range item.Content {
+				resp.Reasoning += part.Text
+			}
+			if len(item.Content) == 0 {
+				for _, part := range item.Summary {
+					resp.Reasoning += part.Text
+				}
+			}
+		case "message":
+			for _, part := range item.Content {
+				resp.Content += part.Text + part.Refusal
+			}
+		case "function_call":
+			resp.ToolCalls = append(resp.ToolCalls, toolCallUnion(item.CallID, item.Name, item.Arguments))
+		}
+	}
+	if len(reasoning) > 0 {
+		resp.Blocks = marshal(reasoning)
+	}
+	resp.Usage = openai.CompletionUsage{
+		PromptTokens:            r.Usage.InputTokens,
+		CompletionTokens:        r.Usage.OutputTokens,
+		TotalTokens:             r.Usage.TotalTokens,
+		PromptTokensDetails:     openai.CompletionUsagePromptTokensDetails{CachedTokens: r.Usage.InputTokensDetails.CachedTokens},
+		CompletionTokensDetails: openai.CompletionUsageCompletionTokensDetails{ReasoningTokens: r.Usage.OutputTokensDetails.ReasoningTokens},
+	}
+	return resp, nil
+}
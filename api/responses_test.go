@@ -0,0 +1,123 @@
+package api_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/jnb666/gpt-go/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResponsesToolCall(t *testing.T) {
+	var requests []map[string]any
+	record := func(body string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "/responses", r.URL.Path)
+			var req map[string]any
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+			requests = append(requests, req)
+			jsonResponse(body)(w, r)
+		}
+	}
+	client := testClient(t,
+		record(`{"id":"resp_1","object":"response","model":"test-model","status":"completed","output":[
+			{"type":"reasoning","id":"rs_1","summary":[],"content":[{"type":"reasoning_text","text":"need to sleep"}],"encrypted_content":"enc1"},
+			{"type":"function_call","id":"fc_1","call_id":"call_1","name":"sleep","arguments":"{\"id\":\"a\"}","status":"completed"}],
+			"usage":{"input_tokens":10,"output_tokens":7,"total_tokens":17}}`),
+		record(`{"id":"resp_2","object":"response","model":"test-model","status":"completed","output":[
+			{"type":"message","id":"msg_1","role":"assistant","status":"completed","content":[{"type":"output_text","text":"All done","annotations":[]}]}],
+			"usage":{"input_tokens":30,"output_tokens":4,"total_tokens":34}}`),
+	)
+	client.ResponsesAPI = true
+	tool := &sleepTool{name: "sleep"}
+	conv := newTestConversation(tool)
+
+	var analysis []string
+	callback := func(channel, content string, index int, end bool) {
+		if channel == "analysis" {
+			analysis = append(analysis, content)
+		}
+	}
+	var stats api.Stats
+	msgs, err := client.ChatCompletion(t.Context(), conv, callback, func(s api.Stats) { stats = s }, tool)
+	require.NoError(t, err)
+	t.Log(api.Pretty(msgs))
+
+	require.Len(t, msgs, 3)
+	assert.Equal(t, "need to sleep", msgs[0].Reasoning)
+	assert.Contains(t, string(msgs[0].ToolCall), `"id":"call_1"`)
+	assert.Equal(t, api.Message{Role: "tool", Content: `{"id":"a"}`, ToolCallID: "call_1"}, msgs[1])
+	assert.Equal(t, "All done", msgs[2].Content)
+	assert.Equal(t, []string{"need to sleep"}, analysis)
+	assert.Equal(t, 30, stats.PromptTokens)
+	assert.Equal(t, 11, stats.CompletionTokens)
+
+	require.Len(t, requests, 2)
+	first := requests[0]
+	assert.Contains(t, first["instructions"], "helpful")
+	assert.Equal(t, map[string]any{"effort": "medium"}, first["reasoning"])
+	assert.Equal(t, "sleep", first["tools"].([]any)[0].(map[string]any)["name"])
+	assert.Equal(t, []any{"reasoning.encrypted_content"}, first["include"])
+	// reasoning from previous turns is replayed as reasoning items
+	input := requests[1]["input"].([]any)
+	types := []string{}
+	for _, item := range input {
+		types = append(types, fmt.Sprint(item.(map[string]any)["type"]))
+	}
+	assert.Equal(t, []string{"message", "reasoning", "message", "message", "reasoning", "function_call", "function_call_output"}, types)
+	// reasoning text from earlier messages has no item ID, the item from this turn is sent back unchanged
+	assert.NotContains(t, input[1], "id")
+	assert.Equal(t, "rs_1", input[4].(map[string]any)["id"])
+	assert.Equal(t, "enc1", input[4].(map[string]any)["encrypted_content"])
+	assert.Equal(t, map[string]any{"type": "function_call", "call_id": "call_1", "name": "sleep", "arguments": `{"id":"a"}`}, input[5])
+	assert.Equal(t, map[string]any{"type": "function_call_output", "call_id": "call_1", "output": `{"id":"a"}`}, input[6])
+}
+
+func TestResponsesStream(t *testing.T) {
+	completed := `{"id":"resp_1","object":"response","model":"test-model","status":"completed","output":[` +
+		`{"type":"reasoning","id":"rs_1","summary":[],"content":[{"type":"reasoning_text","text":"Let me count"}]},` +
+		`{"type":"message","id":"msg_1","role":"assistant","status":"completed","content":[{"type":"output_text","text":"There are 3","annotations":[]}]}],` +
+		`"usage":{"input_tokens":12,"output_tokens":9,"total_tokens":21}}`
+	client := testClient(t, sseResponse(
+		`{"type":"response.created","sequence_number":0,"response":{"id":"resp_1","status":"in_progress","output":[]}}`,
+		`{"type":"response.reasoning_text.delta","sequence_number":1,"item_id":"rs_1","output_index":0,"content_index":0,"delta":"Let me "}`,
+		`{"type":"response.reasoning_text.delta","sequence_number":2,"item_id":"rs_1","output_index":0,"content_index":0,"delta":"count"}`,
+		`{"type":"response.output_text.delta","sequence_number":3,"item_id":"msg_1","output_index":1,"content_index":0,"delta":"There are "}`,
+		`{"type":"response.output_text.delta","sequence_number":4,"item_id":"msg_1","output_index":1,"content_index":0,"delta":"3"}`,
+		`{"type":"response.completed","sequence_number":5,"response":`+completed+`}`,
+	))
+	client.ResponsesAPI = true
+	conv := newTestConversation()
+
+	var output []string
+	callback := func(channel, content string, index int, end bool) {
+		output = append(output, fmt.Sprintf("%s:%d:%q", channel, index, content))
+	}
+	var stats api.Stats
+	msgs, err := client.ChatCompletionStream(t.Context(), conv, callback, func(s api.Stats) { stats = s })
+	require.NoError(t, err)
+	t.Log(strings.Join(output, "\n"))
+
+	require.Len(t, msgs, 1)
+	assert.Equal(t, "There are 3", msgs[0].Content)
+	assert.Equal(t, "Let me count", msgs[0].Reasoning)
+	assert.Contains(t, string(msgs[0].ReasoningBlocks), `"id":"rs_1"`)
+	assert.Equal(t, []string{
+		`analysis:0:"Let me "`, `analysis:1:"count"`, `analysis:2:"\n"`,
+		`final:0:"There are "`, `final:1:"3"`, `final:2:"\n"`, `final:3:"There are 3\n"`,
+	}, output)
+	assert.Equal(t, 12, stats.PromptTokens)
+	assert.Equal(t, 9, stats.CompletionTokens)
+}
+
+func TestResponsesFailed(t *testing.T) {
+	client := testClient(t, jsonResponse(`{"id":"resp_1","object":"response","model":"test-model","status":"failed",
+		"error":{"code":"server_error","message":"model crashed"},"output":[]}`))
+	client.ResponsesAPI = true
+	_, err := client.ChatCompletion(t.Context(), newTestConversation(), discard, nil)
+	assert.EqualError(t, err, "error server_error: model crashed")
+}
@@ -0,0 +1,159 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/openai/openai-go/v3"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// Max number of times to retry an API call which fails with a rate limit or server error - 0 to disable
+	MaxRetries = 5
+	// Initial backoff delay which is doubled after each retry
+	RetryBaseDelay = time.Second
+	// Max delay between retries - if the server requests a longer wait then the error is returned without retrying
+	RetryMaxDelay = time.Minute
+)
+
+// Error response from the server with HTTP status code
+type StatusError struct {
+	StatusCode int
+	Message    string
+	Header     http.Header // response headers if available
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("error %d: %s", e.StatusCode, e.Message)
+}
+
+// call API with retries if error is retryable - i.e. a rate limit or server error
+func (c *Client) completeWithRetry(ctx context.Context, conv Conversation, tools []ToolFunction, stream bool, callback CallbackFunc, stats *Stats) (
+	resp Completion, err error) {
+
+	for attempt := 0; ; attempt++ {
+		spanCtx, span := c.startRequestSpan(ctx, tools, stream)
+		resp, err = c.complete(spanCtx, conv, tools, stream, callback)
+		endRequestSpan(span, resp, err)
+		if err != nil && ctx.Err() == nil {
+			apiErrors.Inc(c.Provider.Name())
+		}
+		if err == nil || ctx.Err() != nil || attempt >= MaxRetries {
+			return resp, err
+		}
+		if streamStarted(resp, stream) {
+			return resp, err
+		}
+		status, header, ok := errorStatus(err)
+		if !ok || !retryable(status) {
+			return resp, err
+		}
+		delay := backoff(attempt)
+		if wait, ok := retryAfter(header, time.Now()); ok {
+			if wait > RetryMaxDelay {
+				log.Warnf("%v - not retrying as server requested wait of %s", err, wait.Round(time.Second))
+				return resp, err
+			}
+			delay = wait
+		}
+		log.Warnf("%v - retry %d/%d in %s", err, attempt+1, MaxRetries, delay.Round(time.Millisecond))
+		stats.Retries++
+		select {
+		case <-ctx.Done():
+			return resp, ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// can't retry a stream once content has been sent to the callback
+func streamStarted(resp Completion, stream bool) bool {
+	return stream && (resp.Streamer.Index > 0 || resp.Streamer.Channel == "final")
+}
+
+func errorStatus(err error) (status int, header http.Header, ok bool) {
+	var apiErr *openai.Error
+	if errors.As(err, &apiErr) {
+		if apiErr.Response != nil {
+			header = apiErr.Response.Header
+		}
+		return apiErr.StatusCode, header, true
+	}
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode, statusErr.Header, true
+	}
+	return 0, nil, false
+}
+
+// request timeout, rate limit and server errors may succeed if retried - 529 is returned by Anthropic if overloaded
+func retryable(status int) bool {
+	return status == http.StatusRequestTimeout || status == http.StatusTooManyRequests || status >= 500
+}
+
+// exponential backoff with jitter
+func backoff(attempt int) time.Duration {
+	delay := min(RetryBaseDelay<<attempt, RetryMaxDelay)
+	return delay/2 + rand.N(delay/2+1)
+}
+
+// get delay requested by server from Retry-After or x-ratelimit-reset headers
+func retryAfter(header http.Header, now time.Time) (time.Duration, bool) {
+	if header == nil {
+		return 0, false
+	}
+	if ms, err := strconv.ParseFloat(header.Get("Retry-After-Ms"), 64); err == nil {
+		return time.Duration(ms * float64(time.Millisecond)), true
+	}
+	if val := header.Get("Retry-After"); val != "" {
+		if secs, err := strconv.ParseFloat(val, 64); err == nil {
+			return time.Duration(secs * float64(time.Second)), true
+		}
+		if t, err := http.ParseTime(val); err == nil {
+			return max(t.Sub(now), 0), true
+		}
+	}
+	// wait for the longest reset time of any exhausted limit e.g. x-ratelimit-reset-tokens-minute if x-ratelimit-remaining-tokens-minute is 0
+	var wait time.Duration
+	found := false
+	for key := range header {
+		suffix, ok := strings.CutPrefix(strings.ToLower(key), "x-ratelimit-reset")
+		if !ok {
+			continue
+		}
+		if remaining := header.Get("x-ratelimit-remaining" + suffix); remaining != "" && remaining != "0" {
+			continue
+		}
+		if d, ok := parseReset(header.Get(key), now); ok {
+			wait = max(wait, d)
+			found = true
+		}
+	}
+	return wait, found
+}
+
+// reset value may be a duration such as 1m30s, a number of seconds, or a unix timestamp in seconds or milliseconds
+func parseReset(val string, now time.Time) (time.Duration, bool) {
+	if d, err := time.ParseDuration(val); err == nil {
+		return d, true
+	}
+	n, err := strconv.ParseFloat(val, 64)
+	if err != nil {
+		return 0, false
+	}
+	switch {
+	case n > 1e12:
+		return max(time.UnixMilli(int64(n)).Sub(now), 0), true
+	case n > 1e9:
+		return max(time.Unix(int64(n), 0).Sub(now), 0), true
+	default:
+		return time.Duration(n * float64(time.Second)), true
+	}
+}
@@ -0,0 +1,116 @@
+package api_test
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/jnb666/gpt-go/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetryRateLimit(t *testing.T) {
+	fastRetry(t, 3)
+	client := testClient(t,
+		errorResponse(http.StatusTooManyRequests, "Retry-After-Ms", "10"),
+		errorResponse(http.StatusServiceUnavailable, "x-ratelimit-reset-requests", "20ms"),
+		jsonResponse(`{"error":{"code":502,"message":"upstream error"}}`),
+		jsonResponse(contentResponse("There are 3")),
+	)
+	var stats api.Stats
+	start := time.Now()
+	msgs, err := client.ChatCompletion(t.Context(), newTestConversation(), discard, func(s api.Stats) { stats = s })
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+	assert.Equal(t, "There are 3", msgs[0].Content)
+	assert.Equal(t, 3, stats.Retries)
+	assert.Equal(t, 1, stats.ApiCalls)
+	assert.GreaterOrEqual(t, time.Since(start), 30*time.Millisecond)
+}
+
+func TestRetryStream(t *testing.T) {
+	fastRetry(t, 3)
+	client := testClient(t,
+		errorResponse(http.StatusInternalServerError),
+		sseResponse(`{"model":"test-model","choices":[{"index":0,"delta":{"content":"Hello"},"finish_reason":"stop"}]}`, `[DONE]`),
+	)
+	var stats api.Stats
+	msgs, err := client.ChatCompletionStream(t.Context(), newTestConversation(), discard, func(s api.Stats) { stats = s })
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+	assert.Equal(t, "Hello", msgs[0].Content)
+	assert.Equal(t, 1, stats.Retries)
+}
+
+func TestRetryAfterToolCall(t *testing.T) {
+	fastRetry(t, 3)
+	tool := &sleepTool{name: "sleep"}
+	client := testClient(t,
+		jsonResponse(toolCallResponse(toolCall{"call_1", "sleep", `{"id":"a"}`})),
+		errorResponse(http.StatusBadGateway),
+		errorResponse(http.StatusTooManyRequests),
+		jsonResponse(contentResponse("done")),
+	)
+	msgs, err := client.ChatCompletion(t.Context(), newTestConversation(tool), discard, nil, tool)
+	require.NoError(t, err)
+	require.Len(t, msgs, 3)
+	assert.Equal(t, "done", msgs[2].Content)
+	// tool call is not repeated
+	assert.Equal(t, []string{`{"id":"a"}`}, tool.order)
+}
+
+func TestRetryGiveUp(t *testing.T) {
+	fastRetry(t, 1)
+	client := testClient(t,
+		errorResponse(http.StatusServiceUnavailable),
+		errorResponse(http.StatusServiceUnavailable),
+		jsonResponse(contentResponse("not reached")),
+	)
+	_, err := client.ChatCompletion(t.Context(), newTestConversation(), discard, nil)
+	assert.ErrorContains(t, err, "503")
+}
+
+func TestNoRetryLongWait(t *testing.T) {
+	fastRetry(t, 3)
+	client := testClient(t,
+		errorResponse(http.StatusTooManyRequests, "x-ratelimit-remaining-requests-day", "0", "x-ratelimit-reset-requests-day", "7200"),
+		jsonResponse(contentResponse("not reached")),
+	)
+	var stats api.Stats
+	start := time.Now()
+	_, err := client.ChatCompletion(t.Context(), newTestConversation(), discard, func(s api.Stats) { stats = s })
+	assert.ErrorContains(t, err, "429")
+	assert.Equal(t, 0, stats.Retries)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestNoRetryBadRequest(t *testing.T) {
+	fastRetry(t, 3)
+	client := testClient(t,
+		errorResponse(http.StatusBadRequest),
+		jsonResponse(contentResponse("not reached")),
+	)
+	_, err := client.ChatCompletion(t.Context(), newTestConversation(), discard, nil)
+	assert.ErrorContains(t, err, "400")
+}
+
+func fastRetry(t *testing.T, maxRetries int) {
+	prevRetries, prevDelay := api.MaxRetries, api.RetryBaseDelay
+	api.MaxRetries, api.RetryBaseDelay = maxRetries, time.Millisecond
+	t.Cleanup(func() {
+		api.MaxRetries, api.RetryBaseDelay = prevRetries, prevDelay
+	})
+}
+
+// error response with optional header key, value pairs
+func errorResponse(status int, headers ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i+1 < len(headers); i += 2 {
+			w.Header().Set(headers[i], headers[i+1])
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write([]byte(`{"error":{"message":"` + http.StatusText(status) + `"}}`))
+	}
+}
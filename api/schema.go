@@ -0,0 +1,362 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// JSON schema used to constrain the final response - see Config.ResponseFormat
+type ResponseFormat struct {
+	Name   string         `json:"name"`            // a-z, A-Z, 0-9, underscores and dashes
+	Schema map[string]any `json:"schema"`          // JSON schema for the response
+	Strict bool           `json:"strict,omitzero"` // strict schema adherence if supported by the server
+}
+
+// Response format with the JSON schema derived from type T - see Schema
+func NewResponseFormat[T any](name string) *ResponseFormat {
+	return &ResponseFormat{Name: name, Schema: Schema[T]()}
+}
+
+// instructions added to the prompt for providers which do not support a response format
+func (f *ResponseFormat) prompt() string {
+	return "Respond only with a JSON object which matches the following JSON schema:\n" + string(marshal(f.Schema))
+}
+
+// Decode final response content generated using a ResponseFormat into a value of type T. The content is first
+// validated against the schema for T so that the error lists any missing or invalid fields. A markdown code fence
+// around the JSON is ignored.
+func DecodeJSON[T any](content string) (v T, err error) {
+	content = stripCodeFence(content)
+	var raw any
+	if err = json.Unmarshal([]byte(content), &raw); err != nil {
+		return v, fmt.Errorf("invalid JSON in response: %w", err)
+	}
+	if err = ValidateJSON(Schema[T](), raw); err != nil {
+		return v, fmt.Errorf("response does not match schema: %w", err)
+	}
+	err = json.Unmarshal([]byte(content), &v)
+	return v, err
+}
+
+func stripCodeFence(s string) string {
+	s = trim(s)
+	if !strings.HasPrefix(s, "```") {
+		return s
+	}
+	_, s, _ = strings.Cut(s, "\n")
+	return trim(strings.TrimSuffix(trim(s), "```"))
+}
+
+// Generate JSON schema for Go type T using reflection. Struct fields are named using the json tag and may have
+// description, enum (comma separated list), default and required tags, and a type tag with a comma separated list of
+// JSON types to override the type of the field - e.g. for an any field. Fields are required unless they are pointers,
+// have a default or have the omitempty or omitzero json option - this can be overridden with required:"true|false".
+// Recursive types are not supported.
+func Schema[T any]() map[string]any {
+	return typeSchema(reflect.TypeFor[T]())
+}
+
+func typeSchema(t reflect.Type) map[string]any {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t {
+	case reflect.TypeFor[time.Time]():
+		return map[string]any{"type": "string", "format": "date-time"}
+	case reflect.TypeFor[json.RawMessage]():
+		return map[string]any{}
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string"}
+		}
+		return map[string]any{"type": "array", "items": typeSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": typeSchema(t.Elem())}
+	case reflect.Struct:
+		return structSchema(t)
+	}
+	return map[string]any{}
+}
+
+func structSchema(t reflect.Type) map[string]any {
+	properties := map[string]any{}
+	var required []string
+	for _, f := range reflect.VisibleFields(t) {
+		name, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if !f.IsExported() || name == "-" || (f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct) {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		s := typeSchema(f.Type)
+		if typ := f.Tag.Get("type"); typ != "" {
+			if types := strings.Split(typ, ","); len(types) > 1 {
+				s["type"] = types
+			} else {
+				s["type"] = typ
+			}
+		}
+		if desc := f.Tag.Get("description"); desc != "" {
+			s["description"] = desc
+		}
+		if enum := f.Tag.Get("enum"); enum != "" {
+			var values []any
+			for _, val := range strings.Split(enum, ",") {
+				values = append(values, tagValue(f.Type, trim(val)))
+			}
+			s["enum"] = values
+		}
+		def, hasDefault := f.Tag.Lookup("default")
+		if hasDefault {
+			s["default"] = tagValue(f.Type, def)
+		}
+		optional := hasDefault || f.Type.Kind() == reflect.Pointer || slices.ContainsFunc(strings.Split(opts, ","), func(opt string) bool {
+			return opt == "omitempty" || opt == "omitzero"
+		})
+		if req, ok := f.Tag.Lookup("required"); ok {
+			optional = req != "true"
+		}
+		if !optional {
+			required = append(required, name)
+		}
+		properties[name] = s
+	}
+	schema := map[string]any{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+// value from struct tag - strings are used as is, other types are parsed as JSON
+func tagValue(t reflect.Type, s string) any {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t.Kind() == reflect.String {
+		return s
+	}
+	var v any
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		return s
+	}
+	return v
+}
+
+// Validate value decoded from JSON against the given schema. Supports the type, enum, properties, required,
+// additionalProperties, items, minimum, maximum and anyOf keywords. The error lists each of the failures.
+func ValidateJSON(schema map[string]any, value any) error {
+	var errs []string
+	validate(normalizeSchema(schema), value, "", &errs)
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// convert schema to generic JSON types - e.g. []string enums or nested shared.FunctionParameters
+func normalizeSchema(schema map[string]any) (s map[string]any) {
+	if err := json.Unmarshal(marshal(schema), &s); err != nil {
+		panic(err)
+	}
+	return s
+}
+
+func validate(schema map[string]any, v any, path string, errs *[]string) {
+	if anyOf, ok := schema["anyOf"].([]any); ok {
+		if !slices.ContainsFunc(anyOf, func(s any) bool {
+			var e []string
+			sub, _ := s.(map[string]any)
+			validate(sub, v, path, &e)
+			return len(e) == 0
+		}) {
+			*errs = append(*errs, fmt.Sprintf("%s does not match any of the allowed types", fieldName(path)))
+			return
+		}
+	}
+	if types := schemaTypes(schema); len(types) > 0 && !slices.ContainsFunc(types, func(t string) bool { return hasType(v, t) }) {
+		*errs = append(*errs, fmt.Sprintf("%s should be %s but got %s", fieldName(path), strings.Join(types, " or "), jsonType(v)))
+		return
+	}
+	if enum, ok := schema["enum"].([]any); ok && !slices.ContainsFunc(enum, func(e any) bool { return reflect.DeepEqual(e, v) }) {
+		*errs = append(*errs, fmt.Sprintf("%s should be one of %s but got %s", fieldName(path), marshal(enum), marshal(v)))
+	}
+	switch val := v.(type) {
+	case float64:
+		if lo, ok := schema["minimum"].(float64); ok && val < lo {
+			*errs = append(*errs, fmt.Sprintf("%s should be at least %v", fieldName(path), lo))
+		}
+		if hi, ok := schema["maximum"].(float64); ok && val > hi {
+			*errs = append(*errs, fmt.Sprintf("%s should be at most %v", fieldName(path), hi))
+		}
+	case []any:
+		if items, ok := schema["items"].(map[string]any); ok {
+			for i, item := range val {
+				validate(items, item, fmt.Sprintf("%s[%d]", path, i), errs)
+			}
+		}
+	case map[string]any:
+		properties, _ := schema["properties"].(map[string]any)
+		required, _ := schema["required"].([]any)
+		for _, name := range required {
+			if _, ok := val[name.(string)]; !ok {
+				*errs = append(*errs, fmt.Sprintf("%s is required", fieldName(joinPath(path, name.(string)))))
+			}
+		}
+		for _, name := range slices.Sorted(maps.Keys(val)) {
+			if prop, ok := properties[name].(map[string]any); ok {
+				validate(prop, val[name], joinPath(path, name), errs)
+			} else if additional, ok := schema["additionalProperties"].(map[string]any); ok {
+				validate(additional, val[name], joinPath(path, name), errs)
+			} else if schema["additionalProperties"] == false {
+				*errs = append(*errs, fmt.Sprintf("%s is not an allowed property", fieldName(joinPath(path, name))))
+			}
+		}
+	}
+}
+
+// convert value to the type given by the schema where this can be done without losing information - e.g. "3" to 3
+// for a number or 3 to "3" for a string. Maps and slices are updated in place. Returns true if anything was changed.
+func coerce(schema map[string]any, v any) (any, bool) {
+	if types := schemaTypes(schema); len(types) > 0 && !slices.ContainsFunc(types, func(t string) bool { return hasType(v, t) }) {
+		for _, typ := range types {
+			if val, ok := coerceType(v, typ); ok {
+				v, _ = coerce(schema, val)
+				return v, true
+			}
+		}
+	}
+	changed := false
+	switch val := v.(type) {
+	case []any:
+		if items, ok := schema["items"].(map[string]any); ok {
+			for i, item := range val {
+				if x, ok := coerce(items, item); ok {
+					val[i], changed = x, true
+				}
+			}
+		}
+	case map[string]any:
+		properties, _ := schema["properties"].(map[string]any)
+		for name, item := range val {
+			if prop, ok := properties[name].(map[string]any); ok {
+				if x, ok := coerce(prop, item); ok {
+					val[name], changed = x, true
+				}
+			}
+		}
+	}
+	return v, changed
+}
+
+func coerceType(v any, typ string) (any, bool) {
+	switch val := v.(type) {
+	case string:
+		s := trim(val)
+		switch typ {
+		case "number":
+			if n, err := strconv.ParseFloat(s, 64); err == nil {
+				return n, true
+			}
+		case "integer":
+			if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+				return float64(n), true
+			}
+		case "boolean":
+			if s == "true" || s == "false" {
+				return s == "true", true
+			}
+		case "array", "object":
+			// JSON encoded as a string
+			var x any
+			if err := json.Unmarshal([]byte(s), &x); err == nil && jsonType(x) == typ {
+				return x, true
+			}
+		}
+	case float64:
+		if typ == "string" {
+			return strconv.FormatFloat(val, 'f', -1, 64), true
+		}
+	case bool:
+		if typ == "string" {
+			return strconv.FormatBool(val), true
+		}
+	}
+	return nil, false
+}
+
+func schemaTypes(schema map[string]any) []string {
+	switch t := schema["type"].(type) {
+	case string:
+		return []string{t}
+	case []any:
+		var types []string
+		for _, s := range t {
+			if str, ok := s.(string); ok {
+				types = append(types, str)
+			}
+		}
+		return types
+	}
+	return nil
+}
+
+func hasType(v any, typ string) bool {
+	if typ == "integer" {
+		n, ok := v.(float64)
+		return ok && n == math.Trunc(n)
+	}
+	return jsonType(v) == typ
+}
+
+func jsonType(v any) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+func fieldName(path string) string {
+	if path == "" {
+		return "value"
+	}
+	return fmt.Sprintf("%q", path)
+}
+
+func joinPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
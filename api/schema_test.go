@@ -0,0 +1,106 @@
+package api_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/jnb666/gpt-go/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testWeather struct {
+	Location    string   `json:"location" description:"City name"`
+	Units       string   `json:"units" enum:"metric,imperial" default:"metric"`
+	Temperature float64  `json:"temperature"`
+	Days        int      `json:"days,omitempty" description:"Number of days"`
+	Tags        []string `json:"tags,omitzero"`
+	Detail      *struct {
+		Wind bool `json:"wind"`
+	} `json:"detail"`
+	Ignored string `json:"-"`
+}
+
+func TestSchema(t *testing.T) {
+	schema := api.Schema[testWeather]()
+	t.Log(api.Pretty(schema))
+	assert.JSONEq(t, `{
+		"type": "object",
+		"properties": {
+			"location": {"type": "string", "description": "City name"},
+			"units": {"type": "string", "enum": ["metric", "imperial"], "default": "metric"},
+			"temperature": {"type": "number"},
+			"days": {"type": "integer", "description": "Number of days"},
+			"tags": {"type": "array", "items": {"type": "string"}},
+			"detail": {"type": "object", "properties": {"wind": {"type": "boolean"}}, "required": ["wind"]}
+		},
+		"required": ["location", "temperature"]
+	}`, toJSON(schema))
+}
+
+func TestValidateJSON(t *testing.T) {
+	schema := api.Schema[testWeather]()
+	var value any
+	require.NoError(t, json.Unmarshal([]byte(`{"location":"London","units":"kelvin","days":1.5,"tags":["a",2],"detail":{}}`), &value))
+	err := api.ValidateJSON(schema, value)
+	assert.EqualError(t, err, `"temperature" is required; "days" should be integer but got number; "detail.wind" is required; `+
+		`"tags[1]" should be string but got number; "units" should be one of ["metric","imperial"] but got "kelvin"`)
+
+	require.NoError(t, json.Unmarshal([]byte(`{"location":"London","temperature":12.5}`), &value))
+	assert.NoError(t, api.ValidateJSON(schema, value))
+	assert.EqualError(t, api.ValidateJSON(schema, "London"), "value should be object but got string")
+}
+
+func TestDecodeJSON(t *testing.T) {
+	w, err := api.DecodeJSON[testWeather]("```json\n{\"location\":\"London\",\"temperature\":12.5}\n```")
+	require.NoError(t, err)
+	assert.Equal(t, testWeather{Location: "London", Temperature: 12.5}, w)
+
+	_, err = api.DecodeJSON[testWeather](`{"location":"London"}`)
+	assert.EqualError(t, err, `response does not match schema: "temperature" is required`)
+
+	_, err = api.DecodeJSON[testWeather](`It is sunny`)
+	assert.ErrorContains(t, err, "invalid JSON in response")
+}
+
+func TestResponseFormat(t *testing.T) {
+	var request map[string]any
+	client := testClient(t, func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&request))
+		jsonResponse(contentResponse(`{"location":"Paris","temperature":20}`))(w, r)
+	})
+	conv := newTestConversation()
+	conv.Config.ResponseFormat = api.NewResponseFormat[testWeather]("weather")
+
+	msgs, err := client.ChatCompletion(t.Context(), conv, discard, nil)
+	require.NoError(t, err)
+	w, err := api.DecodeJSON[testWeather](msgs[0].Content)
+	require.NoError(t, err)
+	assert.Equal(t, "Paris", w.Location)
+
+	format := request["response_format"].(map[string]any)
+	assert.Equal(t, "json_schema", format["type"])
+	assert.Equal(t, "weather", format["json_schema"].(map[string]any)["name"])
+	assert.JSONEq(t, toJSON(api.Schema[testWeather]()), toJSON(format["json_schema"].(map[string]any)["schema"]))
+}
+
+func TestResponseFormatLlamaCPP(t *testing.T) {
+	var request map[string]any
+	testServer(t,
+		jsonResponse(`{"default_generation_settings":{"n_ctx":4096}}`),
+		func(w http.ResponseWriter, r *http.Request) {
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&request))
+			jsonResponse(contentResponse(`{"location":"Paris","temperature":20}`))(w, r)
+		},
+	)
+	client, err := api.NewClient(api.LlamaCPP, "")
+	require.NoError(t, err)
+	conv := newTestConversation()
+	conv.Config.ResponseFormat = api.NewResponseFormat[testWeather]("weather")
+
+	_, err = client.ChatCompletion(t.Context(), conv, discard, nil)
+	require.NoError(t, err)
+	assert.NotContains(t, request, "response_format")
+	assert.JSONEq(t, toJSON(api.Schema[testWeather]()), toJSON(request["json_schema"]))
+}
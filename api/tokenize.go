@@ -1,85 +1,33 @@
 package api
 
 import (
-	"fmt"
+	"errors"
+	"strconv"
 	"strings"
 
 	"github.com/jnb666/gpt-go/api/tools"
 	"github.com/openai/openai-go/v3"
-	log "github.com/sirupsen/logrus"
 )
 
-// Estimate number of prompt tokens generated from the given list of messages.
-// If this exceeds the given limit then the oldest messages in the conversation are marked as excluded.
-func (c *Client) CompactMessages(conv Conversation, limit int) error {
-	if c.Server != LlamaCPP && c.Server != VLLM || c.ContextLength == 0 {
-		log.Warnf("CompactMessages: skipping as not supported for %s server", c.Server)
-		return nil
-	}
-	// calc additional tokens in latest user message
-	n := len(conv.Messages)
-	if n == 0 {
-		log.Warn("empty conversation passed to CompactMessages - skipping")
-		return nil
-	}
-	newTokens, err := Tokenize(c.Server, c.BaseURL, []openai.ChatCompletionMessageParamUnion{FromMessage(conv.Messages[n-1], "")})
-	if err != nil {
-		return err
-	}
-	tokens := conv.NumTokens + newTokens
-	end := conv.LastUserMessageNumber()
-	for {
-		if tokens <= limit {
-			log.Infof("number of prompt tokens = %d / %d", tokens, limit)
-			return nil
-		}
-		log.Warnf("number of prompt tokens %d exceeds threshold of %d - excluding old messages", tokens, limit)
-		for i := 0; i < end; i++ {
-			msg := conv.Messages[i]
-			if !msg.Excluded && msg.Role == "user" {
-				excluded, err := excludeTurnAt(i, end, conv.Messages)
-				if err != nil {
-					return err
-				}
-				excudedTokens, err := Tokenize(c.Server, c.BaseURL, excluded)
-				if err != nil {
-					return err
-				}
-				tokens -= excudedTokens
-				break
-			}
-		}
-	}
+// Context length for models on hosted providers which do not report it, keyed by lowercase model name
+var ModelContextLength = map[string]int{
+	"gpt-oss-120b":        131072,
+	"gpt-oss-20b":         131072,
+	"openai/gpt-oss-120b": 131072,
+	"openai/gpt-oss-20b":  131072,
+	"@preset/gpt-oss-120": 131072,
 }
 
-func excludeTurnAt(start, end int, msgs []Message) (excluded []openai.ChatCompletionMessageParamUnion, err error) {
-	msgs[start].Excluded = true
-	excluded = append(excluded, FromMessage(msgs[start], ""))
-	for i := start + 1; i < end; i++ {
-		if msgs[i].Role == "user" {
-			// llama.cpp gives "Assistant response prefill is incompatible with enable_thinking." error if last message is assistant so add a dummy record
-			excluded = append(excluded, openai.UserMessage(""))
-			log.Infof("excluded %d messages from turn starting at message %d", i-start, start)
-			//log.Debug(Pretty(excluded))
-			return excluded, nil
+// Get max content length for current model. If not implemented by the provider then uses the ModelContextLength
+// setting for the model, or returns ErrNotSupported if not set.
+func (c *Client) MaxModelLength() (int, error) {
+	n, err := c.Provider.MaxModelLength(c)
+	if errors.Is(err, ErrNotSupported) {
+		if n, ok := ModelContextLength[strings.ToLower(c.ModelName)]; ok {
+			return n, nil
 		}
-		msgs[i].Excluded = true
-		excluded = append(excluded, FromMessage(msgs[i], ""))
-	}
-	return nil, fmt.Errorf("ExcludeOldMessages: exceeded limit but no more messages to exclude")
-}
-
-// Get max content length for current model
-func MaxModelLength(server Server, baseURL string) (maxLen int, err error) {
-	switch server {
-	case LlamaCPP:
-		return maxModelLenLllamaCPP(baseURL)
-	case VLLM:
-		_, maxLen, err = tokenizeVLLM(baseURL, []openai.ChatCompletionMessageParamUnion{openai.UserMessage("test")})
-		return
-	default:
-		return 0, fmt.Errorf("MaxModelLength not implemented for %s", server)
 	}
+	return n, err
 }
 
 func maxModelLenLllamaCPP(baseURL string) (int, error) {
@@ -99,17 +47,56 @@ func maxModelLenLllamaCPP(baseURL string) (int, error) {
 	return resp.DefaultGenerationSettings.ContextSize, nil
 }
 
-// Convert text to tokens for current model
-func Tokenize(server Server, baseURL string, messages []openai.ChatCompletionMessageParamUnion) (numTokens int, err error) {
-	switch server {
-	case LlamaCPP:
-		return tokenizeLlamaCPP(baseURL, messages)
-	case VLLM:
-		numTokens, _, err = tokenizeVLLM(baseURL, messages)
-		return
-	default:
-		return 0, fmt.Errorf("Tokenize not implemented for %s", server)
+// Context length used by Ollama if num_ctx is not set in the model parameters
+var OllamaDefaultContext = 4096
+
+func maxModelLenOllama(baseURL, modelName string) (int, error) {
+	type Request struct {
+		Model string `json:"model"`
+	}
+	type Response struct {
+		Parameters string         `json:"parameters"`
+		ModelInfo  map[string]any `json:"model_info"`
 	}
+	url := strings.TrimSuffix(baseURL, "/v1") + "/api/show"
+	var resp Response
+	_, err := tools.Post(url, Request{Model: modelName}, &resp)
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range strings.Split(resp.Parameters, "\n") {
+		if key, val, ok := strings.Cut(strings.TrimSpace(line), " "); ok && key == "num_ctx" {
+			return strconv.Atoi(strings.TrimSpace(val))
+		}
+	}
+	// num_ctx is not set so will use the server default limited to the model training context
+	maxLen := OllamaDefaultContext
+	for key, val := range resp.ModelInfo {
+		if n, ok := val.(float64); ok && strings.HasSuffix(key, ".context_length") {
+			maxLen = min(maxLen, int(n))
+		}
+	}
+	return maxLen, nil
+}
+
+// Get number of prompt tokens for list of messages. If not implemented by the provider then counts tokens using
+// the local tokenizer, or an estimate if the tokenizer vocab file is not available.
+func (c *Client) Tokenize(messages []openai.ChatCompletionMessageParamUnion) (numTokens int, err error) {
+	numTokens, err = c.Provider.Tokenize(c, messages)
+	if errors.Is(err, ErrNotSupported) {
+		return countTokens(messages, nil), nil
+	}
+	return numTokens, err
+}
+
+// Get number of prompt tokens for chat completion request. As per Tokenize, but if the provider does not have a
+// tokenize API then the tool definitions are also included in the local count.
+func (c *Client) TokenizeRequest(req openai.ChatCompletionNewParams) (numTokens int, err error) {
+	numTokens, err = c.Provider.Tokenize(c, req.Messages)
+	if errors.Is(err, ErrNotSupported) {
+		return countTokens(req.Messages, req.Tools), nil
+	}
+	return numTokens, err
 }
 
 func tokenizeLlamaCPP(baseURL string, messages []openai.ChatCompletionMessageParamUnion) (numTokens int, err error) {
@@ -144,6 +131,25 @@ func tokenizeLlamaCPP(baseURL string, messages []openai.ChatCompletionMessagePar
 	return len(resp2.Tokens), nil
 }
 
+// approximate token count for servers without a tokenize API, assuming 4 bytes per token plus per message overhead
+// and ImageTokens for each image
+func estimateTokens(messages []openai.ChatCompletionMessageParamUnion, tools []openai.ChatCompletionToolUnionParam) int {
+	const bytesPerToken, messageTokens = 4, 8
+	numTokens := 0
+	for _, tool := range tools {
+		numTokens += messageTokens + len(marshal(tool))/bytesPerToken
+	}
+	for _, m := range messages {
+		numTokens += messageTokens
+		numTokens += len(messageText(m))/bytesPerToken + countImages(m)*ImageTokens
+		numTokens += len(messageReasoning(m)) / bytesPerToken
+		if m.OfAssistant != nil && len(m.OfAssistant.ToolCalls) > 0 {
+			numTokens += len(marshal(m.OfAssistant.ToolCalls)) / bytesPerToken
+		}
+	}
+	return numTokens
+}
+
 func tokenizeVLLM(baseURL string, messages []openai.ChatCompletionMessageParamUnion) (numTokens, maxModelLen int, err error) {
 	type Request struct {
 		Messages []openai.ChatCompletionMessageParamUnion `json:"messages"`
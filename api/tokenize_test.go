@@ -43,7 +43,7 @@ func tokenize(t *testing.T, msgs []api.Message, tools []api.ToolFunction, expect
 	require.NoError(t, err)
 	req := client.NewRequest(client.ModelName, conv, tools...)
 
-	toks, err := api.Tokenize(server, client.BaseURL, req.Messages)
+	toks, err := client.Tokenize(req.Messages)
 	require.NoError(t, err)
 	t.Logf("token count=%d max_model_len=%d", toks, client.ContextLength)
 	assert.Equal(t, expected, toks, "number of tokens")
@@ -66,7 +66,7 @@ func TestExcludeMessages(t *testing.T) {
 	checkNumMessages(t, conv.Messages, 31, 0)
 
 	log.SetLevel(log.DebugLevel)
-	err = client.CompactMessages(conv, 12800)
+	err = client.CompactMessages(t.Context(), conv, 12800)
 	require.NoError(t, err)
 
 	checkNumMessages(t, conv.Messages, 31, 16)
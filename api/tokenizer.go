@@ -0,0 +1,271 @@
+package api
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/openai/openai-go/v3"
+	log "github.com/sirupsen/logrus"
+)
+
+// Vocab file in tiktoken format used for local token counting - o200k_base is used by gpt-oss models.
+// Defaults to $TIKTOKEN_FILE if set, else o200k_base.tiktoken in the user cache directory - see scripts/get_tokenizer.sh.
+var TokenizerFile = defaultTokenizerFile()
+
+// o200k pre-tokenizer pattern - the \s+(?!\S) lookahead alternative is not supported by regexp so is handled in Split
+var o200kPattern = strings.Join([]string{
+	`[^\r\n\p{L}\p{N}]?[\p{Lu}\p{Lt}\p{Lm}\p{Lo}\p{M}]*[\p{Ll}\p{Lm}\p{Lo}\p{M}]+(?i:'s|'t|'re|'ve|'m|'ll|'d)?`,
+	`[^\r\n\p{L}\p{N}]?[\p{Lu}\p{Lt}\p{Lm}\p{Lo}\p{M}]+[\p{Ll}\p{Lm}\p{Lo}\p{M}]*(?i:'s|'t|'re|'ve|'m|'ll|'d)?`,
+	`\p{N}{1,3}`,
+	` ?[^\s\p{L}\p{N}]+[\r\n/]*`,
+	`\s*[\r\n]+`,
+	`\s+`,
+}, "|")
+
+// Byte pair encoding tokenizer
+type Tokenizer struct {
+	ranks   map[string]int
+	pattern *regexp.Regexp
+}
+
+// Load tokenizer from vocab file in tiktoken format
+func LoadTokenizer(path string) (*Tokenizer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return NewTokenizer(f)
+}
+
+// Read vocab with a base64 encoded token and rank on each line
+func NewTokenizer(r io.Reader) (*Tokenizer, error) {
+	t := &Tokenizer{ranks: map[string]int{}, pattern: regexp.MustCompile(`^(?:` + o200kPattern + `)`)}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		token, rank, ok := strings.Cut(scanner.Text(), " ")
+		if !ok {
+			continue
+		}
+		data, err := base64.StdEncoding.DecodeString(token)
+		if err != nil {
+			return nil, fmt.Errorf("tokenizer vocab line %d: %w", line, err)
+		}
+		t.ranks[string(data)], err = strconv.Atoi(rank)
+		if err != nil {
+			return nil, fmt.Errorf("tokenizer vocab line %d: %w", line, err)
+		}
+	}
+	return t, scanner.Err()
+}
+
+// Split text into pieces using the pre-tokenizer pattern
+func (t *Tokenizer) Split(text string) (pieces []string) {
+	for len(text) > 0 {
+		end := len(text)
+		if loc := t.pattern.FindStringIndex(text); loc != nil && loc[1] > 0 {
+			end = loc[1]
+		}
+		piece := text[:end]
+		// emulate \s+(?!\S) - trailing whitespace before a non-space char is left to prefix the next piece
+		if end < len(text) && utf8.RuneCountInString(piece) > 1 && strings.TrimSpace(piece) == "" && !strings.ContainsAny(piece, "\r\n") {
+			_, size := utf8.DecodeLastRuneInString(piece)
+			piece = piece[:end-size]
+		}
+		pieces = append(pieces, piece)
+		text = text[len(piece):]
+	}
+	return pieces
+}
+
+// Encode text to list of token ids
+func (t *Tokenizer) Encode(text string) (tokens []int) {
+	for _, piece := range t.Split(text) {
+		tokens = append(tokens, t.merge(piece)...)
+	}
+	return tokens
+}
+
+// Number of tokens in text
+func (t *Tokenizer) Count(text string) int {
+	n := 0
+	for _, piece := range t.Split(text) {
+		n += len(t.merge(piece))
+	}
+	return n
+}
+
+// merge pairs of adjacent parts with the lowest rank until no more merges are possible. Candidate pairs are kept
+// in a priority queue so that long pieces such as base64 data or runs of whitespace are merged in O(n log n) time.
+func (t *Tokenizer) merge(piece string) []int {
+	if rank, ok := t.ranks[piece]; ok {
+		return []int{rank}
+	}
+	// parts are a linked list indexed by start offset - version is incremented when a part is changed or removed
+	n := len(piece)
+	next := make([]int, n)
+	prev := make([]int, n)
+	version := make([]int, n)
+	for i := range n {
+		next[i], prev[i] = i+1, i-1
+	}
+	var queue pairQueue
+	push := func(left int) {
+		if left < 0 || next[left] >= n {
+			return
+		}
+		right := next[left]
+		end := n
+		if right < n {
+			end = next[right]
+		}
+		if rank, ok := t.ranks[piece[left:end]]; ok {
+			heap.Push(&queue, bytePair{rank: rank, left: left, right: right, leftVersion: version[left], rightVersion: version[right]})
+		}
+	}
+	for i := range n - 1 {
+		push(i)
+	}
+	for queue.Len() > 0 {
+		p := heap.Pop(&queue).(bytePair)
+		if version[p.left] != p.leftVersion || version[p.right] != p.rightVersion {
+			continue
+		}
+		next[p.left] = next[p.right]
+		if next[p.right] < n {
+			prev[next[p.right]] = p.left
+		}
+		version[p.left]++
+		version[p.right]++
+		push(p.left)
+		push(prev[p.left])
+	}
+	var tokens []int
+	for i := 0; i < n; i = next[i] {
+		rank, ok := t.ranks[piece[i:next[i]]]
+		if !ok {
+			// byte not in vocab - should not happen with a complete vocab file
+			rank = -1
+		}
+		tokens = append(tokens, rank)
+	}
+	return tokens
+}
+
+// candidate merge of adjacent parts starting at the left and right offsets
+type bytePair struct {
+	rank, left, right         int
+	leftVersion, rightVersion int
+}
+
+// priority queue ordered by rank then position - the same order as merging the lowest ranked pair first
+type pairQueue []bytePair
+
+func (q pairQueue) Len() int { return len(q) }
+
+func (q pairQueue) Less(i, j int) bool {
+	return q[i].rank < q[j].rank || (q[i].rank == q[j].rank && q[i].left < q[j].left)
+}
+
+func (q pairQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *pairQueue) Push(x any) { *q = append(*q, x.(bytePair)) }
+
+func (q *pairQueue) Pop() any {
+	old := *q
+	x := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return x
+}
+
+var (
+	tokenizerMu     sync.Mutex
+	tokenizer       *Tokenizer
+	tokenizerLoaded bool
+)
+
+// Get tokenizer loaded from TokenizerFile - returns nil if the file is not available
+func DefaultTokenizer() *Tokenizer {
+	tokenizerMu.Lock()
+	defer tokenizerMu.Unlock()
+	if !tokenizerLoaded {
+		tokenizerLoaded = true
+		var err error
+		if tokenizer, err = LoadTokenizer(TokenizerFile); err != nil {
+			log.Warnf("local tokenizer not available - using estimated token counts: %v", err)
+		}
+	}
+	return tokenizer
+}
+
+// Replace the default tokenizer - if nil then estimated token counts are used
+func SetDefaultTokenizer(t *Tokenizer) {
+	tokenizerMu.Lock()
+	defer tokenizerMu.Unlock()
+	tokenizer, tokenizerLoaded = t, true
+}
+
+// count prompt tokens using the local tokenizer, allowing for the harmony chat template overhead of
+// <|start|>role<|channel|>channel<|message|>...<|end|> for each message. Reasoning sent in the assistant message extra
+// fields and the tool definitions which are rendered in the developer message are included.
+// Falls back to estimateTokens if no tokenizer.
+func countTokens(messages []openai.ChatCompletionMessageParamUnion, tools []openai.ChatCompletionToolUnionParam) int {
+	const messageTokens, toolCallTokens, toolTokens, replyTokens = 4, 8, 8, 2
+	t := DefaultTokenizer()
+	if t == nil {
+		return estimateTokens(messages, tools)
+	}
+	numTokens := replyTokens
+	for _, tool := range tools {
+		numTokens += toolTokens + t.Count(string(marshal(tool)))
+	}
+	for _, m := range messages {
+		numTokens += messageTokens + t.Count(messageRole(m))
+		numTokens += t.Count(messageText(m)) + countImages(m)*ImageTokens
+		if m.OfAssistant != nil {
+			if reasoning := messageReasoning(m); reasoning != "" {
+				numTokens += messageTokens + t.Count(reasoning)
+			}
+			for _, call := range m.OfAssistant.ToolCalls {
+				if fn := call.OfFunction; fn != nil {
+					numTokens += toolCallTokens + t.Count(fn.Function.Name) + t.Count(fn.Function.Arguments)
+				}
+			}
+		}
+	}
+	return numTokens
+}
+
+// reasoning content set by FromMessage in the assistant message extra fields
+func messageReasoning(m openai.ChatCompletionMessageParamUnion) (reasoning string) {
+	if m.OfAssistant == nil {
+		return ""
+	}
+	for _, val := range m.OfAssistant.ExtraFields() {
+		if text, ok := val.(string); ok {
+			reasoning += text
+		}
+	}
+	return reasoning
+}
+
+func defaultTokenizerFile() string {
+	if file := os.Getenv("TIKTOKEN_FILE"); file != "" {
+		return file
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "gpt-go", "o200k_base.tiktoken")
+}
@@ -0,0 +1,91 @@
+package api_test
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jnb666/gpt-go/api"
+	"github.com/openai/openai-go/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenizerSplit(t *testing.T) {
+	tok := testTokenizer(t)
+	pieces := tok.Split("Hello world  \n\n  foo's 12345 ok?!\n")
+	assert.Equal(t, []string{"Hello", " world", "  \n\n", " ", " foo's", " ", "123", "45", " ok", "?!\n"}, pieces)
+}
+
+func TestTokenizerEncode(t *testing.T) {
+	tok := testTokenizer(t)
+	// single bytes have rank 0-255, merges are ranked in order
+	assert.Equal(t, []int{259, 260}, tok.Encode("hello world"))
+	assert.Equal(t, []int{259, 32, 'x'}, tok.Encode("hello x"))
+	assert.Equal(t, 4, tok.Count("hello world!!!"))
+}
+
+func TestLocalTokenize(t *testing.T) {
+	api.SetDefaultTokenizer(testTokenizer(t))
+	t.Cleanup(func() { api.SetDefaultTokenizer(nil) })
+	api.ModelContextLength["test-model"] = 4096
+	t.Cleanup(func() { delete(api.ModelContextLength, "test-model") })
+
+	client := testClient(t)
+	assert.Equal(t, 4096, client.ContextLength)
+	numTokens, err := client.Tokenize([]openai.ChatCompletionMessageParamUnion{openai.UserMessage("hello world")})
+	require.NoError(t, err)
+	// 2 content tokens + 1 token per byte for role + 4 for message start and end + 2 for reply prefix
+	assert.Equal(t, 2+4+4+2, numTokens)
+}
+
+func TestTokenizerLongPiece(t *testing.T) {
+	tok := testTokenizer(t)
+	// unbroken piece is merged without quadratic slowdown
+	text := strings.Repeat("hellohe", 100000)
+	start := time.Now()
+	assert.Equal(t, 200000, tok.Count(text))
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestLocalTokenizeRequest(t *testing.T) {
+	api.SetDefaultTokenizer(testTokenizer(t))
+	t.Cleanup(func() { api.SetDefaultTokenizer(nil) })
+
+	tool := &sleepTool{name: "sleep"}
+	client := testClient(t)
+	conv := newTestConversation(tool)
+	conv.Config.SystemPrompt = ""
+	conv.Messages = []api.Message{
+		{Role: "user", Content: "hello"},
+		{Role: "assistant", Content: "hello", Reasoning: "hello world"},
+	}
+	withTools, err := client.TokenizeRequest(client.NewRequest(client.ModelName, conv, tool))
+	require.NoError(t, err)
+	conv.Config.Tools = nil
+	noTools, err := client.TokenizeRequest(client.NewRequest(client.ModelName, conv, tool))
+	require.NoError(t, err)
+	conv.Messages[1].Reasoning = ""
+	noReasoning, err := client.TokenizeRequest(client.NewRequest(client.ModelName, conv, tool))
+	require.NoError(t, err)
+
+	assert.Greater(t, withTools-noTools, 20, "tool definition tokens")
+	// 2 reasoning tokens + 4 for message start and end
+	assert.Equal(t, 2+4, noTools-noReasoning, "reasoning tokens")
+}
+
+// tokenizer with all single bytes plus a few merges
+func testTokenizer(t *testing.T) *api.Tokenizer {
+	var b strings.Builder
+	for i := range 256 {
+		fmt.Fprintf(&b, "%s %d\n", base64.StdEncoding.EncodeToString([]byte{byte(i)}), i)
+	}
+	for i, token := range []string{"he", "ll", "hell", "hello", " world", "!!"} {
+		fmt.Fprintf(&b, "%s %d\n", base64.StdEncoding.EncodeToString([]byte(token)), 256+i)
+	}
+	tok, err := api.NewTokenizer(strings.NewReader(b.String()))
+	require.NoError(t, err)
+	return tok
+}
@@ -0,0 +1,241 @@
+package api
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/openai/openai-go/v3"
+	"github.com/openai/openai-go/v3/shared"
+	log "github.com/sirupsen/logrus"
+)
+
+// Tool which calls a function with the JSON arguments decoded into a struct of type Args - implements ToolFunction
+// and ContextTool. The parameter schema is generated from the fields of Args as per Schema.
+type Tool[Args any] struct {
+	Name        string
+	Description string
+	Func        func(Args) (string, error)
+	ContextFunc func(context.Context, Args) (string, error) // called instead of Func if set
+	schema      map[string]any
+}
+
+// Create new tool with the given name and description which calls fn with the decoded arguments.
+// Args should be a struct type.
+func NewTool[Args any](name, description string, fn func(Args) (string, error)) *Tool[Args] {
+	return &Tool[Args]{Name: name, Description: description, Func: fn, schema: Schema[Args]()}
+}
+
+// As per NewTool but fn is passed the context from the tool call - e.g. to carry the trace context.
+func NewContextTool[Args any](name, description string, fn func(context.Context, Args) (string, error)) *Tool[Args] {
+	return &Tool[Args]{Name: name, Description: description, ContextFunc: fn, schema: Schema[Args]()}
+}
+
+func (t *Tool[Args]) Definition() shared.FunctionDefinitionParam {
+	return shared.FunctionDefinitionParam{
+		Name:        t.Name,
+		Description: openai.String(t.Description),
+		Parameters:  shared.FunctionParameters(t.schema),
+	}
+}
+
+// Decode arguments and call the function. If the arguments cannot be decoded then an error message is returned
+// to the model so that it can retry.
+func (t *Tool[Args]) Call(arg string) (req, resp string, err error) {
+	return t.call(context.Background(), arg)
+}
+
+// Implements the ContextTool interface. If ContextFunc is not set then Func is run in the background as per WithContext.
+func (t *Tool[Args]) CallContext(ctx context.Context, call ToolCall) (ToolResult, error) {
+	if t.ContextFunc == nil {
+		return contextAdapter{t}.CallContext(ctx, call)
+	}
+	req, resp, err := t.call(ctx, call.Arguments)
+	return ToolResult{Request: req, Response: resp}, err
+}
+
+func (t *Tool[Args]) call(ctx context.Context, arg string) (req, resp string, err error) {
+	log.Infof("%s(%s)", t.Name, arg)
+	args, err := DecodeArgs[Args](arg)
+	if err != nil {
+		return t.Name + arg, invalidArgs(t.Name, err), nil
+	}
+	req = fmt.Sprintf("%s%+v", t.Name, args)
+	if t.ContextFunc != nil {
+		resp, err = t.ContextFunc(ctx, args)
+	} else {
+		resp, err = t.Func(args)
+	}
+	return req, resp, err
+}
+
+// Decode JSON tool call arguments into a value of type Args. Fields which are not set in the JSON are set from
+// the default tag if present.
+func DecodeArgs[Args any](arg string) (args Args, err error) {
+	if properties, ok := Schema[Args]()["properties"].(map[string]any); ok {
+		defaults := map[string]any{}
+		for name, prop := range properties {
+			if def, ok := prop.(map[string]any)["default"]; ok {
+				defaults[name] = def
+			}
+		}
+		if len(defaults) > 0 {
+			if err = json.Unmarshal(marshal(defaults), &args); err != nil {
+				return args, err
+			}
+		}
+	}
+	if trim(arg) == "" {
+		return args, nil
+	}
+	err = json.Unmarshal([]byte(arg), &args)
+	return args, err
+}
+
+// Check JSON tool call arguments against the parameters schema from the tool definition. Values are converted to the
+// type given in the schema where this is safe - e.g. "3" to 3 for a number parameter. Returns the arguments to pass
+// to the tool, which are unchanged unless a value was converted, or an error listing each of the problems.
+func ValidateArgs(params shared.FunctionParameters, arg string) (string, error) {
+	var value any = map[string]any{}
+	if trim(arg) != "" {
+		if err := json.Unmarshal([]byte(arg), &value); err != nil {
+			return arg, fmt.Errorf("malformed JSON: %w", err)
+		}
+	}
+	if params == nil {
+		return arg, nil
+	}
+	schema := normalizeSchema(params)
+	value, changed := coerce(schema, value)
+	if err := ValidateJSON(schema, value); err != nil {
+		return arg, err
+	}
+	if changed {
+		arg = string(marshal(value))
+	}
+	return arg, nil
+}
+
+// error message returned to the model if the tool arguments are not valid
+func invalidArgs(name string, err error) string {
+	return fmt.Sprintf("Error: invalid arguments for %s: %v - correct the arguments and call the function again", name, err)
+}
+
+// Details of a tool call passed to ContextTool.CallContext
+type ToolCall struct {
+	ID             string // tool call ID generated by the model
+	Name           string // function name
+	Arguments      string // arguments in JSON format - these have been validated against the tool parameters schema
+	ConversationID string // ID of the conversation the call is from - may be empty
+	Store          *Store // scratch store shared by all tool calls in the conversation
+	// send partial output to the tool channel of the callback while the tool is running - may be nil
+	Output func(text string)
+}
+
+// Result from ContextTool.CallContext
+type ToolResult struct {
+	Request  string // description of the call for display
+	Response string // response returned to the model
+}
+
+// Wrap tool so that it implements the ContextTool interface. If the tool already implements it then it is returned
+// unchanged, else Call is run in the background so that the tool can be interrupted if it also implements Interrupter.
+func WithContext(tool ToolFunction) ContextTool {
+	if t, ok := tool.(ContextTool); ok {
+		return t
+	}
+	return contextAdapter{tool}
+}
+
+type contextAdapter struct {
+	ToolFunction
+}
+
+// Always waits for the call to return so that the tool does not update its state after the turn has completed.
+func (t contextAdapter) CallContext(ctx context.Context, call ToolCall) (ToolResult, error) {
+	type result struct {
+		ToolResult
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		var r result
+		r.Request, r.Response, r.err = t.Call(call.Arguments)
+		ch <- r
+	}()
+	select {
+	case r := <-ch:
+		return r.ToolResult, r.err
+	case <-ctx.Done():
+		if it, ok := t.ToolFunction.(Interrupter); ok {
+			it.Interrupt()
+		}
+		r := <-ch
+		return ToolResult{Request: cmp.Or(r.Request, call.Arguments)}, ctx.Err()
+	}
+}
+
+// Per-conversation scratch store for tools to save values between calls. Values are held in memory only.
+type Store struct {
+	mu     sync.Mutex
+	values map[string]any
+}
+
+// Get value with given key
+func (s *Store) Get(key string) (value any, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	value, ok = s.values[key]
+	return value, ok
+}
+
+// Set value with given key
+func (s *Store) Set(key string, value any) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.values == nil {
+		s.values = map[string]any{}
+	}
+	s.values[key] = value
+}
+
+// Delete value with given key
+func (s *Store) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.values, key)
+}
+
+var stores = struct {
+	sync.Mutex
+	m map[string]*Store
+}{m: map[string]*Store{}}
+
+// Get scratch store for the conversation with given ID - it is created if it does not exist
+func ConversationStore(id string) *Store {
+	stores.Lock()
+	defer stores.Unlock()
+	s, ok := stores.m[id]
+	if !ok {
+		s = &Store{}
+		stores.m[id] = s
+	}
+	return s
+}
+
+// Delete scratch store for the conversation with given ID - e.g. when the conversation is deleted
+func DeleteConversationStore(id string) {
+	stores.Lock()
+	defer stores.Unlock()
+	delete(stores.m, id)
+}
+
+// conversations without an ID get a new store for each set of tool calls
+func conversationStore(id string) *Store {
+	if id == "" {
+		return &Store{}
+	}
+	return ConversationStore(id)
+}
@@ -0,0 +1,246 @@
+package api_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/jnb666/gpt-go/api"
+	"github.com/openai/openai-go/v3/shared"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type forecastArgs struct {
+	Location string `json:"location" description:"City name"`
+	Units    string `json:"units" enum:"metric,imperial" default:"metric"`
+	Days     int    `json:"days" default:"3"`
+}
+
+func forecast(args forecastArgs) (string, error) {
+	return fmt.Sprintf("%d day forecast for %s in %s units", args.Days, args.Location, args.Units), nil
+}
+
+func TestNewTool(t *testing.T) {
+	tool := api.NewTool("get_forecast", "Get weather forecast.", forecast)
+	def := tool.Definition()
+	assert.Equal(t, "get_forecast", def.Name)
+	assert.Equal(t, "Get weather forecast.", def.Description.Value)
+	assert.JSONEq(t, `{
+		"type": "object",
+		"properties": {
+			"location": {"type": "string", "description": "City name"},
+			"units": {"type": "string", "enum": ["metric", "imperial"], "default": "metric"},
+			"days": {"type": "integer", "default": 3}
+		},
+		"required": ["location"]
+	}`, toJSON(def.Parameters))
+
+	req, resp, err := tool.Call(`{"location":"Paris","days":5}`)
+	require.NoError(t, err)
+	assert.Equal(t, "get_forecast{Location:Paris Units:metric Days:5}", req)
+	assert.Equal(t, "5 day forecast for Paris in metric units", resp)
+
+	// decode error is returned to the model
+	_, resp, err = tool.Call(`{"location":`)
+	require.NoError(t, err)
+	assert.Contains(t, resp, "Error: invalid arguments for get_forecast")
+}
+
+func TestNewToolCall(t *testing.T) {
+	tool := api.NewTool("get_forecast", "Get weather forecast.", forecast)
+	client := testClient(t,
+		jsonResponse(toolCallResponse(toolCall{"call_1", "get_forecast", `{"location":"Paris"}`})),
+		jsonResponse(contentResponse("It will be sunny")),
+	)
+	msgs, err := client.ChatCompletion(t.Context(), newTestConversation(tool), discard, nil, tool)
+	require.NoError(t, err)
+	require.Len(t, msgs, 3)
+	assert.Equal(t, "3 day forecast for Paris in metric units", msgs[1].Content)
+}
+
+func TestValidateArgs(t *testing.T) {
+	params := api.NewTool("get_forecast", "", forecast).Definition().Parameters
+	args, err := api.ValidateArgs(params, `{"location":"Paris","days":"5"}`)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"location":"Paris","days":5}`, args)
+
+	args, err = api.ValidateArgs(params, `{"location":"Paris"}`)
+	require.NoError(t, err)
+	assert.Equal(t, `{"location":"Paris"}`, args)
+
+	_, err = api.ValidateArgs(params, `{"days":"five","units":"kelvin"}`)
+	assert.EqualError(t, err, `"location" is required; "days" should be integer but got string; `+
+		`"units" should be one of ["metric","imperial"] but got "kelvin"`)
+
+	_, err = api.ValidateArgs(params, `{"location":`)
+	assert.ErrorContains(t, err, "malformed JSON")
+}
+
+func TestToolCallInvalidArgs(t *testing.T) {
+	tool := api.NewTool("get_forecast", "Get weather forecast.", forecast)
+	client := testClient(t,
+		jsonResponse(toolCallResponse(
+			toolCall{"call_1", "get_forecast", `{"location":"Paris","days":"2"}`},
+			toolCall{"call_2", "get_forecast", `{"days":2}`},
+			toolCall{"call_3", "get_weather", `{}`},
+		)),
+		jsonResponse(contentResponse("It will be sunny")),
+	)
+	var stats api.Stats
+	msgs, err := client.ChatCompletion(t.Context(), newTestConversation(tool), discard, func(s api.Stats) { stats = s }, tool)
+	require.NoError(t, err)
+	require.Len(t, msgs, 5)
+	assert.Equal(t, "2 day forecast for Paris in metric units", msgs[1].Content)
+	assert.Equal(t, `Error: invalid arguments for get_forecast: "location" is required - correct the arguments and call the function again`, msgs[2].Content)
+	assert.Equal(t, `Error: function "get_weather" is not defined`, msgs[3].Content)
+	assert.Equal(t, 1, stats.ToolCalls)
+	assert.Equal(t, 2, stats.ToolErrors)
+}
+
+// context aware tool which counts the number of calls in each conversation
+type counterTool struct {
+	calls []api.ToolCall
+}
+
+func (t *counterTool) Definition() shared.FunctionDefinitionParam {
+	return api.NewTool("count", "Increment counter.", func(struct{}) (string, error) { return "", nil }).Definition()
+}
+
+func (t *counterTool) Call(args string) (req, resp string, err error) {
+	return "", "", fmt.Errorf("Call should not be used")
+}
+
+func (t *counterTool) CallContext(ctx context.Context, call api.ToolCall) (api.ToolResult, error) {
+	t.calls = append(t.calls, call)
+	n, _ := call.Store.Get("count")
+	count, _ := n.(int)
+	call.Store.Set("count", count+1)
+	return api.ToolResult{Request: "count()", Response: fmt.Sprint(count + 1)}, nil
+}
+
+func TestContextTool(t *testing.T) {
+	tool := &counterTool{}
+	client := testClient(t,
+		jsonResponse(toolCallResponse(toolCall{"call_1", "count", `{}`})),
+		jsonResponse(contentResponse("Counted once")),
+		jsonResponse(toolCallResponse(toolCall{"call_2", "count", `{}`})),
+		jsonResponse(contentResponse("Counted twice")),
+	)
+	conv := newTestConversation(tool)
+	defer api.DeleteConversationStore(conv.ID)
+	for i := range 2 {
+		msgs, err := client.ChatCompletion(t.Context(), conv, discard, nil, tool)
+		require.NoError(t, err)
+		require.Len(t, msgs, 3)
+		assert.Equal(t, fmt.Sprint(i+1), msgs[1].Content)
+		conv.Messages = append(conv.Messages, msgs...)
+	}
+	require.Len(t, tool.calls, 2)
+	call := tool.calls[1]
+	assert.Equal(t, "call_2", call.ID)
+	assert.Equal(t, "count", call.Name)
+	assert.Equal(t, "{}", call.Arguments)
+	assert.Equal(t, conv.ID, call.ConversationID)
+	assert.Same(t, api.ConversationStore(conv.ID), call.Store)
+}
+
+// tool which saves a list of the arguments it was called with
+type historyTool struct {
+	history []string
+	resets  int
+}
+
+func (t *historyTool) Definition() shared.FunctionDefinitionParam {
+	return shared.FunctionDefinitionParam{Name: "history", Parameters: shared.FunctionParameters{"type": "object"}}
+}
+
+func (t *historyTool) Call(args string) (req, resp string, err error) {
+	t.history = append(t.history, args)
+	return "history" + args, fmt.Sprint(len(t.history)), nil
+}
+
+func (t *historyTool) SaveState() (json.RawMessage, error) {
+	return json.Marshal(t.history)
+}
+
+func (t *historyTool) LoadState(data json.RawMessage) error {
+	return json.Unmarshal(data, &t.history)
+}
+
+func (t *historyTool) ResetState() {
+	t.history = nil
+	t.resets++
+}
+
+func TestStatefulTool(t *testing.T) {
+	tool := &historyTool{history: []string{"stale"}}
+	client := testClient(t,
+		jsonResponse(toolCallResponse(toolCall{"call_1", "history", `{"n":1}`})),
+		jsonResponse(contentResponse("Done")),
+		jsonResponse(toolCallResponse(toolCall{"call_2", "history", `{"n":2}`})),
+		jsonResponse(contentResponse("Done")),
+	)
+	// state is reset as this is a new conversation
+	conv := newTestConversation(tool)
+	_, err := client.ChatCompletion(t.Context(), conv, discard, nil, tool)
+	require.NoError(t, err)
+	assert.Equal(t, 1, tool.resets)
+	assert.JSONEq(t, `["{\"n\":1}"]`, string(conv.ToolData["history"]))
+
+	// state is restored from the conversation
+	tool.history = nil
+	msgs, err := client.ChatCompletion(t.Context(), conv, discard, nil, tool)
+	require.NoError(t, err)
+	assert.Equal(t, "2", msgs[1].Content)
+	assert.Equal(t, 1, tool.resets)
+	assert.JSONEq(t, `["{\"n\":1}","{\"n\":2}"]`, string(conv.ToolData["history"]))
+}
+
+// tool which streams each word of the text argument as output
+type echoTool struct{}
+
+func (t echoTool) Definition() shared.FunctionDefinitionParam {
+	return api.NewTool("echo", "Echo text.", func(struct{ Text string }) (string, error) { return "", nil }).Definition()
+}
+
+func (t echoTool) Call(args string) (req, resp string, err error) {
+	return t.call(args, nil)
+}
+
+func (t echoTool) CallContext(ctx context.Context, call api.ToolCall) (api.ToolResult, error) {
+	req, resp, err := t.call(call.Arguments, call.Output)
+	return api.ToolResult{Request: req, Response: resp}, err
+}
+
+func (t echoTool) call(args string, output func(string)) (req, resp string, err error) {
+	a, err := api.DecodeArgs[struct{ Text string }](args)
+	for word := range strings.FieldsSeq(a.Text) {
+		if output != nil {
+			output(word + " ")
+		}
+		resp += word + " "
+	}
+	return "echo", resp, err
+}
+
+func TestToolOutput(t *testing.T) {
+	client := testClient(t,
+		jsonResponse(toolCallResponse(toolCall{"call_1", "echo", `{"Text":"one two"}`}, toolCall{"call_2", "echo", `{"Text":"three"}`})),
+		jsonResponse(contentResponse("Done")),
+	)
+	var output []string
+	callback := func(channel, content string, index int, end bool) {
+		if channel == "tool" {
+			output = append(output, fmt.Sprintf("%d %t %q", index, end, content))
+		}
+	}
+	_, err := client.ChatCompletion(t.Context(), newTestConversation(echoTool{}), callback, nil, echoTool{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		`0 false "one "`, `1 false "two "`, `2 true "echo\none two \n"`,
+		`0 false "three "`, `1 true "echo\nthree \n"`,
+	}, output)
+}
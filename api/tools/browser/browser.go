@@ -2,13 +2,16 @@
 package browser
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/url"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 	"unicode"
 
@@ -16,7 +19,6 @@ import (
 	"github.com/jnb666/gpt-go/api/tools"
 	"github.com/jnb666/gpt-go/markdown"
 	"github.com/jnb666/gpt-go/scrape"
-	"github.com/openai/openai-go/v3"
 	"github.com/openai/openai-go/v3/shared"
 	log "github.com/sirupsen/logrus"
 )
@@ -30,12 +32,14 @@ var (
 	FindMaxWords       = 150
 	BraveSearchURL     = "https://api.search.brave.com/res/v1/web/search"
 	MaxLinkTitleLength = 100
+	MaxStateBytes      = 1000000 // approx limit on size of documents saved with the conversation
 )
 
-// Current browser state with documents retrieved in this session
+// Current browser state with documents retrieved in this session. The tools may be called concurrently.
 type Browser struct {
 	BaseID      int                   `json:"base_id"`
 	URLIndex    map[int]markdown.Link `json:"url_index"`
+	mu          sync.Mutex
 	docs        []markdown.Document
 	cursor      int
 	scaper      scrape.Browser
@@ -52,23 +56,136 @@ func NewBrowser(braveApiKey string, opts ...func(*scrape.Options)) *Browser {
 	}
 }
 
-// Get all defined functions
+// Get all defined functions. The tools share the browser state which is saved with the conversation.
 func (b *Browser) Tools() []api.ToolFunction {
-	return []api.ToolFunction{
-		&Search{Browser: b},
-		&Open{Browser: b},
-		&Find{Browser: b},
-	}
+	return []api.ToolFunction{tool[SearchArgs]{b.searchTool(), b}, tool[OpenArgs]{b.openTool(), b}, tool[FindArgs]{b.findTool(), b}}
+}
+
+// browser tool function - implements the api.StatefulTool and api.SharedState interfaces
+type tool[Args any] struct {
+	*api.Tool[Args]
+	*Browser
+}
+
+func (t tool[Args]) StateKey() string {
+	return "browser"
+}
+
+// Tool to search using Brave API - implements api.ToolFunction interface. Same as the browser_search tool
+// returned by Browser.Tools.
+type Search struct {
+	*Browser
 }
 
+func (t Search) Definition() shared.FunctionDefinitionParam { return t.searchTool().Definition() }
+
+func (t Search) Call(arg string) (req, res string, err error) { return t.searchTool().Call(arg) }
+
+func (t Search) StateKey() string { return "browser" }
+
+// Tool to fetch a web URL using scrape module - implements api.ToolFunction and api.ContextTool interfaces.
+// Same as the browser_open tool returned by Browser.Tools.
+type Open struct {
+	*Browser
+}
+
+func (t Open) Definition() shared.FunctionDefinitionParam { return t.openTool().Definition() }
+
+func (t Open) Call(arg string) (req, res string, err error) { return t.openTool().Call(arg) }
+
+func (t Open) CallContext(ctx context.Context, call api.ToolCall) (api.ToolResult, error) {
+	return t.openTool().CallContext(ctx, call)
+}
+
+func (t Open) StateKey() string { return "browser" }
+
+// Tool to find a substring within a retrieved page - implements api.ToolFunction interface. Same as the
+// browser_find tool returned by Browser.Tools.
+type Find struct {
+	*Browser
+}
+
+func (t Find) Definition() shared.FunctionDefinitionParam { return t.findTool().Definition() }
+
+func (t Find) Call(arg string) (req, res string, err error) { return t.findTool().Call(arg) }
+
+func (t Find) StateKey() string { return "browser" }
+
 // Reset saved document state
 func (b *Browser) Reset() {
 	if b != nil {
+		b.mu.Lock()
+		defer b.mu.Unlock()
 		b.BaseID = 0
+		b.URLIndex = map[int]markdown.Link{}
 		b.docs = b.docs[:0]
+		b.cursor = 0
 	}
 }
 
+// Saved browser state. Documents and cursor were added later so may be missing in older saved conversations.
+type State struct {
+	BaseID   int                   `json:"base_id"`
+	URLIndex map[int]markdown.Link `json:"url_index"`
+	Docs     []markdown.Document   `json:"docs,omitzero"`
+	Cursor   int                   `json:"cursor,omitzero"`
+}
+
+// Get browser state as JSON - implements the api.StatefulTool interface. If the documents are larger than
+// MaxStateBytes then the lines and links of the oldest are dropped so they can still be cited but not reopened.
+func (b *Browser) SaveState() (json.RawMessage, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	state := State{BaseID: b.BaseID, URLIndex: b.URLIndex, Docs: slices.Clone(b.docs), Cursor: b.cursor}
+	size := 0
+	for i := len(state.Docs) - 1; i >= 0; i-- {
+		size += docSize(state.Docs[i])
+		if size > MaxStateBytes && i != b.cursor && len(state.Docs[i].Lines) > 0 {
+			log.Debugf("browser: evict saved document %d %s", i, state.Docs[i].URL)
+			state.Docs[i].Lines, state.Docs[i].Links = nil, nil
+		}
+	}
+	return json.Marshal(state)
+}
+
+// Restore browser state - implements the api.StatefulTool interface
+func (b *Browser) LoadState(data json.RawMessage) error {
+	var state State
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.BaseID = state.BaseID
+	b.URLIndex = state.URLIndex
+	if b.URLIndex == nil {
+		b.URLIndex = map[int]markdown.Link{}
+	}
+	b.docs = state.Docs
+	b.cursor = 0
+	if state.Cursor >= 0 && state.Cursor < len(b.docs) {
+		b.cursor = state.Cursor
+	}
+	return nil
+}
+
+// approx size of document in bytes when saved
+func docSize(doc markdown.Document) int {
+	n := len(doc.Title) + len(doc.Subtitle) + len(doc.URL)
+	for _, line := range doc.Lines {
+		n += len(line)
+	}
+	for _, link := range doc.Links {
+		n += len(link.Title) + len(link.URL)
+	}
+	return n
+}
+
+// Clear browser state - implements the api.StatefulTool interface
+func (b *Browser) ResetState() {
+	b.Reset()
+}
+
 // Close browser and release all resources
 func (b *Browser) Close() {
 	if b != nil {
@@ -77,10 +194,14 @@ func (b *Browser) Close() {
 }
 
 func (b *Browser) Docs() []markdown.Document {
+	b.mu.Lock()
+	defer b.mu.Unlock()
 	return b.docs
 }
 
 func (b *Browser) Cursor() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
 	return b.cursor
 }
 
@@ -88,6 +209,8 @@ var citationRegexp = regexp.MustCompile(`【(\d+)†(L.+?)】`)
 
 // Replace citations in final markdown output with links
 func (s *Browser) Postprocess(content string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	return citationRegexp.ReplaceAllStringFunc(content, func(ref string) string {
 		m := citationRegexp.FindStringSubmatch(ref)
 		if len(m) != 3 {
@@ -106,6 +229,7 @@ func (s *Browser) Postprocess(content string) string {
 	})
 }
 
+// following methods should be called with the mutex held
 func (b *Browser) current() *markdown.Document {
 	if b.cursor >= len(b.docs) {
 		return nil
@@ -113,9 +237,10 @@ func (b *Browser) current() *markdown.Document {
 	return &b.docs[b.cursor]
 }
 
+// get cached document and set the cursor - documents evicted by SaveState have no content so are not returned
 func (b *Browser) get(url string) *markdown.Document {
 	for i, page := range b.docs {
-		if page.URL == url {
+		if page.URL == url && len(page.Lines) > 0 {
 			b.cursor = i
 			return &b.docs[i]
 		}
@@ -140,60 +265,54 @@ func (b *Browser) getLink(id int) (l markdown.Link, ok bool) {
 	return
 }
 
+// add new document, or replace a document with the same URL which was evicted by SaveState so that the cursor
+// for earlier citations of that page is unchanged
 func (b *Browser) add(doc markdown.Document) {
-	b.cursor = len(b.docs)
 	b.BaseID += len(doc.Links)
+	for i, page := range b.docs {
+		if page.URL == doc.URL && len(page.Lines) == 0 {
+			b.cursor = i
+			b.docs[i] = doc
+			return
+		}
+	}
+	b.cursor = len(b.docs)
 	b.docs = append(b.docs, doc)
 }
 
-// Tool to search using Brave API - implements api.ToolFunction interface
-type Search struct {
-	*Browser
+// Arguments for browser_search tool
+type SearchArgs struct {
+	Query string `json:"query" description:"Text to search for on the web."`
 }
 
-func (t Search) Definition() shared.FunctionDefinitionParam {
-	return shared.FunctionDefinitionParam{
-		Name: "browser_search",
-		Description: openai.String("Searches the web for information related to `query`." +
-			" Returns a list of up to 10 links each with the page id, title, url and a brief summary of the page." +
-			" Links are formatted as 【{id}†.*】 where id is the page id parameter to pass to the browser_open tool."),
-		Parameters: shared.FunctionParameters{
-			"type": "object",
-			"properties": map[string]any{
-				"query": map[string]any{
-					"type":        "string",
-					"description": "Text to search for on the web.",
-				},
-			},
-			"required": []string{"query"},
-		},
-	}
+func (b *Browser) searchTool() *api.Tool[SearchArgs] {
+	return api.NewTool("browser_search", "Searches the web for information related to `query`."+
+		" Returns a list of up to 10 links each with the page id, title, url and a brief summary of the page."+
+		" Links are formatted as 【{id}†.*】 where id is the page id parameter to pass to the browser_open tool.",
+		b.Search)
 }
 
 // Perform a web search add the returned results to the Browser docs and return markdown formatted text
-func (t Search) Call(arg string) (req, res string, err error) {
-	log.Infof("[%d] browser_search(%s)", len(t.docs), arg)
-	var args struct {
-		Query string
-	}
-	if err := json.Unmarshal([]byte(arg), &args); err != nil {
-		return arg, "", err
-	}
-	req = fmt.Sprintf("browser.search%+v", args)
+func (b *Browser) Search(args SearchArgs) (string, error) {
 	if strings.TrimSpace(args.Query) == "" {
-		return req, errorResponse(fmt.Errorf("query argument is required")), nil
+		return errorResponse(fmt.Errorf("query argument is required")), nil
 	}
 	url := fmt.Sprintf("https://search.brave.com/search?q=%s&source=web", url.QueryEscape(args.Query))
-	if doc := t.get(url); doc != nil {
+	b.mu.Lock()
+	if doc := b.get(url); doc != nil {
 		log.Debugf("get %s from browser cache", url)
-		return req, doc.Format(0), nil
+		defer b.mu.Unlock()
+		return doc.Format(0), nil
 	}
-	resp, err := t.search(args.Query, 10)
+	b.mu.Unlock()
+	resp, err := b.search(args.Query, 10)
 	if err != nil {
-		return req, errorResponse(err), nil
+		return errorResponse(err), nil
 	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
 	doc := markdown.Document{
-		BaseID:     t.BaseID,
+		BaseID:     b.BaseID,
 		Title:      fmt.Sprintf("Web search for “%s”", args.Query),
 		URL:        url,
 		WrapColumn: WrapColumn,
@@ -201,14 +320,14 @@ func (t Search) Call(arg string) (req, res string, err error) {
 	doc.Write("# Search Results\n\n")
 	for i, r := range resp.Web.Results {
 		link := markdown.Link{URL: r.URL, Title: r.Title}
-		ref := link.Format(t.BaseID, i, "search.brave.com")
+		ref := link.Format(b.BaseID, i, "search.brave.com")
 		log.Debug(ref)
 		doc.Write("  * " + ref + "\n" + r.Description + "\n")
 		doc.Links = append(doc.Links, link)
-		t.URLIndex[doc.BaseID+i] = link
+		b.URLIndex[doc.BaseID+i] = link
 	}
-	t.add(doc)
-	return req, doc.Format(0), nil
+	b.add(doc)
+	return doc.Format(0), nil
 }
 
 type searchResponse struct {
@@ -227,12 +346,15 @@ type ratelimitHeaders struct {
 }
 
 // Call Brave web search API
-func (t Search) search(query string, topn int) (resp searchResponse, err error) {
+func (t *Browser) search(query string, topn int) (resp searchResponse, err error) {
 	if t.braveApiKey == "" {
 		return resp, fmt.Errorf("BraveApiKey is required for search")
 	}
-	if tm := time.Now(); tm.Before(t.nextSearch) {
-		wait := t.nextSearch.Sub(tm)
+	t.mu.Lock()
+	nextSearch := t.nextSearch
+	t.mu.Unlock()
+	if tm := time.Now(); tm.Before(nextSearch) {
+		wait := nextSearch.Sub(tm)
 		log.Infof("Brave search rate limit - wait %s", wait.Round(time.Millisecond))
 		time.Sleep(wait)
 	}
@@ -246,7 +368,9 @@ func (t Search) search(query string, topn int) (resp searchResponse, err error)
 	}
 	log.Debugf("Brave search rate limits: %+v", limits)
 	if limits.Remaining[0] == 0 {
+		t.mu.Lock()
 		t.nextSearch = time.Now().Add(time.Duration(limits.Reset[0]) * time.Second)
+		t.mu.Unlock()
 	}
 	if err != nil {
 		return resp, err
@@ -257,81 +381,68 @@ func (t Search) search(query string, topn int) (resp searchResponse, err error)
 	return resp, nil
 }
 
-// Tool to fetch a web URL using scrape module - implements api.ToolFunction interface
-type Open struct {
-	*Browser
+// Arguments for browser_open tool
+type OpenArgs struct {
+	ID  any     "json:\"id,omitzero\" type:\"number,string\" description:\"If `id` is a number it is treated as a page id. If `id` is a string, it is treated as a fully qualified URL. If not provided then `loc` can be used to scroll the current document.\""
+	Loc float64 `json:"loc,omitzero" description:"Line number in the document at which to position the viewport. Defaults to the start of the document if not provided."`
 }
 
-func (t Open) Definition() shared.FunctionDefinitionParam {
-	return shared.FunctionDefinitionParam{
-		Name: "browser_open",
-		Description: openai.String("Opens a web page and returns the text content in Markdown format." +
-			" Links in the returned document are replaced with 【{id}†.*】 where id can be passed to a new call to browser_open to go to that page."),
-		Parameters: shared.FunctionParameters{
-			"type": "object",
-			"properties": map[string]any{
-				"id": map[string]any{
-					"type": []string{"number", "string"},
-					"description": "If `id` is a number it is treated as a page id. If `id` is a string, it is treated as a fully qualified URL." +
-						" If not provided then `loc` can be used to scroll the current document.",
-				},
-				"loc": map[string]any{
-					"type":        "number",
-					"description": "Line number in the document at which to position the viewport. Defaults to the start of the document if not provided.",
-				},
-			},
-		},
-	}
+func (b *Browser) openTool() *api.Tool[OpenArgs] {
+	return api.NewContextTool("browser_open", "Opens a web page and returns the text content in Markdown format."+
+		" Links in the returned document are replaced with 【{id}†.*】 where id can be passed to a new call to browser_open to go to that page.",
+		b.open)
 }
 
 // Gets markdown content using a playwright scape request
-func (t Open) Call(arg string) (req, res string, err error) {
-	log.Infof("[%d] browser_open(%s)", len(t.docs), arg)
-	var args struct {
-		ID  any
-		Loc float64
-	}
-	args.Loc = -1
-	if err := json.Unmarshal([]byte(arg), &args); err != nil {
-		return arg, "", err
-	}
-	req = fmt.Sprintf("browser.open%+v", args)
+func (b *Browser) Open(args OpenArgs) (string, error) {
+	return b.open(context.Background(), args)
+}
+
+// the scrape span is a child of the tool call span in ctx
+func (b *Browser) open(ctx context.Context, args OpenArgs) (string, error) {
 	id, url := parseID(args.ID)
 	var title string
 	log.Debugf("open %+v => id=%d url=%q loc=%g", args, id, url, args.Loc)
+	b.mu.Lock()
 	if url == "" {
-		if l, ok := t.getLink(id); ok {
+		if l, ok := b.getLink(id); ok {
 			url, title = l.URL, l.Title
 		} else {
-			return req, errorResponse(fmt.Errorf("page id %d not found", id)), nil
+			b.mu.Unlock()
+			return errorResponse(fmt.Errorf("page id %d not found", id)), nil
 		}
 	}
-	if doc := t.get(url); doc != nil {
+	if doc := b.get(url); doc != nil {
+		defer b.mu.Unlock()
 		log.Debugf("get %s from browser cache", url)
 		doc.Subtitle = ""
 		if args.Loc > 0 {
 			doc.StartLine = int(args.Loc)
 		}
-		return req, doc.Format(MaxWords), nil
+		return doc.Format(MaxWords), nil
 	}
-	doc, err := t.scrape(url, title)
+	b.mu.Unlock()
+	resp, err := b.scaper.ScrapeContext(ctx, url)
 	if err != nil {
 		log.Error(err)
-		return req, fmt.Sprintf("%s\n(%s)\n", err, doc.URL), nil
+		return fmt.Sprintf("%s\n(%s)\n", err, url), nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	doc, err := b.document(resp, url, title)
+	if err != nil {
+		log.Error(err)
+		return fmt.Sprintf("%s\n(%s)\n", err, doc.URL), nil
 	}
 	if args.Loc > 0 {
 		doc.StartLine = int(args.Loc)
 	}
-	t.add(doc)
-	return req, doc.Format(MaxWords), nil
+	b.add(doc)
+	return doc.Format(MaxWords), nil
 }
 
-// get markdown content for url and extract links from result
-func (t Open) scrape(url, title string) (doc markdown.Document, err error) {
-	resp, err := t.scaper.Scrape(url)
-	if err != nil {
-		return doc, err
-	}
+// convert scraped markdown content to document and extract links from result - should be called with the mutex held
+func (t *Browser) document(resp scrape.Response, url, title string) (doc markdown.Document, err error) {
 	if resp.StatusText != "OK" {
 		err = fmt.Errorf("error %d: %s", resp.Status, resp.StatusText)
 	} else if resp.Title != "" {
@@ -344,46 +455,28 @@ func (t Open) scrape(url, title string) (doc markdown.Document, err error) {
 	return doc, err
 }
 
-// Tool to find a substring within a retrieved page - implements api.ToolFunction interface
-type Find struct {
-	*Browser
+// Arguments for browser_find tool
+type FindArgs struct {
+	Pattern string `json:"pattern" description:"Text to search for."`
 }
 
-func (t Find) Definition() shared.FunctionDefinitionParam {
-	return shared.FunctionDefinitionParam{
-		Name: "browser_find",
-		Description: openai.String("Finds exact matches of `pattern` in the current page, or the page given by `cursor`." +
-			" If a match is found then returns the page scrolled to the first line containing that string." +
-			" Repeat the same browser_find call to scroll to the next match."),
-		Parameters: shared.FunctionParameters{
-			"type": "object",
-			"properties": map[string]any{
-				"pattern": map[string]any{
-					"type":        "string",
-					"description": "Text to search for.",
-				},
-			},
-			"required": []string{"pattern"},
-		},
-	}
+func (b *Browser) findTool() *api.Tool[FindArgs] {
+	return api.NewTool("browser_find", "Finds exact matches of `pattern` in the current page, or the page given by `cursor`."+
+		" If a match is found then returns the page scrolled to the first line containing that string."+
+		" Repeat the same browser_find call to scroll to the next match.",
+		b.Find)
 }
 
-func (t Find) Call(arg string) (req, res string, err error) {
-	log.Infof("[%d] browser_find(%s)", len(t.docs), arg)
-	// parse arguments
-	var args struct {
-		Pattern string
-	}
-	if err := json.Unmarshal([]byte(arg), &args); err != nil {
-		return arg, "", err
-	}
-	req = fmt.Sprintf("browser.find%+v", args)
+// Find a substring within the current page
+func (b *Browser) Find(args FindArgs) (string, error) {
 	if strings.TrimSpace(args.Pattern) == "" {
-		return req, errorResponse(fmt.Errorf("pattern argument is required")), nil
+		return errorResponse(fmt.Errorf("pattern argument is required")), nil
 	}
-	doc := t.current()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	doc := b.current()
 	if doc == nil {
-		return req, errorResponse(fmt.Errorf("no current document to search")), nil
+		return errorResponse(fmt.Errorf("no current document to search")), nil
 	}
 	if doc.Subtitle != "" {
 		// search again in search page
@@ -397,7 +490,7 @@ func (t Find) Call(arg string) (req, res string, err error) {
 		doc.Subtitle = fmt.Sprintf("“%s” not found", args.Pattern)
 		doc.StartLine = len(doc.Lines)
 	}
-	return req, doc.Format(FindMaxWords), nil
+	return doc.Format(FindMaxWords), nil
 }
 
 func errorResponse(err error) string {
@@ -3,8 +3,11 @@ package browser
 import (
 	"encoding/json"
 	"os"
+	"reflect"
 	"strings"
 	"testing"
+
+	"github.com/jnb666/gpt-go/markdown"
 )
 
 func TestSearch(t *testing.T) {
@@ -18,7 +21,7 @@ func TestSearch(t *testing.T) {
 func TestRatelimit(t *testing.T) {
 	browser := newBrowser()
 	defer browser.Close()
-	search := Search{Browser: browser}
+	search := browser.searchTool()
 	for _, query := range []string{"foo", "bar"} {
 		_, resp, err := search.Call(marshal(map[string]any{"query": query}))
 		if err != nil {
@@ -31,7 +34,7 @@ func TestRatelimit(t *testing.T) {
 func TestOpenURL(t *testing.T) {
 	browser := newBrowser()
 	defer browser.Close()
-	open := Open{Browser: browser}
+	open := browser.openTool()
 	_, resp, _ := open.Call(marshal(map[string]any{"id": "https://itsabanana.dev/posts/local_llm_hosting-part1/"}))
 	t.Logf("response:\n%s", resp)
 	printLinks(t, browser, 10)
@@ -40,7 +43,7 @@ func TestOpenURL(t *testing.T) {
 func TestOpenWikipedia(t *testing.T) {
 	browser := newBrowser()
 	defer browser.Close()
-	open := Open{Browser: browser}
+	open := browser.openTool()
 	_, resp, _ := open.Call(marshal(map[string]any{"id": "https://en.wikipedia.org/wiki/Liz_Truss"}))
 	t.Logf("response:\n%s", resp)
 	printLinks(t, browser, 10)
@@ -49,7 +52,7 @@ func TestOpenWikipedia(t *testing.T) {
 func TestOpenReddit(t *testing.T) {
 	browser := newBrowser()
 	defer browser.Close()
-	open := Open{Browser: browser}
+	open := browser.openTool()
 	_, resp, _ := open.Call(marshal(map[string]any{"id": "https://www.reddit.com/r/programming/comments/1nm2u3h/vibe_coding_is_creating_braindead_coders/"}))
 	t.Logf("response:\n%s", resp)
 	printLinks(t, browser, 10)
@@ -58,7 +61,7 @@ func TestOpenReddit(t *testing.T) {
 func TestOpenYahoo(t *testing.T) {
 	browser := newBrowser()
 	defer browser.Close()
-	open := Open{Browser: browser}
+	open := browser.openTool()
 	_, resp, _ := open.Call(marshal(map[string]any{"id": "https://www.yahoo.com/entertainment/"}))
 	t.Logf("response:\n%s", resp)
 	printLinks(t, browser, 10)
@@ -67,7 +70,7 @@ func TestOpenYahoo(t *testing.T) {
 func TestNotFound(t *testing.T) {
 	browser := newBrowser()
 	defer browser.Close()
-	open := Open{Browser: browser}
+	open := browser.openTool()
 	_, resp, _ := open.Call(marshal(map[string]any{"id": "https://itsabanana.dev/nonsuch/"}))
 	t.Logf("response:\n%s", resp)
 	if !strings.Contains(resp, "404: Not Found") {
@@ -78,7 +81,7 @@ func TestNotFound(t *testing.T) {
 func TestBlocked(t *testing.T) {
 	browser := newBrowser()
 	defer browser.Close()
-	open := Open{Browser: browser}
+	open := browser.openTool()
 	_, resp, _ := open.Call(marshal(map[string]any{"id": "https://www.g2.com/"}))
 	t.Logf("response:\n%s", resp)
 	if !strings.Contains(resp, "403: Forbidden") {
@@ -92,7 +95,7 @@ func TestOpenID(t *testing.T) {
 	resp := doSearch(t, browser, "local LLM hosting")
 	t.Log(resp)
 
-	open := Open{Browser: browser}
+	open := browser.openTool()
 	_, resp, _ = open.Call(marshal(map[string]any{"id": 3}))
 	t.Logf("response:\n%s", resp)
 	_, resp, _ = open.Call(marshal(map[string]any{"loc": 63}))
@@ -105,11 +108,11 @@ func TestFind(t *testing.T) {
 	browser := newBrowser()
 	defer browser.Close()
 
-	open := Open{Browser: browser}
+	open := browser.openTool()
 	_, resp, _ := open.Call(marshal(map[string]any{"id": "https://blog.n8n.io/local-llm/"}))
 	t.Logf("open response:\n%s", resp)
 
-	find := Find{Browser: browser}
+	find := browser.findTool()
 	for range 3 {
 		_, resp, _ = find.Call(marshal(map[string]any{"pattern": "video ram"}))
 		t.Logf("find response:\n%s", resp)
@@ -117,12 +120,66 @@ func TestFind(t *testing.T) {
 	printLinks(t, browser, 10)
 }
 
+func TestSaveState(t *testing.T) {
+	b := &Browser{URLIndex: map[int]markdown.Link{}}
+	b.add(markdown.Document{URL: "https://example.com/a", Title: "Page A", Lines: []string{"line 1", "line 2"}, Links: []markdown.Link{{Title: "B", URL: "https://example.com/b"}}})
+	b.add(markdown.Document{URL: "https://example.com/b", Title: "Page B", BaseID: 1, Lines: []string{"line 1"}, StartLine: 1})
+	b.cursor = 1
+	data, err := b.SaveState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b2 := &Browser{}
+	if err := b2.LoadState(data); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(b.docs, b2.docs) || b2.cursor != 1 || b2.BaseID != 1 {
+		t.Errorf("state not restored: %s", data)
+	}
+	if resp := b2.Postprocess("see 【0†L1-L2】"); !strings.Contains(resp, "(https://example.com/a") {
+		t.Errorf("citation not replaced: %q", resp)
+	}
+
+	// older saved state without documents
+	if err := b2.LoadState(json.RawMessage(`{"base_id":3,"url_index":{"1":{"title":"A","url":"https://example.com/a"}}}`)); err != nil {
+		t.Fatal(err)
+	}
+	if len(b2.docs) != 0 || b2.cursor != 0 || b2.URLIndex[1].URL != "https://example.com/a" {
+		t.Errorf("invalid state after loading old format: %+v", b2)
+	}
+
+	// oldest document is evicted if size limit exceeded
+	defer func(n int) { MaxStateBytes = n }(MaxStateBytes)
+	MaxStateBytes = 40
+	data, _ = b.SaveState()
+	b2.LoadState(data)
+	if len(b2.docs) != 2 || len(b2.docs[0].Lines) != 0 || b2.docs[0].URL != "https://example.com/a" || len(b2.docs[1].Lines) != 1 {
+		t.Errorf("expected first document to be evicted: %s", data)
+	}
+
+	// evicted document is fetched again when reopened and replaced at the same cursor
+	if doc := b2.get("https://example.com/a"); doc != nil {
+		t.Errorf("expected cache miss for evicted document: %+v", doc)
+	}
+	b2.add(markdown.Document{URL: "https://example.com/a", Title: "Page A", BaseID: b2.BaseID, Lines: []string{"line 1", "line 2"},
+		Links: []markdown.Link{{Title: "B", URL: "https://example.com/b"}}})
+	if len(b2.docs) != 2 || b2.cursor != 0 || len(b2.docs[0].Lines) != 2 || b2.get("https://example.com/a") != &b2.docs[0] {
+		t.Errorf("expected first document to be replaced: %+v", b2.docs)
+	}
+	if link, ok := b2.getLink(b2.docs[0].BaseID); !ok || link.URL != "https://example.com/b" {
+		t.Errorf("link from reopened document not found: %+v", link)
+	}
+	if resp := b2.Postprocess("see 【0†L1-L2】"); !strings.Contains(resp, "(https://example.com/a") {
+		t.Errorf("citation not replaced: %q", resp)
+	}
+}
+
 func newBrowser() *Browser {
 	return NewBrowser(os.Getenv("BRAVE_API_KEY"))
 }
 
 func doSearch(t *testing.T, browser *Browser, query string) string {
-	search := Search{Browser: browser}
+	search := browser.searchTool()
 	_, resp, err := search.Call(marshal(map[string]any{"query": query}))
 	if err != nil {
 		t.Fatal(err)
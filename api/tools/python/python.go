@@ -9,29 +9,59 @@ import (
 	"io"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/docker/go-sdk/container"
 	"github.com/docker/go-sdk/container/exec"
+	"github.com/jnb666/gpt-go/api"
+	"github.com/jnb666/gpt-go/metrics"
+	"github.com/moby/moby/api/pkg/stdcopy"
 	moby_container "github.com/moby/moby/api/types/container"
 	"github.com/openai/openai-go/v3"
 	"github.com/openai/openai-go/v3/shared"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
-var DefaultConfig = Config{TimeSeconds: 120, MemoryBytes: 1024 * 1024 * 1024, OutputBytes: 10000}
+var DefaultConfig = Config{TimeSeconds: 120, MemoryBytes: 1024 * 1024 * 1024, OutputBytes: 10000, WorkspaceBytes: 1024 * 1024}
 
-// Python tool - implements the api.ToolFunction interface
+// Number of running containers exported by the metrics package
+var runningContainers = metrics.NewGauge("gpt_python_containers", "Number of running python containers.")
+
+// OpenTelemetry tracer using the global tracer provider
+var tracer = otel.Tracer("github.com/jnb666/gpt-go/api/tools/python")
+
+// archive files used to save and restore the working directory - restore file is owned by root so is not removed
+const (
+	workspaceArchive = "/tmp/workspace.tgz"
+	restoreArchive   = "/tmp/restore.tgz"
+)
+
+// Python tool - implements the api.ToolFunction and api.StatefulTool interfaces
 type Python struct {
-	ctr *container.Container
-	cfg Config
+	ctr       *container.Container
+	cfg       Config
+	mu        sync.Mutex
+	interrupt chan struct{}
+	workspace []byte
 }
 
 // Limits for python code execution.
 type Config struct {
-	TimeSeconds int
-	MemoryBytes int
-	OutputBytes int
+	TimeSeconds    int
+	MemoryBytes    int
+	OutputBytes    int
+	WorkspaceBytes int // max size of compressed workspace files saved with the conversation
+}
+
+// Saved tool state
+type State struct {
+	Workspace []byte `json:"workspace"` // tar.gz archive of files in the working directory
 }
 
 // Create a new python tool. Uses DefaultConfig if config is omitted.
@@ -52,19 +82,15 @@ func (c *Python) Definition() shared.FunctionDefinitionParam {
 			" python will respond with the output generated by the script and the value of the last expression if not None." +
 			" Execution will time out after 120.0 seconds. The current directory can be used to save and persist user files." +
 			" Internet access for this session is blocked."),
-		Parameters: shared.FunctionParameters{
-			"type": "object",
-			"properties": map[string]any{
-				"code": map[string]any{
-					"type":        "string",
-					"description": "Python code to execute.",
-				},
-			},
-			"required": []string{"code"},
-		},
+		Parameters: shared.FunctionParameters(api.Schema[Args]()),
 	}
 }
 
+// Arguments for python tool
+type Args struct {
+	Code string `json:"code" description:"Python code to execute."`
+}
+
 // Stop current container if running
 func (c *Python) Stop() {
 	if c != nil && c.ctr != nil {
@@ -73,15 +99,47 @@ func (c *Python) Stop() {
 			log.Error(err)
 		}
 		c.ctr = nil
+		runningContainers.Dec()
+	}
+}
+
+// Calls share a single container so must be run in order - implements the api.Sequential interface
+func (c *Python) Sequential() bool {
+	return true
+}
+
+// Kill the currently running python process if any - implements the api.Interrupter interface
+func (c *Python) Interrupt() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.interrupt != nil {
+		log.Debug("python: interrupt")
+		close(c.interrupt)
+		c.interrupt = nil
+	}
+}
+
+// Execute python code and kill the process if the context is cancelled. Output from the script is streamed to
+// call.Output a line at a time. Implements the api.ContextTool interface.
+func (c *Python) CallContext(ctx context.Context, call api.ToolCall) (api.ToolResult, error) {
+	if err := ctx.Err(); err != nil {
+		return api.ToolResult{Request: call.Arguments}, err
 	}
+	stop := context.AfterFunc(ctx, c.Interrupt)
+	defer stop()
+	code, resp, err := c.call(ctx, call.Arguments, call.Output)
+	return api.ToolResult{Request: code, Response: resp}, err
 }
 
 // Execute python code within container with time limit
 func (c *Python) Call(input string) (code, resp string, err error) {
-	var args struct {
-		Code string
-	}
-	if err := json.Unmarshal([]byte(input), &args); err != nil {
+	return c.call(context.Background(), input, nil)
+}
+
+// parent is used for the trace context only - cancellation is handled by the interrupt channel so the process is killed
+func (c *Python) call(parent context.Context, input string, output func(string)) (code, resp string, err error) {
+	args, err := api.DecodeArgs[Args](input)
+	if err != nil {
 		return code, "", fmt.Errorf(`error: invalid argument syntax - expecting {"code": ".. python code ..")`)
 	}
 	code = args.Code
@@ -90,15 +148,25 @@ func (c *Python) Call(input string) (code, resp string, err error) {
 	}
 	log.Info("Calling python tool")
 	log.Debug(code)
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(context.WithoutCancel(parent))
 	defer cancel()
 	if c.ctr == nil {
 		if err := c.start(ctx); err != nil {
 			return code, "", err
 		}
 	}
+	c.mu.Lock()
+	interrupt := make(chan struct{})
+	c.interrupt = interrupt
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		c.interrupt = nil
+		c.mu.Unlock()
+	}()
+
 	b := new(bytes.Buffer)
-	err = c.exec(ctx, strconv.Quote(code), b)
+	err = c.exec(ctx, strconv.Quote(code), b, output, interrupt)
 	if err != nil {
 		return code, "", err
 	}
@@ -106,6 +174,42 @@ func (c *Python) Call(input string) (code, resp string, err error) {
 	return code, b.String(), nil
 }
 
+// Save files in the working directory if the container is running. Disabled if Config.WorkspaceBytes is zero.
+// Implements the api.StatefulTool interface
+func (c *Python) SaveState() (json.RawMessage, error) {
+	if c.cfg.WorkspaceBytes <= 0 {
+		return nil, nil
+	}
+	if c.ctr != nil {
+		ws, err := c.saveWorkspace(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		c.workspace = ws
+	}
+	if len(c.workspace) == 0 {
+		return nil, nil
+	}
+	return json.Marshal(State{Workspace: c.workspace})
+}
+
+// Load saved files - these are restored to the working directory when the container is next started.
+// Implements the api.StatefulTool interface
+func (c *Python) LoadState(data json.RawMessage) error {
+	var state State
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	c.workspace = state.Workspace
+	return nil
+}
+
+// Stop the container and clear any saved files - implements the api.StatefulTool interface
+func (c *Python) ResetState() {
+	c.Stop()
+	c.workspace = nil
+}
+
 func (c *Python) start(ctx context.Context) error {
 	var err error
 	log.Debug("python: start container")
@@ -116,39 +220,175 @@ func (c *Python) start(ctx context.Context) error {
 			h.Resources.Memory = int64(c.cfg.MemoryBytes)
 		}),
 	)
+	if err != nil {
+		return err
+	}
+	runningContainers.Inc()
+	if len(c.workspace) == 0 {
+		return nil
+	}
+	log.Debugf("python: restore %d byte workspace", len(c.workspace))
+	if err = c.ctr.CopyToContainer(ctx, c.workspace, restoreArchive, 0o644); err != nil {
+		return err
+	}
+	_, err = c.run(ctx, "tar xzf "+restoreArchive)
 	return err
 }
 
-func (c *Python) exec(ctx context.Context, code string, b *bytes.Buffer) error {
-	timedOut := false
+// returns nil if the working directory is empty
+func (c *Python) saveWorkspace(ctx context.Context) ([]byte, error) {
+	if files, err := c.run(ctx, "ls -A"); err != nil || files == "" {
+		return nil, err
+	}
+	if _, err := c.run(ctx, "tar czf "+workspaceArchive+" ."); err != nil {
+		return nil, err
+	}
+	r, err := c.ctr.CopyFromContainer(ctx, workspaceArchive)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	b, err := io.ReadAll(io.LimitReader(r, int64(c.cfg.WorkspaceBytes)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > c.cfg.WorkspaceBytes {
+		return nil, fmt.Errorf("python workspace is too large to save - limit is %d bytes", c.cfg.WorkspaceBytes)
+	}
+	log.Debugf("python: saved %d byte workspace", len(b))
+	_, err = c.run(ctx, "rm -f "+workspaceArchive)
+	return b, err
+}
+
+// run shell command in the working directory and return the output
+func (c *Python) run(ctx context.Context, cmd string) (string, error) {
+	rc, out, err := c.ctr.Exec(ctx, []string{"sh", "-c", cmd}, exec.Multiplexed())
+	if err != nil {
+		return "", err
+	}
+	b, err := io.ReadAll(out)
+	if err != nil {
+		return "", err
+	}
+	if rc != 0 {
+		return "", fmt.Errorf("python: %q failed: rc=%d %s", cmd, rc, strings.TrimSpace(string(b)))
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+func (c *Python) exec(ctx context.Context, code string, b *bytes.Buffer, output func(string), interrupt chan struct{}) (err error) {
+	// set by the goroutine which kills the process
+	var timedOut, interrupted atomic.Bool
+	rc := -1
+	ctx, span := tracer.Start(ctx, "python_exec", trace.WithAttributes(attribute.Int("gpt.python.code_size", len(code))))
+	defer func() {
+		span.SetAttributes(attribute.Int("gpt.python.rc", rc), attribute.Bool("gpt.python.timed_out", timedOut.Load()),
+			attribute.Bool("gpt.python.interrupted", interrupted.Load()))
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
 	ch := time.After(time.Duration(c.cfg.TimeSeconds) * time.Second)
 	go func() {
 		select {
 		case <-ch:
 			log.Debugf("python: command timed out - killing")
-			timedOut = true
+			timedOut.Store(true)
+			c.ctr.Exec(ctx, []string{"killall", "python"})
+		case <-interrupt:
+			log.Debugf("python: command interrupted - killing")
+			interrupted.Store(true)
 			c.ctr.Exec(ctx, []string{"killall", "python"})
 		case <-ctx.Done():
 		}
 	}()
 
-	rc, out, err := c.ctr.Exec(ctx, []string{"python", "-u", "/home/app/runner.py"},
-		exec.WithEnv([]string{"USER_CODE=" + code}), exec.Multiplexed(),
-	)
+	opts := []exec.ProcessOption{exec.WithEnv([]string{"USER_CODE=" + code}), exec.Multiplexed()}
+	var w *lineWriter
+	if output != nil {
+		w = &lineWriter{buf: b, output: output, maxBytes: c.cfg.OutputBytes}
+		opts[1] = streamTo(w)
+	}
+	rc, out, err := c.ctr.Exec(ctx, []string{"python", "-u", "/home/app/runner.py"}, opts...)
 	if err != nil {
 		return err
 	}
 	log.Debugf("python: exec rc = %d", rc)
-	io.Copy(b, out)
+	if w == nil {
+		io.Copy(b, out)
+	} else {
+		// wait for remaining output
+		io.Copy(io.Discard, out)
+		w.flush()
+	}
 
 	if b.Len() > c.cfg.OutputBytes {
 		b.Truncate(c.cfg.OutputBytes)
 		b.WriteString("\n=== output truncated ===\n")
 	}
-	if timedOut {
+	if timedOut.Load() {
 		b.WriteString("\nError: timed out - killed\n")
+	} else if interrupted.Load() {
+		b.WriteString("\nError: interrupted - killed\n")
 	} else if rc != 0 && rc != 1 {
 		b.WriteString("\nError: execution failed\n")
 	}
 	return nil
 }
+
+// exec option to copy the combined stdout and stderr to w as it is generated. The reader returned by Exec is empty
+// and reaches EOF once all of the output has been copied.
+func streamTo(w io.Writer) exec.ProcessOption {
+	return exec.ProcessOptionFunc(func(opts *exec.ProcessOptions) {
+		if opts.Reader == nil {
+			return
+		}
+		r := opts.Reader
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			if _, err := stdcopy.StdCopy(w, w, r); err != nil {
+				log.Error("python: error copying output: ", err)
+			}
+		}()
+		opts.Reader = doneReader(done)
+	})
+}
+
+type doneReader chan struct{}
+
+func (r doneReader) Read(p []byte) (int, error) {
+	<-r
+	return 0, io.EOF
+}
+
+// writes to buf and sends each complete line to output until maxBytes have been written
+type lineWriter struct {
+	buf      *bytes.Buffer
+	output   func(string)
+	maxBytes int
+	sent     int
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.buf.Write(p)
+	if end := bytes.LastIndexByte(w.buf.Bytes(), '\n') + 1; end > w.sent {
+		w.send(end)
+	}
+	return len(p), nil
+}
+
+// send any remaining output without a trailing newline
+func (w *lineWriter) flush() {
+	w.send(w.buf.Len())
+}
+
+func (w *lineWriter) send(end int) {
+	end = min(end, w.maxBytes)
+	if end > w.sent {
+		w.output(string(w.buf.Bytes()[w.sent:end]))
+		w.sent = end
+	}
+}
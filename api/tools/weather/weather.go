@@ -2,7 +2,6 @@
 package weather
 
 import (
-	"encoding/json"
 	"fmt"
 	"math"
 	"net/url"
@@ -10,16 +9,11 @@ import (
 
 	"github.com/jnb666/gpt-go/api"
 	"github.com/jnb666/gpt-go/api/tools"
-	"github.com/openai/openai-go/v3"
 	"github.com/openai/openai-go/v3/shared"
-	log "github.com/sirupsen/logrus"
 )
 
 func Tools(apiKey string) []api.ToolFunction {
-	return []api.ToolFunction{
-		Current{ApiKey: apiKey},
-		Forecast{ApiKey: apiKey},
-	}
+	return []api.ToolFunction{currentTool(apiKey), forecastTool(apiKey)}
 }
 
 // Tool to get current weather - implements api.ToolFunction interface
@@ -28,79 +22,54 @@ type Current struct {
 }
 
 func (t Current) Definition() shared.FunctionDefinitionParam {
-	return shared.FunctionDefinitionParam{
-		Name: "get_current_weather",
-		Description: openai.String("Get the current weather in a given location." +
-			" Returns conditions with temperatures in Celsius and wind speed in meters/second."),
-		Parameters: shared.FunctionParameters{
-			"type": "object",
-			"properties": map[string]any{
-				"location": map[string]any{
-					"type":        "string",
-					"description": `The city name and ISO 3166 country code, e.g. "London,GB" or "New York,US".`,
-				},
-			},
-			"required": []string{"location"},
-		},
-	}
+	return currentTool(t.ApiKey).Definition()
 }
 
 func (t Current) Call(arg string) (req, res string, err error) {
-	log.Printf("call get_current_weather(%s)", arg)
-	var args struct {
-		Location string
-	}
-	if err := json.Unmarshal([]byte(arg), &args); err != nil {
-		return arg, "", err
-	}
-	req = fmt.Sprintf("get_current_weather%+v", args)
-	w, err := currentWeather(args.Location, t.ApiKey)
-	return req, w.String(), err
+	return currentTool(t.ApiKey).Call(arg)
 }
 
-// Tool to get weather forecast data - implements api.ToolFunction interface
+// Tool to get weather forecast - implements api.ToolFunction interface
 type Forecast struct {
 	ApiKey string
 }
 
 func (t Forecast) Definition() shared.FunctionDefinitionParam {
-	return shared.FunctionDefinitionParam{
-		Name: "get_weather_forecast",
-		Description: openai.String("Get the weather forecast in a given location." +
-			" Returns a list with date and time in local timezone and predicted conditions every 3 hours.\n" +
-			" Temperatures are in Celsius and wind speed in meters/second."),
-		Parameters: shared.FunctionParameters{
-			"type": "object",
-			"properties": map[string]any{
-				"location": map[string]any{
-					"type":        "string",
-					"description": `The city name and ISO 3166 country code, e.g. "London,GB" or "New York,US".`,
-				},
-				"periods": map[string]any{
-					"type":        "number",
-					"description": `Number of 3 hour periods to look ahead from current time - default 24.`,
-				},
-			},
-			"required": []string{"location"},
-		},
-	}
+	return forecastTool(t.ApiKey).Definition()
 }
 
 func (t Forecast) Call(arg string) (req, res string, err error) {
-	log.Printf("call get_weather_forecast(%s)", arg)
-	var args struct {
-		Location string
-		Periods  float64
-	}
-	if err := json.Unmarshal([]byte(arg), &args); err != nil {
-		return arg, "", err
-	}
-	if args.Periods == 0 {
-		args.Periods = 24
-	}
-	req = fmt.Sprintf("get_weather_forecast%+v", args)
-	w, err := weatherForecast(args.Location, int(args.Periods), t.ApiKey)
-	return req, w.String(), err
+	return forecastTool(t.ApiKey).Call(arg)
+}
+
+func currentTool(apiKey string) *api.Tool[CurrentArgs] {
+	return api.NewTool("get_current_weather", "Get the current weather in a given location."+
+		" Returns conditions with temperatures in Celsius and wind speed in meters/second.",
+		func(args CurrentArgs) (string, error) {
+			w, err := currentWeather(args.Location, apiKey)
+			return w.String(), err
+		})
+}
+
+func forecastTool(apiKey string) *api.Tool[ForecastArgs] {
+	return api.NewTool("get_weather_forecast", "Get the weather forecast in a given location."+
+		" Returns a list with date and time in local timezone and predicted conditions every 3 hours.\n"+
+		" Temperatures are in Celsius and wind speed in meters/second.",
+		func(args ForecastArgs) (string, error) {
+			w, err := weatherForecast(args.Location, int(args.Periods), apiKey)
+			return w.String(), err
+		})
+}
+
+// Arguments for get_current_weather tool
+type CurrentArgs struct {
+	Location string `json:"location" description:"The city name and ISO 3166 country code, e.g. \"London,GB\" or \"New York,US\"."`
+}
+
+// Arguments for get_weather_forecast tool
+type ForecastArgs struct {
+	Location string  `json:"location" description:"The city name and ISO 3166 country code, e.g. \"London,GB\" or \"New York,US\"."`
+	Periods  float64 `json:"periods" description:"Number of 3 hour periods to look ahead from current time - default 24." default:"24"`
 }
 
 // Current weather API per https://openweathermap.org/current
@@ -0,0 +1,90 @@
+package api
+
+import (
+	"context"
+
+	"github.com/openai/openai-go/v3"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// OpenTelemetry tracer using the global tracer provider - spans are not recorded unless a provider is configured,
+// e.g. by the tracing package. Attribute names follow the gen_ai semantic conventions where they apply.
+var tracer = otel.Tracer("github.com/jnb666/gpt-go/api")
+
+// span for a chat completion request to the given endpoint
+func (c *Client) startRequestSpan(ctx context.Context, tools []ToolFunction, stream bool) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "chat "+c.ModelName, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("gen_ai.operation.name", "chat"),
+		attribute.String("gen_ai.provider.name", c.Provider.Name()),
+		attribute.String("gen_ai.request.model", c.ModelName),
+		attribute.String("server.address", c.BaseURL),
+		attribute.Int("gpt.request.tools", len(tools)),
+		attribute.Bool("gpt.request.stream", stream),
+	))
+}
+
+func endRequestSpan(span trace.Span, resp Completion, err error) {
+	span.SetAttributes(
+		attribute.String("gen_ai.response.model", resp.Model),
+		attribute.Int64("gen_ai.usage.input_tokens", resp.Usage.PromptTokens),
+		attribute.Int64("gen_ai.usage.output_tokens", resp.Usage.CompletionTokens),
+		attribute.Int64("gpt.usage.cached_tokens", resp.Usage.PromptTokensDetails.CachedTokens),
+		attribute.Int64("gpt.usage.reasoning_tokens", resp.Usage.CompletionTokensDetails.ReasoningTokens),
+		attribute.Int("gpt.response.tool_calls", len(resp.ToolCalls)),
+	)
+	endSpan(span, err)
+}
+
+// record error if not nil and end the span
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// span for a user turn which is the parent of the API call and tool call spans
+func startTurnSpan(ctx context.Context, conv Conversation) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "chat_turn", trace.WithAttributes(
+		attribute.String("gen_ai.conversation.id", conv.ID),
+		attribute.Int("gpt.request.messages", len(conv.Messages)),
+	))
+}
+
+func endTurnSpan(span trace.Span, stats Stats, err error) {
+	span.SetAttributes(
+		attribute.Int("gpt.turn.api_calls", stats.ApiCalls),
+		attribute.Int("gpt.turn.tool_calls", stats.ToolCalls),
+		attribute.Int("gpt.turn.tool_errors", stats.ToolErrors),
+		attribute.Int("gpt.turn.retries", stats.Retries),
+		attribute.Int("gen_ai.usage.input_tokens", stats.PromptTokens),
+		attribute.Int("gen_ai.usage.output_tokens", stats.CompletionTokens),
+		attribute.StringSlice("gpt.turn.limits", stats.Limits),
+	)
+	if stats.Cost > 0 {
+		span.SetAttributes(attribute.Float64("gpt.turn.cost_usd", stats.Cost))
+	}
+	endSpan(span, err)
+}
+
+// span for a tool call - the context is passed to tools which implement ContextTool
+func startToolSpan(ctx context.Context, call openai.ChatCompletionMessageToolCallUnion) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "execute_tool "+call.Function.Name, trace.WithAttributes(
+		attribute.String("gen_ai.operation.name", "execute_tool"),
+		attribute.String("gen_ai.tool.name", call.Function.Name),
+		attribute.String("gen_ai.tool.call.id", call.ID),
+		attribute.Int("gpt.tool.arguments_size", len(call.Function.Arguments)),
+	))
+}
+
+// tool call was not run - the error message returned to the model is recorded as the span status
+func rejectToolSpan(span trace.Span, resp string) string {
+	span.SetAttributes(attribute.Bool("gpt.tool.rejected", true))
+	span.SetStatus(codes.Error, resp)
+	span.End()
+	return resp
+}
@@ -0,0 +1,63 @@
+package api_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jnb666/gpt-go/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTraceSpans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	var toolSpan trace.SpanContext
+	tool := api.NewContextTool("get_forecast", "Get weather forecast.", func(ctx context.Context, args forecastArgs) (string, error) {
+		toolSpan = trace.SpanContextFromContext(ctx)
+		return forecast(args)
+	})
+	client := testClient(t,
+		jsonResponse(toolCallResponse(
+			toolCall{"call_1", "get_forecast", `{"location":"Paris"}`},
+			toolCall{"call_2", "unknown_tool", `{}`},
+		)),
+		jsonResponse(contentResponse("Paris is sunny")),
+	)
+	conv := newTestConversation(tool)
+	_, err := client.ChatCompletion(t.Context(), conv, discard, nil, tool)
+	require.NoError(t, err)
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+	require.Len(t, recorder.Ended(), 5)
+	turn, request, call, unknown := spans["chat_turn"], spans["chat test-model"], spans["execute_tool get_forecast"], spans["execute_tool unknown_tool"]
+	require.NotNil(t, turn)
+	require.NotNil(t, request)
+	require.NotNil(t, call)
+	require.NotNil(t, unknown)
+
+	assert.Contains(t, turn.Attributes(), attribute.String("gen_ai.conversation.id", conv.ID))
+	assert.Contains(t, turn.Attributes(), attribute.Int("gpt.turn.api_calls", 2))
+	assert.Equal(t, trace.SpanKindClient, request.SpanKind())
+	assert.Equal(t, turn.SpanContext().SpanID(), request.Parent().SpanID())
+	assert.Contains(t, request.Attributes(), attribute.String("gen_ai.request.model", "test-model"))
+	assert.Contains(t, request.Attributes(), attribute.Int64("gen_ai.usage.output_tokens", 5))
+
+	assert.Equal(t, turn.SpanContext().SpanID(), call.Parent().SpanID())
+	assert.Equal(t, call.SpanContext().SpanID(), toolSpan.SpanID())
+	assert.Contains(t, call.Attributes(), attribute.String("gen_ai.tool.call.id", "call_1"))
+	assert.Contains(t, call.Attributes(), attribute.Int("gpt.tool.arguments_size", len(`{"location":"Paris"}`)))
+	assert.Equal(t, codes.Unset, call.Status().Code)
+	assert.Equal(t, codes.Error, unknown.Status().Code)
+	assert.Contains(t, unknown.Attributes(), attribute.Bool("gpt.tool.rejected", true))
+}
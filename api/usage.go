@@ -0,0 +1,191 @@
+package api
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/openai/openai-go/v3"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// Price per million tokens by model name used to calculate Stats.Cost - see LoadPrices
+	Prices = map[string]Price{}
+	// If set then the usage from each API call is appended to the ledger
+	Ledger *UsageLedger
+)
+
+// Price per million tokens in USD. Cached prompt tokens are charged at the input price if CachedInput is not set.
+type Price struct {
+	Input       float64 `json:"input"`
+	CachedInput float64 `json:"cached_input,omitzero"`
+	Output      float64 `json:"output"`
+}
+
+// Load price table from JSON file with a map from model name to Price. It is not an error if the file does not exist.
+func LoadPrices(filename string) error {
+	data, err := os.ReadFile(filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &Prices)
+}
+
+// Cost of an API call in USD. The cost reported by the provider is used if included in the usage info - e.g. from
+// OpenRouter - else it is calculated from the price table. Returns zero if the price for the model is not known.
+func Cost(model string, u openai.CompletionUsage) float64 {
+	var reported struct {
+		Cost float64 `json:"cost"`
+	}
+	if json.Unmarshal([]byte(u.RawJSON()), &reported) == nil && reported.Cost > 0 {
+		return reported.Cost
+	}
+	p, ok := Prices[model]
+	if !ok {
+		return 0
+	}
+	cached := u.PromptTokensDetails.CachedTokens
+	cost := float64(u.PromptTokens-cached)*p.Input + float64(cached)*cmp.Or(p.CachedInput, p.Input) + float64(u.CompletionTokens)*p.Output
+	return cost / 1e6
+}
+
+// Usage info for a single API call
+type Usage struct {
+	Time             time.Time `json:"time"`
+	Conversation     string    `json:"conversation,omitzero"`
+	Provider         string    `json:"provider"`
+	Model            string    `json:"model"`
+	PromptTokens     int       `json:"prompt_tokens"`
+	CachedTokens     int       `json:"cached_tokens,omitzero"`
+	CompletionTokens int       `json:"completion_tokens"`
+	ReasoningTokens  int       `json:"reasoning_tokens,omitzero"` // estimated from the reasoning text if not reported
+	Cost             float64   `json:"cost,omitzero"`
+}
+
+func newUsage(conversation, provider, model string, u openai.CompletionUsage) Usage {
+	return Usage{
+		Time:             time.Now(),
+		Conversation:     conversation,
+		Provider:         provider,
+		Model:            model,
+		PromptTokens:     int(u.PromptTokens),
+		CachedTokens:     int(u.PromptTokensDetails.CachedTokens),
+		CompletionTokens: int(u.CompletionTokens),
+		ReasoningTokens:  int(u.CompletionTokensDetails.ReasoningTokens),
+		Cost:             Cost(model, u),
+	}
+}
+
+// Persistent log of usage info stored as a JSON lines file
+type UsageLedger struct {
+	mu       sync.Mutex
+	filename string
+}
+
+func NewUsageLedger(filename string) *UsageLedger {
+	return &UsageLedger{filename: filename}
+}
+
+// Append usage to the ledger file
+func (l *UsageLedger) Add(u Usage) error {
+	data, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f, err := os.OpenFile(l.filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(data, '\n'))
+	return errors.Join(err, f.Close())
+}
+
+// Read all the entries from the ledger file. Lines which cannot be parsed are skipped.
+func (l *UsageLedger) Read() (list []Usage, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f, err := os.Open(l.filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var u Usage
+		if json.Unmarshal(scanner.Bytes(), &u) == nil {
+			list = append(list, u)
+		}
+	}
+	return list, scanner.Err()
+}
+
+// Total usage for a set of API calls
+type UsageTotal struct {
+	ApiCalls         int     `json:"api_calls"`
+	PromptTokens     int     `json:"prompt_tokens"`
+	CachedTokens     int     `json:"cached_tokens"`
+	CompletionTokens int     `json:"completion_tokens"`
+	ReasoningTokens  int     `json:"reasoning_tokens"`
+	Cost             float64 `json:"cost"`
+}
+
+func (t *UsageTotal) add(u Usage) {
+	t.ApiCalls++
+	t.PromptTokens += u.PromptTokens
+	t.CachedTokens += u.CachedTokens
+	t.CompletionTokens += u.CompletionTokens
+	t.ReasoningTokens += u.ReasoningTokens
+	t.Cost += u.Cost
+}
+
+// Usage totals grouped by model, day in local time (YYYY-MM-DD format) and conversation ID
+type UsageReport struct {
+	Total          UsageTotal            `json:"total"`
+	ByModel        map[string]UsageTotal `json:"by_model"`
+	ByDay          map[string]UsageTotal `json:"by_day"`
+	ByConversation map[string]UsageTotal `json:"by_conversation"`
+}
+
+// Summarize list of usage entries
+func NewUsageReport(list []Usage) UsageReport {
+	r := UsageReport{ByModel: map[string]UsageTotal{}, ByDay: map[string]UsageTotal{}, ByConversation: map[string]UsageTotal{}}
+	for _, u := range list {
+		r.Total.add(u)
+		addTotal(r.ByModel, u.Model, u)
+		addTotal(r.ByDay, u.Time.Local().Format(time.DateOnly), u)
+		if u.Conversation != "" {
+			addTotal(r.ByConversation, u.Conversation, u)
+		}
+	}
+	return r
+}
+
+func addTotal(m map[string]UsageTotal, key string, u Usage) {
+	t := m[key]
+	t.add(u)
+	m[key] = t
+}
+
+// record usage from an API call in the ledger if set
+func recordUsage(u Usage) {
+	if Ledger == nil {
+		return
+	}
+	if err := Ledger.Add(u); err != nil {
+		log.Error("error writing usage ledger: ", err)
+	}
+}
@@ -0,0 +1,59 @@
+package api_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/jnb666/gpt-go/api"
+	"github.com/openai/openai-go/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUsageLedger(t *testing.T) {
+	tool := api.NewTool("get_forecast", "Get weather forecast.", forecast)
+	client := testClient(t,
+		jsonResponse(toolCallResponse(toolCall{"call_1", "get_forecast", `{"location":"Paris"}`})),
+		jsonResponse(`{"model":"other-model","choices":[{"index":0,"finish_reason":"stop","message":{"role":"assistant","content":"Sunny"}}],
+			"usage":{"prompt_tokens":1000,"completion_tokens":100,"prompt_tokens_details":{"cached_tokens":600},
+			"completion_tokens_details":{"reasoning_tokens":40},"cost":0.5}}`),
+	)
+	api.Prices = map[string]api.Price{"test-model": {Input: 1, CachedInput: 0.1, Output: 10}}
+	api.Ledger = api.NewUsageLedger(filepath.Join(t.TempDir(), "usage.jsonl"))
+	t.Cleanup(func() { api.Prices, api.Ledger = map[string]api.Price{}, nil })
+
+	conv := newTestConversation(tool)
+	var stats api.Stats
+	_, err := client.ChatCompletion(t.Context(), conv, discard, func(s api.Stats) { stats = s }, tool)
+	require.NoError(t, err)
+	// 10 prompt tokens at $1 per million + 5 completion tokens at $10 per million, then $0.5 reported by server
+	assert.InDelta(t, 0.50006, stats.Cost, 1e-9)
+	assert.Equal(t, 600, stats.CachedTokens)
+	assert.Equal(t, 40, stats.ReasoningTokens)
+
+	list, err := api.Ledger.Read()
+	require.NoError(t, err)
+	require.Len(t, list, 2)
+	assert.Equal(t, conv.ID, list[0].Conversation)
+	assert.Equal(t, "openrouter", list[0].Provider)
+	assert.Equal(t, "test-model", list[0].Model)
+	assert.Equal(t, 600, list[1].CachedTokens)
+
+	report := api.NewUsageReport(list)
+	assert.Equal(t, 2, report.Total.ApiCalls)
+	assert.Equal(t, 1010, report.Total.PromptTokens)
+	assert.Equal(t, 1, report.ByModel["other-model"].ApiCalls)
+	assert.InDelta(t, 0.50006, report.ByConversation[conv.ID].Cost, 1e-9)
+	assert.NotEmpty(t, report.ByDay)
+}
+
+func TestCost(t *testing.T) {
+	api.Prices = map[string]api.Price{"model-a": {Input: 2, Output: 8}, "model-b": {Input: 2, CachedInput: 0.5, Output: 8}}
+	t.Cleanup(func() { api.Prices = map[string]api.Price{} })
+
+	// all of the prompt tokens are cached
+	u := openai.CompletionUsage{PromptTokens: 1000, CompletionTokens: 250, PromptTokensDetails: openai.CompletionUsagePromptTokensDetails{CachedTokens: 1000}}
+	assert.InDelta(t, 0.004, api.Cost("model-a", u), 1e-9)
+	assert.InDelta(t, 0.0025, api.Cost("model-b", u), 1e-9)
+	assert.Zero(t, api.Cost("model-c", u))
+}
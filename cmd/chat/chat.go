@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"cmp"
 	"context"
 	"flag"
 	"fmt"
@@ -9,28 +10,47 @@ import (
 	"strings"
 
 	"github.com/jnb666/gpt-go/api"
+	"github.com/jnb666/gpt-go/tracing"
 	log "github.com/sirupsen/logrus"
 )
 
 func main() {
-	var debug, nostream bool
+	var debug, nostream, responses bool
 	var systemPrompt, reasoning, modelName string
-	var endpoint int
+	var endpoint, fallback, otelExporter string
 	flag.StringVar(&reasoning, "reasoning", "medium", "set reasoning - none, low, medium or high")
 	flag.StringVar(&systemPrompt, "system", "", "set custom system prompt")
 	flag.BoolVar(&debug, "debug", false, "enable debug logging")
 	flag.BoolVar(&api.TraceRequests, "trace", false, "trace request and response messages")
 	flag.BoolVar(&nostream, "nostream", false, "don't stream responses")
-	flag.IntVar(&endpoint, "endpoint", 0, "openai server endpoint to use: 0=LlamaCPP 1=vLLM 2=OpenRouter 3=Cerebras")
+	flag.StringVar(&endpoint, "endpoint", cmp.Or(api.GetServer(), api.LlamaCPP), "openai server endpoint to use: "+strings.Join(api.Providers(), ", "))
+	flag.BoolVar(&responses, "responses", false, "use the responses API instead of chat completions")
+	flag.StringVar(&fallback, "fallback", "", "comma separated list of provider[:model] endpoints to use if request fails")
 	flag.StringVar(&modelName, "model", "", "model name - optional for local server")
+	flag.StringVar(&otelExporter, "otel", "", "export OpenTelemetry trace spans: otlp or stdout")
 	flag.Parse()
 	if debug {
 		log.SetLevel(log.DebugLevel)
 	}
-	client, err := api.NewClient(api.Server(endpoint), modelName)
+	if otelExporter != "" {
+		shutdown, err := tracing.Init(context.Background(), otelExporter, "gpt-go-chat")
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer shutdown(context.Background())
+	}
+	endpoints, err := api.ParseEndpoints(fallback)
+	if err != nil {
+		log.Fatal(err)
+	}
+	client, err := api.NewClient(endpoint, modelName)
 	if err != nil {
 		log.Fatal(err)
 	}
+	client.ResponsesAPI = responses
+	if err = client.AddFallback(endpoints...); err != nil {
+		log.Fatal(err)
+	}
 	cfg := api.DefaultConfig()
 	cfg.ReasoningEffort = reasoning
 	if systemPrompt != "" {
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"cmp"
 	"context"
 	"flag"
 	"fmt"
@@ -19,12 +20,14 @@ var useWeather, useBrowser, usePython bool
 
 func main() {
 	var modelName string
-	var debug, nostream bool
-	var endpoint int
+	var debug, nostream, responses bool
+	var endpoint, fallback string
 	flag.BoolVar(&debug, "debug", false, "enable debug logging")
 	flag.BoolVar(&api.TraceRequests, "trace", false, "trace request and response messages")
 	flag.BoolVar(&nostream, "nostream", false, "don't stream responses")
-	flag.IntVar(&endpoint, "endpoint", 0, "openai server endpoint to use: 0=LlamaCPP 1=vLLM 2=OpenRouter 3=Cerebras")
+	flag.StringVar(&endpoint, "endpoint", cmp.Or(api.GetServer(), api.LlamaCPP), "openai server endpoint to use: "+strings.Join(api.Providers(), ", "))
+	flag.BoolVar(&responses, "responses", false, "use the responses API instead of chat completions")
+	flag.StringVar(&fallback, "fallback", "", "comma separated list of provider[:model] endpoints to use if request fails")
 	flag.StringVar(&modelName, "model", "", "model name - optional for local server")
 	flag.BoolVar(&useWeather, "weather", false, "enable weather tool")
 	flag.BoolVar(&useBrowser, "browser", false, "enable browser tool")
@@ -33,10 +36,18 @@ func main() {
 	if debug {
 		log.SetLevel(log.DebugLevel)
 	}
-	client, err := api.NewClient(api.Server(endpoint), modelName)
+	endpoints, err := api.ParseEndpoints(fallback)
 	if err != nil {
 		log.Fatal(err)
 	}
+	client, err := api.NewClient(endpoint, modelName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	client.ResponsesAPI = responses
+	if err = client.AddFallback(endpoints...); err != nil {
+		log.Fatal(err)
+	}
 	tools, browse, pyexec := initTools()
 	defer browse.Close()
 	defer pyexec.Stop()
@@ -100,7 +111,7 @@ func printOutputFunc(browse *browser.Browser) api.CallbackFunc {
 		if index == 0 {
 			fmt.Printf("\n== %s ==\n", channel)
 		}
-		if end && browse != nil {
+		if end && channel == "final" && browse != nil {
 			fmt.Println("== postprocessed ==")
 			fmt.Print(browse.Postprocess(content))
 		} else if index == 0 || !end {
@@ -41,6 +41,9 @@ function refreshChatList(model, list, currentID) {
 }
 
 function addMessage(chat, msg, showReasoning) {
+	if (msg.summary && msg.summary.trim()) {
+		addSummary(chat, msg.summary);
+	}
 	if (msg.reasoning && msg.reasoning.trim()) {
 		if (!msg.update) {
 			extendMessageList(chat, msg.role, true, showReasoning, msg.excluded);
@@ -87,6 +90,29 @@ function extendMessageList(chat, role, isReasoning, showReasoning, excluded) {
 	}
 }
 
+function addSummary(chat, summary) {
+	chat.appendChild(newElement("li", "chat-item summary", newElement("div", "msg", newElement("div", "msgpart"))));
+	addContent(chat, `<p class="summary-title">earlier messages replaced by summary:</p>` + summary);
+}
+
+function addApproval(app, call) {
+	const form = newElement("form", "pure-form");
+	form.innerHTML = `<p class="approval-title">approve call to <b>${call.name}</b> function?</p>` +
+		`<textarea name="arguments" rows="${Math.min(call.arguments.split("\n").length, 20)}"></textarea><br>` +
+		`<button name="approve" class="button-small pure-button pure-button-primary">approve</button> ` +
+		`<button name="reject" class="button-small pure-button">reject</button>`;
+	form.arguments.value = call.arguments;
+	const entry = newElement("li", "chat-item approval", newElement("div", "msg", form));
+	form.addEventListener("submit", e => {
+		e.preventDefault();
+		const action = e.submitter.name;
+		app.send({ action: action, id: call.id, arguments: form.arguments.value });
+		entry.remove();
+	});
+	app.chat.appendChild(entry);
+	scrollToEnd();
+}
+
 function addContent(chat, content) {
 	const nodes = chat.querySelectorAll("div.msgpart");
 	if (nodes.length == 0) {
@@ -133,17 +159,27 @@ function showConfig(cfg) {
 	form.presence_penalty.value = cfg.presence_penalty;
 	form.repetition_penalty.value = cfg.repetition_penalty;
 	form.compact_threshold.value = cfg.compact_threshold;
+	form.max_tool_rounds.value = cfg.max_tool_rounds || "";
+	form.max_turn_tokens.value = cfg.max_turn_tokens || "";
+	form.max_turn_time.value = cfg.max_turn_time || "";
 
 	for (const el of radio) {
 		el.checked = (el.value == cfg.reasoning_effort);
 	}
+	for (const el of form.querySelectorAll(`input[name="compact_strategy"]`)) {
+		el.checked = (el.value == (cfg.compact_strategy || "exclude"));
+	}
 	const parent = document.getElementById("tools-list");
 	parent.replaceChildren();
 	if (cfg.tools) {
 		for (const tool of cfg.tools) {
 			const checkbox = newElement("div", "tool-checkbox");
 			const checked = (tool.enabled) ? "checked" : "";
-			checkbox.innerHTML = `<input id="${tool.name}-tool" name="${tool.name}_tool" type="checkbox" ${checked}> <label for="${tool.name}-tool">${tool.name}</label><br>`;
+			checkbox.innerHTML = `<input id="${tool.name}-tool" name="${tool.name}_tool" type="checkbox" ${checked}> <label for="${tool.name}-tool">${tool.name}</label> ` +
+				`<select name="${tool.name}_approval"><option value="auto">auto</option><option value="ask">ask</option><option value="deny">deny</option></select>` +
+				`<input name="${tool.name}_max_calls" type="text" size="3" placeholder="max calls"><br>`;
+			checkbox.querySelector("select").value = tool.approval || "auto";
+			checkbox.querySelector("input[type=text]").value = tool.max_calls || "";
 			parent.appendChild(checkbox);
 		}
 	}
@@ -163,13 +199,32 @@ function updateStats(stats) {
 	const tokensPerSec = 1000 * stats.completion_tokens / stats.api_time;
 	document.getElementById("model-name").textContent = stats.model;
 	document.getElementById("stats-calls").textContent = `${stats.api_calls} API calls in ${duration(stats.api_time)}`;
-	if (stats.tool_calls) {
-		document.getElementById("stats-tools").textContent = `${stats.tool_calls} tool calls in ${duration(stats.tool_time)}`;
+	if (stats.tool_calls || stats.tool_errors || stats.limits) {
+		let text = `${stats.tool_calls} tool calls in ${duration(stats.tool_time)}`;
+		if (stats.tool_errors) {
+			text += ` (${stats.tool_errors} rejected)`;
+		}
+		if (stats.limits) {
+			text += ` - reached ${stats.limits.join(", ")}`;
+		}
+		document.getElementById("stats-tools").textContent = text;
 	} else {
 		document.getElementById("stats-tools").textContent = "";
 	}
-	document.getElementById("stats-tokens").textContent = `${stats.prompt_tokens}+${stats.completion_tokens} tokens`;
-	document.getElementById("stats-speed").textContent = `${tokensPerSec.toFixed(1)} tok/sec`;
+	let tokens = `${stats.prompt_tokens}+${stats.completion_tokens} tokens`;
+	if (stats.reasoning_tokens) {
+		tokens += ` (${stats.reasoning_tokens} reasoning)`;
+	}
+	if (stats.cost) {
+		tokens += ` $${stats.cost.toFixed(4)}`;
+	}
+	document.getElementById("stats-tokens").textContent = tokens;
+	if (stats.prefill_time && stats.api_time > stats.prefill_time) {
+		const decodePerSec = 1000 * stats.completion_tokens / (stats.api_time - stats.prefill_time);
+		document.getElementById("stats-speed").textContent = `TTFT ${duration(stats.ttft)}  ${decodePerSec.toFixed(1)} tok/sec`;
+	} else {
+		document.getElementById("stats-speed").textContent = `${tokensPerSec.toFixed(1)} tok/sec`;
+	}
 }
 
 function initFormControls(app) {
@@ -185,6 +240,10 @@ function initFormControls(app) {
 			presence_penalty: parseFloat(form.presence_penalty.value),
 			repetition_penalty: parseFloat(form.repetition_penalty.value),
 			compact_threshold: parseFloat(form.compact_threshold.value),
+			max_tool_rounds: parseInt(form.max_tool_rounds.value) || 0,
+			max_turn_tokens: parseInt(form.max_turn_tokens.value) || 0,
+			max_turn_time: parseInt(form.max_turn_time.value) || 0,
+			compact_strategy: "exclude",
 			reasoning_effort: "medium",
 			tools: []
 		};
@@ -192,9 +251,14 @@ function initFormControls(app) {
 		for (const el of radio) {
 			if (el.checked) cfg.reasoning_effort = el.value;
 		}
-		const tools = form.querySelectorAll(`.tool-checkbox input`);
+		for (const el of form.querySelectorAll(`input[name="compact_strategy"]`)) {
+			if (el.checked) cfg.compact_strategy = el.value;
+		}
+		const tools = form.querySelectorAll(`.tool-checkbox input[type=checkbox]`);
 		for (const el of tools) {
-			cfg.tools.push({ name: el.name.slice(0, -5), enabled: el.checked });	
+			const approval = el.parentElement.querySelector("select").value;
+			const maxCalls = parseInt(el.parentElement.querySelector("input[type=text]").value) || 0;
+			cfg.tools.push({ name: el.name.slice(0, -5), enabled: el.checked, approval: approval, max_calls: maxCalls });
 		}
 		console.log("update config", cfg);
 		app.send({ action: "config", config: cfg });
@@ -257,10 +321,15 @@ function initInputTextbox(app) {
 	const input = document.getElementById("input-text");
 
 	const submit = function () {
+		if (app.running) {
+			console.log("send stop request");
+			app.send({ action: "stop" });
+			return;
+		}
 		console.log("send add message");
 		showConfigForm(false);
 		const msg = input.value;
-		if (msg.trim() == "") {
+		if (msg.trim() == "" && app.images.length == 0) {
 			input.placeholder = "Please enter a question";
 			input.value = "";
 			return;
@@ -271,9 +340,20 @@ function initInputTextbox(app) {
 		if (!app.showReasoning) {
 			refreshChat(app.chat, false);
 		}
-		addMessage(app.chat, {role: "user", content: `<p>${msg}</p>`});
+		const message = { role: "user", content: msg };
+		let html = `<p>${msg}</p>`;
+		if (app.images.length > 0) {
+			message.parts = [{ type: "text", text: msg }];
+			for (const url of app.images) {
+				message.parts.push({ type: "image", url: url });
+				html += `<img class="chat-image" src="${url}">`;
+			}
+			setImages(app, []);
+		}
+		addMessage(app.chat, {role: "user", content: html});
 		clearStats();
-		app.send({ action: "add", message: { role: "user", content: msg } });
+		app.send({ action: "add", message: message });
+		setRunning(app, true);
 		input.placeholder = "Type a message (Shift+Enter to add a new line)";
 	}
 
@@ -291,11 +371,70 @@ function initInputTextbox(app) {
 		input.setAttribute("class", "input-default");
 	});
 	document.getElementById("send-button").addEventListener("click", submit);
+	initImageUpload(app, input);
+}
+
+// images can be pasted into the input box or selected using the attach button - they are sent as data URLs
+function initImageUpload(app, input) {
+	const fileInput = document.getElementById("image-file");
+
+	const addFiles = function (files) {
+		for (const file of files) {
+			if (!file.type.startsWith("image/")) {
+				continue;
+			}
+			const reader = new FileReader();
+			reader.addEventListener("load", e => setImages(app, [...app.images, reader.result]));
+			reader.readAsDataURL(file);
+		}
+	}
+
+	document.getElementById("attach-button").addEventListener("click", e => fileInput.click());
+	fileInput.addEventListener("change", e => {
+		addFiles(fileInput.files);
+		fileInput.value = "";
+	});
+	input.addEventListener("paste", e => {
+		const files = e.clipboardData.files;
+		if (files.length > 0) {
+			e.preventDefault();
+			addFiles(files);
+		}
+	});
+	document.getElementById("attachments").addEventListener("click", e => {
+		if (e.target.tagName == "IMG") {
+			const index = parseInt(e.target.dataset.index);
+			setImages(app, app.images.filter((_, i) => i != index));
+		}
+	});
+}
+
+// update list of images to send with the next message - click on a thumbnail to remove it
+function setImages(app, images) {
+	app.images = images;
+	const parent = document.getElementById("attachments");
+	parent.replaceChildren();
+	images.forEach((url, i) => {
+		const img = newElement("img");
+		img.src = url;
+		img.title = "click to remove";
+		img.dataset.index = i;
+		parent.appendChild(img);
+	});
+	parent.style.display = (images.length > 0) ? "flex" : "none";
+}
+
+function setRunning(app, on) {
+	app.running = on;
+	const button = document.getElementById("send-button");
+	button.innerHTML = (on) ? `<img src="stop.svg" class="icon"> stop` : `<img src="send.svg" class="icon"> send`;
 }
 
 // Websocket communication with server
 class App {
 	connected = false;
+	running = false;
+	images = [];
 
 	constructor() {
 		this.socket = this.initWebsocket();
@@ -329,18 +468,25 @@ class App {
 		switch (resp.action) {
 			case "add":
 				addMessage(this.chat, resp.message, true);
-				if (resp.message.end && !this.showReasoning) {
-					refreshChat(app.chat, false);
+				if (resp.message.end) {
+					setRunning(this, false);
+					if (!this.showReasoning) {
+						refreshChat(app.chat, false);
+					}
 				}
 				break;
 			case "stats":
 				updateStats(resp.stats);
 				break;
+			case "approve":
+				addApproval(this, resp.call);
+				break;
 			case "list":
 				const id = (resp.conversation) ? resp.conversation.id : "";
 				refreshChatList(resp.model, resp.list, id);
 				break;
 			case "load":
+				setRunning(this, false);
 				loadChat(this.chat, resp.conversation, this.showReasoning);
 				break
 			case "config":
@@ -2,19 +2,24 @@
 package main
 
 import (
+	"cmp"
 	"context"
+	"crypto/sha256"
 	"embed"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"html"
 	"io/fs"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"slices"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -24,39 +29,55 @@ import (
 	"github.com/jnb666/gpt-go/api/tools/python"
 	"github.com/jnb666/gpt-go/api/tools/weather"
 	"github.com/jnb666/gpt-go/markdown"
+	"github.com/jnb666/gpt-go/metrics"
 	"github.com/jnb666/gpt-go/scrape"
+	"github.com/jnb666/gpt-go/tracing"
 	log "github.com/sirupsen/logrus"
 )
 
 const MaxConversations = 30
 
+var wsConnections = metrics.NewGauge("gpt_websocket_connections", "Number of open websocket connections.")
+
 var DataDir = getDataDir()
 
+// Images uploaded with user messages are saved here and referenced from the conversation by file path
+var ImageDir = filepath.Join(DataDir, "images")
+
 //go:embed assets
 var assets embed.FS
 
 var upgrader websocket.Upgrader
 
-var debug, nostream bool
-var cdpEndpoint, modelName string
-var apiServer = api.GetServer()
+var debug, nostream, responses bool
+var cdpEndpoint, modelName, apiServer string
+var fallbacks []api.Endpoint
 
 func main() {
 	var server http.Server
-	var endpoint int
 	flag.BoolVar(&debug, "debug", false, "enable debug logging")
 	flag.BoolVar(&api.TraceRequests, "trace", false, "trace request and response messages")
 	flag.BoolVar(&nostream, "nostream", false, "don't stream responses")
-	flag.IntVar(&endpoint, "endpoint", int(apiServer), "openai server endpoint to use: 0=LlamaCPP 1=vLLM 2=OpenRouter 3=Cerebras")
+	flag.StringVar(&apiServer, "endpoint", cmp.Or(api.GetServer(), api.LlamaCPP), "openai server endpoint to use: "+strings.Join(api.Providers(), ", "))
+	flag.BoolVar(&responses, "responses", false, "use the responses API instead of chat completions")
+	fallback := flag.String("fallback", "", "comma separated list of provider[:model] endpoints to use if request fails - set {PROVIDER}_BASE_URL and {PROVIDER}_API_KEY env to override defaults")
 	flag.StringVar(&modelName, "model", "", "model name - optional for local server")
 	flag.StringVar(&server.Addr, "server", ":8000", "web server address")
 	flag.StringVar(&cdpEndpoint, "cdp", "", "connect to browser at this chrome dev tools endpoint if set")
+	otelExporter := flag.String("otel", "", "export OpenTelemetry trace spans: otlp or stdout - set OTEL_EXPORTER_OTLP_ENDPOINT env for otlp")
 	flag.Parse()
 
 	log.SetFormatter(&log.TextFormatter{ForceColors: true})
 	if debug {
 		log.SetLevel(log.DebugLevel)
 	}
+	var err error
+	if _, err = api.GetProvider(apiServer); err != nil {
+		log.Fatal(err)
+	}
+	if fallbacks, err = api.ParseEndpoints(*fallback); err != nil {
+		log.Fatal(err)
+	}
 	if api.TraceRequests {
 		f, err := os.Create("trace.log")
 		if err == nil {
@@ -64,11 +85,24 @@ func main() {
 			api.TraceTo = f
 		}
 	}
-	apiServer = api.Server(endpoint)
+
+	if err := api.LoadPrices(filepath.Join(DataDir, "prices.json")); err != nil {
+		log.Fatal("error loading prices: ", err)
+	}
+	api.Ledger = api.NewUsageLedger(filepath.Join(DataDir, "usage.jsonl"))
+	shutdownTracing := func(context.Context) error { return nil }
+	if *otelExporter != "" {
+		if shutdownTracing, err = tracing.Init(context.Background(), *otelExporter, "gpt-go-webchat"); err != nil {
+			log.Fatal(err)
+		}
+	}
 
 	http.Handle("/", fsHandler())
 	ctx, wsCancel := context.WithCancel(context.Background())
 	http.HandleFunc("/websocket", websocketHandler(ctx))
+	http.HandleFunc("/usage", usageHandler)
+	http.Handle("/metrics", metrics.Handler())
+	http.Handle("/images/", http.StripPrefix("/images/", http.FileServer(http.Dir(ImageDir))))
 
 	// launch web server in background
 	go func() {
@@ -95,22 +129,29 @@ func main() {
 	if err := server.Shutdown(shutdownCtx); err != nil {
 		log.Fatal("HTTP shutdown error: ", err)
 	}
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		log.Error("tracing shutdown error: ", err)
+	}
 	time.Sleep(time.Second)
 	log.Info("server shutdown")
 }
 
 // connection state for websocket
 type Connection struct {
-	conn      *websocket.Conn
-	client    api.Client
-	tools     []api.ToolFunction
-	browser   *browser.Browser
-	python    *python.Python
-	content   string
-	analysis  string
-	first     bool
-	numTokens int
-	toolCalls int
+	conn       *websocket.Conn
+	mu         sync.Mutex
+	cancel     context.CancelFunc
+	client     api.Client
+	tools      []api.ToolFunction
+	browser    *browser.Browser
+	python     *python.Python
+	content    string
+	analysis   string
+	toolOutput string
+	approvals  chan api.Request
+	first      bool
+	numTokens  int
+	toolCalls  int
 }
 
 type Message struct {
@@ -118,6 +159,12 @@ type Message struct {
 	err error
 }
 
+// result from completed or cancelled chat turn
+type Result struct {
+	conv api.Conversation
+	err  error
+}
+
 // handler for websocket connections
 func websocketHandler(ctx context.Context) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -127,10 +174,19 @@ func websocketHandler(ctx context.Context) http.HandlerFunc {
 			return
 		}
 		defer conn.Close()
+		wsConnections.Inc()
+		defer wsConnections.Dec()
 
-		c := &Connection{conn: conn}
+		c := &Connection{conn: conn, approvals: make(chan api.Request, 1)}
+		// server may be down - context length is read again on the first request
 		if c.client, err = api.NewClient(apiServer, modelName); err != nil {
-			log.Fatal(err)
+			log.Warnf("%s server: %v", apiServer, err)
+		}
+		c.client.ResponsesAPI = responses
+		c.client.Approve = c.approve
+		if err = c.client.AddFallback(fallbacks...); err != nil {
+			log.Error(err)
+			return
 		}
 		c.browser, c.python, c.tools = initTools()
 		defer c.browser.Close()
@@ -160,31 +216,61 @@ func pollWebsocket(conn *websocket.Conn, ch chan Message) {
 	}
 }
 
-func readMsg(ctx context.Context, ch chan Message) (req api.Request, err error) {
-	for {
-		select {
-		case <-ctx.Done():
-			return req, ctx.Err()
-		case msg := <-ch:
-			return msg.req, msg.err
-		}
-	}
-}
-
 func (c *Connection) handleWebsocket(ctx context.Context, cfg api.Config) error {
 	conv := api.NewConversation(cfg)
 	ch := make(chan Message)
+	done := make(chan Result)
 	go pollWebsocket(c.conn, ch)
+	defer c.stop(done)
 	for {
-		req, err := readMsg(ctx, ch)
-		if err != nil {
-			return err
+		var req api.Request
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case res := <-done:
+			c.cancel = nil
+			if res.err != nil {
+				return res.err
+			}
+			conv = res.conv
+			continue
+		case msg := <-ch:
+			if msg.err != nil {
+				return msg.err
+			}
+			req = msg.req
+		}
+		if req.Action != "list" && req.Action != "stop" && req.Action != "approve" && req.Action != "reject" {
+			// cancel current turn before modifying the conversation
+			if res, ok := c.stop(done); ok {
+				if res.err != nil {
+					return res.err
+				}
+				conv = res.conv
+			}
 		}
+		var err error
 		switch req.Action {
 		case "list":
 			err = c.listChats(conv.ID)
 		case "add":
-			conv, err = c.addMessage(conv, req.Message)
+			var turnCtx context.Context
+			turnCtx, c.cancel = context.WithCancel(ctx)
+			go func(conv api.Conversation) {
+				conv, err := c.addMessage(turnCtx, conv, req.Message)
+				done <- Result{conv: conv, err: err}
+			}(conv)
+		case "approve", "reject":
+			select {
+			case c.approvals <- req:
+			default:
+				log.Warnf("ignoring %s request: id=%s", req.Action, req.ID)
+			}
+		case "stop":
+			if c.cancel != nil {
+				log.Info("stop current request")
+				c.cancel()
+			}
 		case "load":
 			conv, err = c.loadChat(req.ID, cfg)
 		case "delete":
@@ -200,6 +286,17 @@ func (c *Connection) handleWebsocket(ctx context.Context, cfg api.Config) error
 	}
 }
 
+// cancel the current chat turn if running and wait for it to complete
+func (c *Connection) stop(done chan Result) (res Result, ok bool) {
+	if c.cancel == nil {
+		return res, false
+	}
+	c.cancel()
+	res = <-done
+	c.cancel = nil
+	return res, true
+}
+
 // initialise supported tools
 func initTools() (browse *browser.Browser, pyexec *python.Python, tools []api.ToolFunction) {
 	pyexec = python.New()
@@ -234,13 +331,17 @@ func (c *Connection) listChats(currentID string) error {
 	if err != nil {
 		return err
 	}
-	return c.conn.WriteJSON(resp)
+	return c.send(resp)
 }
 
-// add new message from user to chat, get streaming response, returns updated message list
-func (c *Connection) addMessage(conv api.Conversation, msg api.Message) (api.Conversation, error) {
+// add new message from user to chat, get streaming response, returns updated message list.
+// If the context is cancelled then the partial response is saved.
+func (c *Connection) addMessage(ctx context.Context, conv api.Conversation, msg api.Message) (api.Conversation, error) {
 	newChat := len(conv.Messages) == 0
-	log.Infof("add message: %q", msg.Content)
+	log.Infof("add message: %q with %d images", msg.Content, msg.Images())
+	if msg.Parts = saveImages(msg.Parts); msg.Images() == 0 {
+		msg.Parts = nil
+	}
 	conv.Messages = append(conv.Messages, msg)
 
 	c.content = ""
@@ -249,7 +350,6 @@ func (c *Connection) addMessage(conv api.Conversation, msg api.Message) (api.Con
 	c.toolCalls = 0
 	c.python.Stop()
 
-	ctx := context.Background()
 	var msgs []api.Message
 	var err error
 	if nostream {
@@ -257,7 +357,12 @@ func (c *Connection) addMessage(conv api.Conversation, msg api.Message) (api.Con
 	} else {
 		msgs, err = c.client.ChatCompletionStream(ctx, conv, c.sendUpdate, c.updateStats, c.tools...)
 	}
-	if err != nil {
+	if errors.Is(err, context.Canceled) {
+		log.Warnf("request cancelled: saving %d partial messages", len(msgs))
+		if n := len(msgs); n > 0 && msgs[n-1].Role == "assistant" && len(msgs[n-1].ToolCall) == 0 {
+			c.content = msgs[n-1].Content
+		}
+	} else if err != nil {
 		return conv, err
 	}
 	if c.browser != nil && len(c.browser.Docs()) > 0 {
@@ -269,13 +374,6 @@ func (c *Connection) addMessage(conv api.Conversation, msg api.Message) (api.Con
 	}
 	conv.Messages = append(conv.Messages, msgs...)
 	conv.NumTokens = c.numTokens
-	if c.toolCalls > 0 && c.browser != nil {
-		if data, err := json.Marshal(c.browser); err == nil {
-			conv.ToolData["browser"] = data
-		} else {
-			log.Errorf("error saving browser data:", err)
-		}
-	}
 	err = saveJSON(conv.ID, conv)
 	if err == nil && newChat {
 		err = c.listChats(conv.ID)
@@ -291,11 +389,40 @@ func (c *Connection) updateStats(stats api.Stats) {
 		c.toolCalls = stats.ToolCalls
 	}
 	c.numTokens = stats.PromptTokens + stats.CompletionTokens
-	if err := c.conn.WriteJSON(api.Response{Action: "stats", Stats: stats}); err != nil {
+	if err := c.send(api.Response{Action: "stats", Stats: stats}); err != nil {
 		log.Error(err)
 	}
 }
 
+// ask user to approve tool call and wait for the response - called from the chat turn
+func (c *Connection) approve(ctx context.Context, call api.ToolCall) (approval api.Approval, err error) {
+	// discard any reply to an earlier request which was cancelled
+	select {
+	case <-c.approvals:
+	default:
+	}
+	info := api.ToolCallInfo{ID: call.ID, Name: call.Name, Arguments: api.Pretty(json.RawMessage(call.Arguments))}
+	if err = c.send(api.Response{Action: "approve", Call: info}); err != nil {
+		return approval, err
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return approval, ctx.Err()
+		case req := <-c.approvals:
+			if req.ID != call.ID {
+				log.Warnf("ignoring %s request: id=%s - expecting %s", req.Action, req.ID, call.ID)
+				continue
+			}
+			approval.Approved = req.Action == "approve"
+			if approval.Approved && req.Arguments != info.Arguments {
+				approval.Arguments = req.Arguments
+			}
+			return approval, nil
+		}
+	}
+}
+
 // chat completion stream callback to send updates to front end
 func (c *Connection) sendUpdate(channel, text string, index int, end bool) {
 	r := api.Response{Action: "add"}
@@ -306,8 +433,15 @@ func (c *Connection) sendUpdate(channel, text string, index int, end bool) {
 		c.analysis += text
 		r.Message.Reasoning = toHTML(c.analysis, "assistant")
 	case "tool":
+		// partial output from a running tool is replaced by the complete request and response when it ends
+		if end || index == 0 {
+			c.toolOutput = text
+		} else {
+			c.toolOutput += text
+		}
 		r.Message.Role = "tool"
-		r.Message.Content = toHTML(text, "tool")
+		r.Message.Update = index > 0
+		r.Message.Content = toHTML(c.toolOutput, "tool")
 		c.analysis = ""
 	case "final":
 		if end {
@@ -329,11 +463,18 @@ func (c *Connection) sendUpdate(channel, text string, index int, end bool) {
 		log.Errorf("invalid channel %q", channel)
 		return
 	}
-	if err := c.conn.WriteJSON(r); err != nil {
+	if err := c.send(r); err != nil {
 		log.Error(err)
 	}
 }
 
+// send response to front end - may be called concurrently from the chat turn and the request loop
+func (c *Connection) send(resp api.Response) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn.WriteJSON(resp)
+}
+
 // load conversation with given id, or new conversation if blank
 func (c *Connection) loadChat(id string, cfg api.Config) (conv api.Conversation, err error) {
 	log.Infof("load chat: id=%s", id)
@@ -342,10 +483,9 @@ func (c *Connection) loadChat(id string, cfg api.Config) (conv api.Conversation,
 		if err = loadJSON(id, &conv); err != nil {
 			return conv, err
 		}
-		if c.browser != nil && len(conv.ToolData) > 0 {
-			if err = json.Unmarshal(conv.ToolData["browser"], &c.browser); err != nil {
-				log.Errorf("Error loading browser data: %s", err)
-			}
+		// tool state is loaded and saved by the chat completion
+		if conv.ToolData == nil {
+			conv.ToolData = map[string]json.RawMessage{}
 		}
 		for _, tool := range cfg.Tools {
 			if !slices.ContainsFunc(conv.Config.Tools, func(t api.ToolConfig) bool { return t.Name == tool.Name }) {
@@ -357,11 +497,13 @@ func (c *Connection) loadChat(id string, cfg api.Config) (conv api.Conversation,
 	}
 	resp := api.Response{Action: "load", Conversation: api.Conversation{ID: conv.ID}}
 	for _, msg := range conv.Messages {
-		msg.Content = toHTML(msg.Content, msg.Role)
+		msg.Content = toHTML(msg.Content, msg.Role) + imagesHTML(msg.Parts)
+		msg.Parts = nil
 		msg.Reasoning = toHTML(msg.Reasoning, msg.Role)
+		msg.Summary = toHTML(msg.Summary, "assistant")
 		resp.Conversation.Messages = append(resp.Conversation.Messages, msg)
 	}
-	err = c.conn.WriteJSON(resp)
+	err = c.send(resp)
 	return conv, err
 }
 
@@ -372,6 +514,7 @@ func (c *Connection) deleteChat(id string, cfg api.Config) (conv api.Conversatio
 	if err != nil {
 		return conv, err
 	}
+	api.DeleteConversationStore(id)
 	err = c.listChats(conv.ID)
 	if err != nil {
 		return conv, err
@@ -388,7 +531,7 @@ func (c *Connection) configOptions(conv api.Conversation, cfg, update *api.Confi
 			conv.Config = *cfg
 		}
 		resp := api.Response{Action: "config", Config: conv.Config}
-		err = c.conn.WriteJSON(resp)
+		err = c.send(resp)
 	} else {
 		if len(conv.Messages) == 0 {
 			log.Infof("update default config: %#v", update)
@@ -403,6 +546,20 @@ func (c *Connection) configOptions(conv api.Conversation, cfg, update *api.Confi
 	return conv, err
 }
 
+// usage totals by model, day and conversation from the ledger as JSON
+func usageHandler(w http.ResponseWriter, r *http.Request) {
+	list, err := api.Ledger.Read()
+	if err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(api.NewUsageReport(list)); err != nil {
+		log.Error(err)
+	}
+}
+
 // list of saved conversation files
 func getSavedConversations() (list []api.Item, err error) {
 	entries, err := os.ReadDir(DataDir)
@@ -457,6 +614,69 @@ func toHTML(content, role string) string {
 	return "<p>" + strings.ReplaceAll(content, "\n", "<br>") + "</p>"
 }
 
+// Image types which can be uploaded - the type is detected from the data and mapped to the file extension
+var imageTypes = map[string]string{"image/png": "png", "image/jpeg": "jpg", "image/gif": "gif", "image/webp": "webp"}
+
+// Check content parts from a client message. Images sent as data URLs are saved to a file in ImageDir and replaced
+// with a reference to the file - the file name is the content hash so the same image is only saved once. File
+// references from the client are not trusted and images which are not one of the imageTypes or an http(s) URL are
+// dropped.
+func saveImages(parts []api.ContentPart) (list []api.ContentPart) {
+	for _, p := range parts {
+		switch {
+		case p.Type == "text":
+			list = append(list, api.TextPart(p.Text))
+		case p.Type != "image":
+			log.Warnf("ignoring %q content part", p.Type)
+		case strings.HasPrefix(p.URL, "http://") || strings.HasPrefix(p.URL, "https://"):
+			list = append(list, api.ImagePart(p.URL))
+		case strings.HasPrefix(p.URL, "data:"):
+			filename, err := saveImage(p.URL)
+			if err != nil {
+				log.Errorf("error saving image: %v", err)
+				continue
+			}
+			list = append(list, api.ImageFile(filename))
+		default:
+			log.Warnf("ignoring image part: url=%.40q file=%q", p.URL, p.File)
+		}
+	}
+	return list
+}
+
+func saveImage(dataURL string) (string, error) {
+	_, data, err := api.DecodeDataURL(dataURL)
+	if err != nil {
+		return "", err
+	}
+	mediaType := http.DetectContentType(data)
+	ext, ok := imageTypes[mediaType]
+	if !ok {
+		return "", fmt.Errorf("unsupported image type %q", mediaType)
+	}
+	if err := os.MkdirAll(ImageDir, 0755); err != nil {
+		return "", err
+	}
+	filename := filepath.Join(ImageDir, fmt.Sprintf("%x.%s", sha256.Sum256(data), ext))
+	return filename, os.WriteFile(filename, data, 0644)
+}
+
+// thumbnail of each image in the message content
+func imagesHTML(parts []api.ContentPart) string {
+	var b strings.Builder
+	for _, p := range parts {
+		if p.Type != "image" {
+			continue
+		}
+		src := p.URL
+		if p.File != "" {
+			src = "/images/" + url.PathEscape(filepath.Base(p.File))
+		}
+		fmt.Fprintf(&b, `<img class="chat-image" src="%s">`, html.EscapeString(src))
+	}
+	return b.String()
+}
+
 func loadJSON(file string, v any) error {
 	if !strings.HasSuffix(file, ".json") {
 		file += ".json"
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"encoding/base64"
+	"path/filepath"
+	"testing"
+
+	"github.com/jnb666/gpt-go/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// 1x1 pixel PNG image
+var testImage = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR\x00\x00\x00\x01\x00\x00\x00\x01\x08\x06\x00\x00\x00\x1f\x15\xc4\x89" +
+	"\x00\x00\x00\rIDATx\x9cc\xf8\x0f\x00\x00\x01\x01\x00\x05\x18\xd8N\x00\x00\x00\x00IEND\xaeB`\x82")
+
+func TestSaveImages(t *testing.T) {
+	ImageDir = t.TempDir()
+	png := base64.StdEncoding.EncodeToString(testImage)
+	svg := base64.StdEncoding.EncodeToString([]byte(`<svg xmlns="http://www.w3.org/2000/svg"><script>alert(1)</script></svg>`))
+	parts := saveImages([]api.ContentPart{
+		api.TextPart("what is this?"),
+		api.ImagePart("data:image/png;base64," + png),
+		// claimed media type is ignored so can't be used to set the file name
+		api.ImagePart("data:image/x/../../../tmp/pwn;base64," + png),
+		api.ImagePart("data:image/svg+xml;base64," + svg),
+		api.ImageFile("/etc/passwd"),
+		{Type: "image", URL: "file:///etc/passwd"},
+		api.ImagePart("https://example.com/cat.jpg"),
+	})
+	require.Len(t, parts, 4)
+	assert.Equal(t, api.TextPart("what is this?"), parts[0])
+	assert.Equal(t, ImageDir, filepath.Dir(parts[1].File))
+	assert.Equal(t, ".png", filepath.Ext(parts[1].File))
+	assert.Equal(t, parts[1], parts[2])
+	assert.Equal(t, api.ImagePart("https://example.com/cat.jpg"), parts[3])
+	url, err := parts[1].ImageURL()
+	require.NoError(t, err)
+	assert.Equal(t, "data:image/png;base64,"+png, url)
+}
@@ -47,14 +47,14 @@ func Render(doc string) (string, error) {
 
 // Parsed Markdown content
 type Document struct {
-	BaseID     int
-	Title      string
-	Subtitle   string
-	URL        string
-	Links      []Link
-	Lines      []string
-	StartLine  int
-	WrapColumn int
+	BaseID     int      `json:"base_id"`
+	Title      string   `json:"title"`
+	Subtitle   string   `json:"subtitle,omitzero"`
+	URL        string   `json:"url"`
+	Links      []Link   `json:"links,omitzero"`
+	Lines      []string `json:"lines,omitzero"`
+	StartLine  int      `json:"start_line,omitzero"`
+	WrapColumn int      `json:"wrap_column,omitzero"`
 }
 
 // Link extracted from document
@@ -0,0 +1,221 @@
+// Package metrics provides counters, gauges and histograms which are exported in the Prometheus text format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Default bucket upper bounds for durations in seconds
+var DefaultBuckets = []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120}
+
+// Metrics registered with the default registry - used by New{Counter,Gauge,Histogram} and Handler
+var Default = NewRegistry()
+
+// Set of metrics which are written in the order they were registered
+type Registry struct {
+	mu      sync.Mutex
+	metrics []*metric
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// HTTP handler which writes all the metrics in the default registry
+func Handler() http.Handler {
+	return Default
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteTo(w)
+}
+
+// Write metrics in Prometheus text exposition format. Series for each metric are sorted by label values.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	list := slices.Clone(r.metrics)
+	r.mu.Unlock()
+	var b strings.Builder
+	for _, m := range list {
+		m.write(&b)
+	}
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+func (r *Registry) register(m *metric) *metric {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics = append(r.metrics, m)
+	return m
+}
+
+// Counter which only increases, with optional labels
+type Counter struct{ *metric }
+
+// Register new counter with the default registry
+func NewCounter(name, help string, labels ...string) Counter {
+	return Default.NewCounter(name, help, labels...)
+}
+
+func (r *Registry) NewCounter(name, help string, labels ...string) Counter {
+	return Counter{r.register(newMetric("counter", name, help, labels, nil))}
+}
+
+// Increment counter for the given label values
+func (c Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c Counter) Add(v float64, labelValues ...string) {
+	c.update(labelValues, func(s *series) { s.value += v })
+}
+
+// Gauge which can go up or down, with optional labels
+type Gauge struct{ *metric }
+
+// Register new gauge with the default registry
+func NewGauge(name, help string, labels ...string) Gauge {
+	return Default.NewGauge(name, help, labels...)
+}
+
+func (r *Registry) NewGauge(name, help string, labels ...string) Gauge {
+	return Gauge{r.register(newMetric("gauge", name, help, labels, nil))}
+}
+
+func (g Gauge) Set(v float64, labelValues ...string) {
+	g.update(labelValues, func(s *series) { s.value = v })
+}
+
+func (g Gauge) Add(v float64, labelValues ...string) {
+	g.update(labelValues, func(s *series) { s.value += v })
+}
+
+func (g Gauge) Inc(labelValues ...string) {
+	g.Add(1, labelValues...)
+}
+
+func (g Gauge) Dec(labelValues ...string) {
+	g.Add(-1, labelValues...)
+}
+
+// Histogram of observed values with cumulative buckets, with optional labels
+type Histogram struct{ *metric }
+
+// Register new histogram with the default registry - buckets are the sorted upper bounds, DefaultBuckets if nil
+func NewHistogram(name, help string, buckets []float64, labels ...string) Histogram {
+	return Default.NewHistogram(name, help, buckets, labels...)
+}
+
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) Histogram {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	return Histogram{r.register(newMetric("histogram", name, help, labels, buckets))}
+}
+
+func (h Histogram) Observe(v float64, labelValues ...string) {
+	h.update(labelValues, func(s *series) {
+		for i, le := range h.buckets {
+			if v <= le {
+				s.counts[i]++
+			}
+		}
+		s.value += v
+		s.count++
+	})
+}
+
+type metric struct {
+	mu      sync.Mutex
+	kind    string
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	series  map[string]*series // keyed by label values joined with a zero byte
+}
+
+type series struct {
+	labelValues []string
+	value       float64  // current value or sum of observations
+	counts      []uint64 // histogram only
+	count       uint64
+}
+
+func newMetric(kind, name, help string, labels []string, buckets []float64) *metric {
+	return &metric{kind: kind, name: name, help: help, labels: labels, buckets: buckets, series: map[string]*series{}}
+}
+
+func (m *metric) update(labelValues []string, fn func(s *series)) {
+	if len(labelValues) != len(m.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", m.name, len(m.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\x00")
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.series[key]
+	if !ok {
+		s = &series{labelValues: slices.Clone(labelValues), counts: make([]uint64, len(m.buckets))}
+		m.series[key] = s
+	}
+	fn(s)
+}
+
+func (m *metric) write(b *strings.Builder) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fmt.Fprintf(b, "# HELP %s %s\n", m.name, strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(m.help))
+	fmt.Fprintf(b, "# TYPE %s %s\n", m.name, m.kind)
+	for _, key := range slices.Sorted(maps.Keys(m.series)) {
+		s := m.series[key]
+		if m.kind != "histogram" {
+			fmt.Fprintf(b, "%s%s %s\n", m.name, m.labelString(s.labelValues, ""), formatFloat(s.value))
+			continue
+		}
+		for i, le := range m.buckets {
+			fmt.Fprintf(b, "%s_bucket%s %d\n", m.name, m.labelString(s.labelValues, formatFloat(le)), s.counts[i])
+		}
+		fmt.Fprintf(b, "%s_bucket%s %d\n", m.name, m.labelString(s.labelValues, "+Inf"), s.count)
+		fmt.Fprintf(b, "%s_sum%s %s\n", m.name, m.labelString(s.labelValues, ""), formatFloat(s.value))
+		fmt.Fprintf(b, "%s_count%s %d\n", m.name, m.labelString(s.labelValues, ""), s.count)
+	}
+}
+
+// labels in {name="value",...} format with the le label appended if set
+func (m *metric) labelString(values []string, le string) string {
+	var pairs []string
+	for i, name := range m.labels {
+		pairs = append(pairs, name+"="+quote(values[i]))
+	}
+	if le != "" {
+		pairs = append(pairs, "le="+quote(le))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func quote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
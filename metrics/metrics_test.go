@@ -0,0 +1,59 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	r := NewRegistry()
+	calls := r.NewCounter("test_calls_total", "Number of calls.", "tool")
+	running := r.NewGauge("test_running", "Number running.")
+	duration := r.NewHistogram("test_duration_seconds", "Elapsed time.", []float64{0.1, 1}, "tool")
+
+	calls.Inc("search")
+	calls.Add(2, `say "hi"`)
+	running.Inc()
+	running.Inc()
+	running.Dec()
+	duration.Observe(0.05, "search")
+	duration.Observe(0.5, "search")
+	duration.Observe(5, "search")
+
+	var b strings.Builder
+	_, err := r.WriteTo(&b)
+	require.NoError(t, err)
+	t.Log("\n" + b.String())
+	assert.Equal(t, `# HELP test_calls_total Number of calls.
+# TYPE test_calls_total counter
+test_calls_total{tool="say \"hi\""} 2
+test_calls_total{tool="search"} 1
+# HELP test_running Number running.
+# TYPE test_running gauge
+test_running 1
+# HELP test_duration_seconds Elapsed time.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{tool="search",le="0.1"} 1
+test_duration_seconds_bucket{tool="search",le="1"} 2
+test_duration_seconds_bucket{tool="search",le="+Inf"} 3
+test_duration_seconds_sum{tool="search"} 5.55
+test_duration_seconds_count{tool="search"} 3
+`, b.String())
+}
+
+func TestHandler(t *testing.T) {
+	NewCounter("test_handler_total", "Handler test.").Inc()
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Body.String(), "test_handler_total 1\n")
+}
+
+func TestLabelMismatch(t *testing.T) {
+	c := NewRegistry().NewCounter("test_total", "Test.", "a", "b")
+	assert.Panics(t, func() { c.Inc("x") })
+}
@@ -2,6 +2,7 @@
 package scrape
 
 import (
+	"context"
 	"fmt"
 	"math/rand/v2"
 	"net/url"
@@ -12,6 +13,7 @@ import (
 	"runtime"
 	"slices"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/JohannesKaufmann/html-to-markdown/v2/converter"
@@ -19,10 +21,21 @@ import (
 	"github.com/JohannesKaufmann/html-to-markdown/v2/plugin/commonmark"
 	"github.com/JohannesKaufmann/html-to-markdown/v2/plugin/table"
 	"github.com/PuerkitoBio/goquery"
+	"github.com/jnb666/gpt-go/metrics"
 	"github.com/playwright-community/playwright-go"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// Scrape requests by cache result exported by the metrics package - the hit rate is hit / (hit + miss)
+var cacheRequests = metrics.NewCounter("gpt_scrape_requests_total", "Number of scrape requests by cache result - hit or miss.", "cache")
+
+// OpenTelemetry tracer using the global tracer provider
+var tracer = otel.Tracer("github.com/jnb666/gpt-go/scrape")
+
 type Options struct {
 	Timeout              time.Duration // Timeout for each goto request
 	MaxAge               time.Duration // Used cached response if age of request less than this
@@ -54,19 +67,21 @@ func DefaultOptions() Options {
 	return opts
 }
 
-// Browser instance
+// Browser instance - Scrape may be called concurrently from multiple goroutines
 type Browser struct {
 	playwright *playwright.Playwright
 	browser    playwright.Browser
 	cache      map[string]Response
 	opts       Options
+	mu         *sync.Mutex // guards cache
+	cdp        *sync.Mutex // held while scraping a page via the CDP endpoint
 }
 
 // Load new firefox browser. If withOptions is set it can be used to override DefaultOptions. Will panic on error.
 func NewBrowser(withOptions ...func(*Options)) Browser {
 	log.Info("scrape: new browser")
 	var err error
-	b := Browser{cache: map[string]Response{}, opts: DefaultOptions()}
+	b := Browser{cache: map[string]Response{}, opts: DefaultOptions(), mu: new(sync.Mutex), cdp: new(sync.Mutex)}
 	if len(withOptions) > 0 && withOptions[0] != nil {
 		withOptions[0](&b.opts)
 	}
@@ -107,6 +122,21 @@ type Response struct {
 
 // Scrape HTML content from given URL and convert to Markdown. referer is optional. If withOptions is specified it can be used to override the default options.
 func (b Browser) Scrape(uri string) (r Response, err error) {
+	return b.ScrapeContext(context.Background(), uri)
+}
+
+// As per Scrape but records a trace span as a child of any span in ctx with the URL, status and cache result.
+func (b Browser) ScrapeContext(ctx context.Context, uri string) (r Response, err error) {
+	_, span := tracer.Start(ctx, "scrape", trace.WithAttributes(attribute.String("url.full", uri)))
+	cached := false
+	defer func() {
+		span.SetAttributes(attribute.Bool("gpt.scrape.cache_hit", cached), attribute.Int("http.response.status_code", r.Status))
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
 	opt := b.opts
 	host := getHost(uri)
 	for _, domain := range cookieAddonDomains {
@@ -121,10 +151,16 @@ func (b Browser) Scrape(uri string) (r Response, err error) {
 		}
 	}
 	log.Debugf("scrape options: %+v", opt)
-	if r, ok := b.cache[uri]; ok && r.Status == 200 && time.Since(r.Timestamp) < opt.MaxAge {
+	b.mu.Lock()
+	r, ok := b.cache[uri]
+	b.mu.Unlock()
+	if ok && r.Status == 200 && time.Since(r.Timestamp) < opt.MaxAge {
 		log.Debugf("scrape: get %s from cache", uri)
+		cacheRequests.Inc("hit")
+		cached = true
 		return r, nil
 	}
+	cacheRequests.Inc("miss")
 	log.Info("scrape: ", uri)
 	if opt.MaxSpeed > 0 {
 		b.delay(uri, opt.MaxSpeed)
@@ -137,7 +173,9 @@ func (b Browser) Scrape(uri string) (r Response, err error) {
 	if err != nil {
 		return r, err
 	}
+	b.mu.Lock()
 	b.cache[uri] = r
+	b.mu.Unlock()
 	return r, nil
 }
 
@@ -146,6 +184,9 @@ func (b Browser) scrape(uri string, opt Options) (r Response, err error) {
 	viewport := playwright.Size{Width: 1280 + rand.IntN(400), Height: 720 + rand.IntN(200)}
 	var page playwright.Page
 	if opt.CDPEndpoint != "" {
+		// only a single page is used so requests must be serialised
+		b.cdp.Lock()
+		defer b.cdp.Unlock()
 		b.browser, err = b.playwright.Chromium.ConnectOverCDP(opt.CDPEndpoint)
 		if err != nil {
 			return r, err
@@ -289,11 +330,13 @@ func getContent(page playwright.Page, opt Options) (content, title string, err e
 func (b Browser) delay(uri string, maxSpeed time.Duration) {
 	host := getHost(uri)
 	latest := 24 * time.Hour
+	b.mu.Lock()
 	for key, val := range b.cache {
 		if getHost(key) == host {
 			latest = min(latest, time.Since(val.Timestamp))
 		}
 	}
+	b.mu.Unlock()
 	if latest < maxSpeed {
 		d := maxSpeed - latest
 		log.Debugf("scrape: sleep for %s", d.Round(time.Millisecond))
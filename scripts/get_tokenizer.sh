@@ -0,0 +1,10 @@
+#!/bin/bash
+# script to download the o200k_base vocab used for local token counting with hosted providers
+
+CACHE_DIR="${XDG_CACHE_HOME:-$HOME/.cache}/gpt-go"
+URL="https://openaipublic.blob.core.windows.net/encodings/o200k_base.tiktoken"
+
+OUT_FILE="${1:-$CACHE_DIR/o200k_base.tiktoken}"
+
+mkdir -p `dirname "$OUT_FILE"`
+curl -fsSL -o "$OUT_FILE" "$URL" && echo "saved to $OUT_FILE"
@@ -0,0 +1,47 @@
+// Package tracing configures the OpenTelemetry tracer provider used by the api, scrape and python packages.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// Exporter types accepted by Init
+const (
+	OTLP   = "otlp"   // OTLP over HTTP - endpoint and headers are set with the standard OTEL_EXPORTER_OTLP_* environment variables
+	Stdout = "stdout" // pretty printed JSON written to stderr for local debugging
+)
+
+// Set the global tracer provider to export spans with the given exporter type. The returned shutdown function
+// should be called before the program exits to flush any pending spans.
+func Init(ctx context.Context, exporter, serviceName string) (shutdown func(context.Context) error, err error) {
+	var exp sdktrace.SpanExporter
+	switch exporter {
+	case OTLP:
+		exp, err = otlptracehttp.New(ctx)
+	case Stdout:
+		exp, err = stdouttrace.New(stdouttrace.WithWriter(os.Stderr), stdouttrace.WithPrettyPrint())
+	default:
+		return nil, fmt.Errorf("tracing: unknown exporter %q - should be %s or %s", exporter, OTLP, Stdout)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("tracing: error creating %s exporter: %w", exporter, err)
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(attribute.String("service.name", serviceName)))
+	if err != nil {
+		return nil, err
+	}
+	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exp), sdktrace.WithResource(res))
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return tp.Shutdown, nil
+}